@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
@@ -34,7 +37,14 @@ var (
 // @securityDefinitions.apiKey  RefreshApiKey
 // @in header
 // @name Authorization
+
+// @securityDefinitions.basic  ClientBasicAuth
 func main() {
+	rotateKeys := flag.Bool("rotate-keys", false, "replace the current signing key and exit")
+	clientSecretFor := flag.String("generate-client-secret", "",
+		"generate a new secret for the application with the given client id and exit")
+	flag.Parse()
+
 	if err := configs.InitConfig(); err != nil {
 		log.Fatal(err)
 	}
@@ -56,7 +66,35 @@ func main() {
 	}
 
 	repos := repository.NewRepository(db)
-	services := service.NewService(repos)
+	services, err := service.NewService(repos)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *rotateKeys {
+		if err := services.RotateKeys(); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("signing key has been rotated")
+		return
+	}
+
+	if *clientSecretFor != "" {
+		secret, err := services.GenerateClientSecret(*clientSecretFor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// printed instead of logged, so that the secret does not end up in the log files
+		fmt.Println(secret)
+		return
+	}
+
+	go services.RunKeyRotation(context.Background())
+	go services.RunDenylistSync(context.Background())
+	go services.RunDenylistCleanup(context.Background())
+	go services.RunReaper(context.Background())
+	go services.RunGeoIPReload(context.Background())
+
 	handlers := handler.NewHandler(services)
 
 	if strings.EqualFold(viper.GetString("logging.format"), "json") {
@@ -64,8 +102,13 @@ func main() {
 		log.Error("changing logger format is unavailable for now")
 	}
 
+	router, err := handlers.InitRoutes()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv := new(authServer.Server)
-	if err := srv.Run(viper.GetString("port"), handlers.InitRoutes()); err != nil {
+	if err := srv.Run(viper.GetString("port"), router); err != nil {
 		log.Fatal(err)
 	}
 }
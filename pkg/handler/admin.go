@@ -0,0 +1,386 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+type userListQuery struct {
+	Username    string `form:"username"`
+	Email       string `form:"email"`
+	Role        string `form:"role"`
+	CreatedFrom string `form:"created_from"`
+	CreatedTo   string `form:"created_to"`
+	Status      string `form:"status"`
+	Page        int    `form:"page"`
+	PerPage     int    `form:"per_page"`
+}
+
+// @Summary List users
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Paginated list of users. Username and email match parts of the value, dates are inclusive.
+// @Description Requires the manage_accounts permission
+// @ID admin-list-users
+// @Produce json
+// @Param username query string false "part of the username"
+// @Param email query string false "part of the email"
+// @Param role query string false "role name"
+// @Param created_from query string false "registered on or after the date (YYYY-MM-DD)"
+// @Param created_to query string false "registered on or before the date (YYYY-MM-DD)"
+// @Param status query string false "active or disabled"
+// @Param page query integer false "page number, starting at 1"
+// @Param per_page query integer false "users per page, 50 by default and at most 100"
+// @Success 200 {object} models.UserList
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users [get]
+func (h *Handler) AdminListUsers(ctx *gin.Context) {
+	var query userListQuery
+
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := models.UserFilter{Username: query.Username, Email: query.Email, Role: query.Role}
+
+	if query.CreatedFrom != "" {
+		createdFrom, err := time.Parse(dateLayout, query.CreatedFrom)
+		if err != nil {
+			newErrorResponse(ctx, http.StatusBadRequest, "created_from must be a date like 2006-01-02")
+			return
+		}
+		filter.CreatedFrom = &createdFrom
+	}
+	if query.CreatedTo != "" {
+		createdTo, err := time.Parse(dateLayout, query.CreatedTo)
+		if err != nil {
+			newErrorResponse(ctx, http.StatusBadRequest, "created_to must be a date like 2006-01-02")
+			return
+		}
+		createdBefore := createdTo.AddDate(0, 0, 1)
+		filter.CreatedBefore = &createdBefore
+	}
+
+	switch query.Status {
+	case "":
+	case "active", "disabled":
+		disabled := query.Status == "disabled"
+		filter.Disabled = &disabled
+	default:
+		newErrorResponse(ctx, http.StatusBadRequest, "status must be active or disabled")
+		return
+	}
+
+	users, err := h.services.GetUsers(filter, query.Page, query.PerPage)
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminListUsers")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, users)
+}
+
+// @Summary Get user
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description The account with its second factors and active sessions. Requires the manage_accounts permission
+// @ID admin-get-user
+// @Produce json
+// @Param id path integer true "user id"
+// @Success 200 {object} models.UserAccountDetails
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users/{id} [get]
+func (h *Handler) AdminGetUser(ctx *gin.Context) {
+	userId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	user, err := h.services.GetUserDetails(userId)
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminGetUser")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, user)
+}
+
+type userRoleInput struct {
+	RoleId uint `json:"role_id" binding:"required"`
+}
+
+// @Summary Change user role
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Assigns a role to the user, which takes effect with the next token refresh.
+// @Description Requires the manage_accounts permission
+// @ID admin-set-user-role
+// @Accept json
+// @Produce json
+// @Param id path integer true "user id"
+// @Param input body userRoleInput true "role id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users/{id}/role [put]
+func (h *Handler) AdminSetUserRole(ctx *gin.Context) {
+	var input userRoleInput
+
+	userId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.SetUserRole(uint(adminId), userId, input.RoleId, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, "AdminSetUserRole")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the role has been changed",
+	})
+}
+
+// @Summary Disable user
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Prevents the user from signing in and signs them out of all sessions.
+// @Description Requires the manage_accounts permission
+// @ID admin-disable-user
+// @Produce json
+// @Param id path integer true "user id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users/{id}/disable [post]
+func (h *Handler) AdminDisableUser(ctx *gin.Context) {
+	h.adminUserAction(ctx, h.services.DisableUser, "the user has been disabled", "AdminDisableUser")
+}
+
+// @Summary Enable user
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Allows a disabled user to sign in again. Requires the manage_accounts permission
+// @ID admin-enable-user
+// @Produce json
+// @Param id path integer true "user id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users/{id}/enable [post]
+func (h *Handler) AdminEnableUser(ctx *gin.Context) {
+	h.adminUserAction(ctx, h.services.EnableUser, "the user has been enabled", "AdminEnableUser")
+}
+
+// @Summary Force logout
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Signs the user out of all sessions. Requires the manage_accounts permission
+// @ID admin-logout-user
+// @Produce json
+// @Param id path integer true "user id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users/{id}/logout [post]
+func (h *Handler) AdminLogoutUser(ctx *gin.Context) {
+	h.adminUserAction(ctx, h.services.LogoutUser, "the user has been signed out of all sessions", "AdminLogoutUser")
+}
+
+// @Summary Delete user
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Deletes the account with all its data. Requires the manage_accounts permission
+// @ID admin-delete-user
+// @Produce json
+// @Param id path integer true "user id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/users/{id} [delete]
+func (h *Handler) AdminDeleteUser(ctx *gin.Context) {
+	h.adminUserAction(ctx, h.services.DeleteUser, "the user has been deleted", "AdminDeleteUser")
+}
+
+type auditLogQuery struct {
+	UserId  uint `form:"user_id"`
+	Page    int  `form:"page"`
+	PerPage int  `form:"per_page"`
+}
+
+// @Summary Get audit log
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Actions of administrators, newest first. Requires the manage_accounts permission
+// @ID admin-audit-log
+// @Produce json
+// @Param user_id query integer false "only actions on this user"
+// @Param page query integer false "page number, starting at 1"
+// @Param per_page query integer false "entries per page, 50 by default and at most 100"
+// @Success 200 {object} models.AuditLog
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/audit-log [get]
+func (h *Handler) AdminGetAuditLog(ctx *gin.Context) {
+	var query auditLogQuery
+
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	auditLog, err := h.services.GetAuditLog(query.UserId, query.Page, query.PerPage)
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminGetAuditLog")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, auditLog)
+}
+
+// adminUserAction runs an action of the signed in administrator on the user given by the id path parameter
+func (h *Handler) adminUserAction(ctx *gin.Context, action func(adminId, userId uint, ipAddress string) error,
+	message, function string) {
+	userId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := action(uint(adminId), userId, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, function)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": message,
+	})
+}
+
+func getIdParam(ctx *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil || id == 0 {
+		newErrorResponse(ctx, http.StatusBadRequest, "invalid id")
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+func newAdminErrorResponse(ctx *gin.Context, err error, function string) {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound), errors.Is(err, service.ErrRoleNotFound),
+		errors.Is(err, service.ErrPermissionNotFound):
+		newErrorResponse(ctx, http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrAdminSelfAction), errors.Is(err, service.ErrUnknownPermission),
+		errors.Is(err, service.ErrInvalidPermissionName):
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrRoleExists), errors.Is(err, service.ErrRoleInUse),
+		errors.Is(err, service.ErrDefaultRole), errors.Is(err, service.ErrLastAccountManager),
+		errors.Is(err, service.ErrPermissionExists):
+		newErrorResponse(ctx, http.StatusConflict, err.Error())
+	default:
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "admin.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("error while managing accounts")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// @Summary Get cleanup job status
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Runs of the jobs purging expired sessions, codes and revoked-token records on the instance answering
+// @Description the request. Runs another instance performed are counted as skipped. Requires the manage_accounts permission
+// @ID admin-jobs
+// @Produce json
+// @Success 200 {object} []models.ReaperJobStatus
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Router /admin/jobs [get]
+func (h *Handler) AdminGetJobs(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, h.services.GetReaperStatus())
+}
+
+// @Summary Rotate signing keys
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Immediately replaces the current signing key, e.g. when it may have leaked. Tokens signed with the
+// @Description previous key are accepted until they expire. Requires the manage_accounts and keys:rotate permissions
+// @ID admin-rotate-keys
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/keys/rotate [post]
+func (h *Handler) AdminRotateKeys(ctx *gin.Context) {
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	keyId, err := h.services.RotateSigningKeys(uint(adminId), ctx.ClientIP())
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminRotateKeys")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the signing key has been rotated",
+		"kid":     keyId,
+	})
+}
@@ -1,13 +1,13 @@
 package handler
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/th2empty/auth_service/pkg/models"
-	"github.com/th2empty/auth_service/pkg/utils"
+	"github.com/th2empty/auth_service/pkg/service"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -51,11 +51,14 @@ func (h *Handler) SignUp(ctx *gin.Context) {
 type signInInput struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	// RememberMe selects the longer session lifetimes of the remember-me policy
+	RememberMe bool `json:"remember_me"`
 }
 
 // @Summary SignIn
 // @Tags auth
-// @Description login
+// @Description login. Users with two-factor authentication get an mfa_token instead of tokens,
+// @Description which has to be exchanged at /auth/sign-in/mfa or /auth/sign-in/mfa/webauthn/finish
 // @ID login
 // @Accept json
 // @Produce json
@@ -64,6 +67,7 @@ type signInInput struct {
 // @Param input body signInInput true "account info"
 // @Success 200 {integer} integer 1
 // @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
 // @Failure 500 {object} errorResponse
 // @Router /auth/sign-in [post]
 func (h *Handler) SignIn(ctx *gin.Context) {
@@ -74,8 +78,21 @@ func (h *Handler) SignIn(ctx *gin.Context) {
 		return
 	}
 
-	user, err := h.services.GetUser(input.Username, utils.GeneratePasswordHash(input.Password))
+	user, err := h.services.GetUser(input.Username, input.Password)
 	if err != nil {
+		if event, ok := newLoginFailure(ctx, err, models.LoginMFANotReached); ok {
+			logLoginEventError(h.services.RecordPasswordFailure(input.Username, event), "SignIn")
+		}
+
+		if errors.Is(err, service.ErrInvalidCredentials) {
+			newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if errors.Is(err, service.ErrAccountDisabled) {
+			newErrorResponse(ctx, http.StatusForbidden, err.Error())
+			return
+		}
+
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
 			"file":     "auth.go",
@@ -85,47 +102,138 @@ func (h *Handler) SignIn(ctx *gin.Context) {
 		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
-	sessions, err := h.services.GetSessions(user.Id)
-	newSession := models.Session{
-		UserId:      user.Id,
-		IssusedAt:   uint64(time.Now().Unix()),
-		RefreshUUID: uuid.New().String(),
+
+	mfaMethods, err := h.services.GetMFAMethods(user.Id)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "auth.go",
+			"function": "SignIn",
+			"message":  err,
+		}).Errorf("error while checking second factor")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
 	}
-	if len(sessions) != 0 {
-		newSession.SessionId = sessions[len(sessions)-1].SessionId + 1
-	} else {
-		newSession.SessionId = 1
+
+	if len(mfaMethods) != 0 {
+		mfaToken, err := h.services.CreateMFAChallenge(user.Id)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "handler",
+				"file":     "auth.go",
+				"function": "SignIn",
+				"message":  err,
+			}).Errorf("error while creating mfa challenge")
+			newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		logLoginEventError(h.services.RecordLoginEvent(newLoginEvent(ctx, user.Id, models.LoginResultMFARequired,
+			models.LoginMFARequired, []string{service.AuthMethodPassword})), "SignIn")
+
+		ctx.JSON(http.StatusOK, mfaChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			MFAMethods:  mfaMethods,
+		})
+		return
+	}
+
+	h.signIn(ctx, user, []string{service.AuthMethodPassword}, input.RememberMe, "SignIn")
+}
+
+type mfaChallengeResponse struct {
+	MFARequired bool     `json:"mfa_required"`
+	MFAToken    string   `json:"mfa_token"`
+	MFAMethods  []string `json:"mfa_methods"`
+}
+
+type signInMFAInput struct {
+	MFAToken   string `json:"mfa_token" binding:"required"`
+	Code       string `json:"code" binding:"required"`
+	RememberMe bool   `json:"remember_me"`
+}
+
+// @Summary SignIn (second factor)
+// @Tags auth
+// @Description Completes the sign-in of a user with two-factor authentication with a code of the authenticator app
+// @Description or a recovery code. The mfa_token is returned by sign-in after the password has been verified
+// @ID login-mfa
+// @Accept json
+// @Produce json
+// @Param app_id header integer true "application id"
+// @Param os_name header string true "Operating system name"
+// @Param input body signInMFAInput true "mfa token and verification code"
+// @Success 200 {object} RefreshResponse
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 429 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /auth/sign-in/mfa [post]
+func (h *Handler) SignInMFA(ctx *gin.Context) {
+	var input signInMFAInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	tokens, err := h.services.Authorization.GenerateTokens(user, newSession)
+	user, methods, err := h.services.VerifyMFAChallenge(input.MFAToken, input.Code, ctx.ClientIP())
 	if err != nil {
+		if event, ok := newLoginFailure(ctx, err, models.LoginMFAFailed); ok {
+			logLoginEventError(h.services.RecordMFAFailure(input.MFAToken, event), "SignInMFA")
+		}
+
+		if errors.Is(err, service.ErrInvalidMFACode) || errors.Is(err, service.ErrInvalidMFAChallenge) {
+			newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if errors.Is(err, service.ErrMFALocked) {
+			newErrorResponse(ctx, http.StatusTooManyRequests, err.Error())
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "auth.go",
+			"function": "SignInMFA",
+			"message":  err,
+		}).Errorf("error while verifying mfa challenge")
 		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	newSession.RefreshToken = tokens[1]
-	appId, err := strconv.Atoi(ctx.GetHeader("app_id"))
-	if err != nil {
-		appId = 1
+	h.signIn(ctx, user, methods, input.RememberMe, "SignInMFA")
+}
+
+// signIn starts a session in the application given by the app_id header once the user is fully authenticated
+// with the methods (amr) and records the sign-in in the login history
+func (h *Handler) signIn(ctx *gin.Context, user models.User, methods []string, rememberMe bool, function string) {
+	mfa := models.LoginMFANotEnrolled
+	if len(methods) > 1 {
+		mfa = models.LoginMFAPassed
 	}
-	osName := ctx.GetHeader("os_name")
-	if len(osName) == 0 {
-		osName = "unknown"
+
+	tokens, err := h.startSession(ctx, user, models.Application{Id: getAppId(ctx)}, "", rememberMe)
+	if event, ok := newLoginFailure(ctx, err, mfa); ok {
+		event.UserId = user.Id
+		event.Methods = methods
+		logLoginEventError(h.services.RecordLoginEvent(event), function)
 	}
-	newSessionHistoryItem := models.SessionHistoryItem{
-		IpAddress: strings.Split(ctx.Request.RemoteAddr, ":")[0],
-		OS:        osName,
-		City:      "unknown",
-		AppId:     uint(appId),
-		Time:      uint64(time.Now().Unix()),
+	if err == nil {
+		logLoginEventError(h.services.RecordLoginEvent(newLoginEvent(ctx, user.Id, models.LoginResultSuccess, mfa,
+			methods)), function)
 	}
 
-	_, err = h.services.AddSession(newSession, newSessionHistoryItem)
+	if errors.Is(err, service.ErrAccountDisabled) {
+		newErrorResponse(ctx, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
 			"file":     "auth.go",
-			"function": "SignIn",
+			"function": function,
 			"message":  err,
 		}).Errorf("error while creating session")
 		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
@@ -138,6 +246,36 @@ func (h *Handler) SignIn(ctx *gin.Context) {
 	})
 }
 
+// startSession creates a session of the user in the application and issues its tokens. The client id and scope
+// are empty for first-party sign-ins and carried over to every token of sessions of OAuth clients. rememberMe
+// selects the remember-me session lifetimes
+func (h *Handler) startSession(ctx *gin.Context, user models.User, application models.Application, scope string,
+	rememberMe bool) ([]string, error) {
+	newSession := models.Session{
+		UserId:        user.Id,
+		IssusedAt:     uint64(time.Now().Unix()),
+		RefreshUUID:   uuid.New().String(),
+		Scope:         scope,
+		ClientId:      application.ClientId,
+		RememberMe:    rememberMe,
+		AllowedScopes: application.AllowedScopes,
+	}
+
+	osName := ctx.GetHeader("os_name")
+	if len(osName) == 0 {
+		osName = "unknown"
+	}
+	newSessionHistoryItem := models.SessionHistoryItem{
+		IpAddress: ctx.ClientIP(),
+		OS:        osName,
+		City:      "unknown",
+		AppId:     application.Id,
+		Time:      uint64(time.Now().Unix()),
+	}
+
+	return h.services.StartSession(user, newSession, newSessionHistoryItem)
+}
+
 // @Summary GetSessionsList
 // @Security ApiKeyAuth
 // @Tags account
@@ -164,7 +302,7 @@ func (h *Handler) GetSessionsDetails(ctx *gin.Context) {
 
 	claims, err := h.services.Authorization.ParseAccessToken(headerParts[1])
 	if err != nil {
-		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		newTokenErrorResponse(ctx, err)
 		return
 	}
 
@@ -210,11 +348,14 @@ func (h *Handler) Logout(ctx *gin.Context) {
 
 	claims, err := h.services.Authorization.ParseAccessToken(headerParts[1])
 	if err != nil {
-		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		newTokenErrorResponse(ctx, err)
 		return
 	}
 
-	err = h.services.Logout(claims.SessionId)
+	err = h.services.RevokeAccessToken(claims)
+	if err == nil {
+		err = h.services.Logout(claims.SessionId)
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
@@ -231,6 +372,86 @@ func (h *Handler) Logout(ctx *gin.Context) {
 	})
 }
 
+// @Summary Revoke session
+// @Security ApiKeyAuth
+// @Tags account
+// @Description Signs the user out of one of their sessions, e.g. an unknown device from the sessions list
+// @ID revoke-session
+// @Produce json
+// @Param id path integer true "session id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/sessions/{id} [delete]
+func (h *Handler) RevokeSession(ctx *gin.Context) {
+	sessionId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.RevokeSession(uint(userId), sessionId); err != nil {
+		if errors.Is(err, service.ErrSessionNotFound) {
+			newErrorResponse(ctx, http.StatusNotFound, err.Error())
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "auth.go",
+			"function": "RevokeSession",
+			"message":  err,
+		}).Errorf("failed to revoke session")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the session has been revoked",
+	})
+}
+
+// @Summary Revoke other sessions
+// @Security ApiKeyAuth
+// @Tags account
+// @Description Signs the user out of all devices except the current session
+// @ID revoke-other-sessions
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/sessions/revoke-others [post]
+func (h *Handler) RevokeOtherSessions(ctx *gin.Context) {
+	value, ok := ctx.Get(claimsCtx)
+	if !ok {
+		newErrorResponse(ctx, http.StatusUnauthorized, "access token not found")
+		return
+	}
+	claims := value.(*service.AccessTokenClaims)
+
+	revoked, err := h.services.RevokeOtherSessions(claims.UserId, claims.SessionId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "auth.go",
+			"function": "RevokeOtherSessions",
+			"message":  err,
+		}).Errorf("failed to revoke sessions")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]interface{}{
+		"revoked": revoked,
+	})
+}
+
 type RefreshResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -245,6 +466,7 @@ type RefreshResponse struct {
 // @Produce json
 // @Success 200 {object} RefreshResponse
 // @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
 // @Failure 500 {object} errorResponse
 // @Router /auth/refresh-token [post]
 func (h *Handler) RefreshToken(ctx *gin.Context) {
@@ -268,7 +490,7 @@ func (h *Handler) RefreshToken(ctx *gin.Context) {
 			"function": "RefreshToken",
 			"message":  err,
 		}).Errorf("error while parsing token")
-		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		newTokenErrorResponse(ctx, err)
 		return
 	}
 
@@ -284,7 +506,11 @@ func (h *Handler) RefreshToken(ctx *gin.Context) {
 		return
 	}
 
-	session, err := h.services.GetSessionById(claims.SessionID)
+	session, err := h.services.UseSession(claims.SessionID)
+	if errors.Is(err, service.ErrSessionExpired) {
+		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
@@ -296,14 +522,42 @@ func (h *Handler) RefreshToken(ctx *gin.Context) {
 		return
 	}
 
+	// sessions of OAuth clients are refreshed at the token endpoint, where the client is authenticated
+	if session.ClientId != "" {
+		newErrorResponse(ctx, http.StatusForbidden, "refresh tokens of OAuth clients have to be used at /oauth/token")
+		return
+	}
+
 	if session.RefreshUUID != claims.RefreshUUID {
+		reused, err := h.services.IsRefreshTokenReused(session.SessionId, claims.RefreshUUID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "handler",
+				"file":     "auth.go",
+				"function": "RefreshToken",
+				"message":  err,
+			}).Errorf("error while checking refresh token reuse")
+			newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if reused {
+			h.revokeSessionFamily(ctx, session)
+			return
+		}
+
 		newErrorResponse(ctx, http.StatusUnauthorized, "token ids do not match")
 		return
 	}
 
+	previousRefreshUUID := session.RefreshUUID
 	session.RefreshUUID = uuid.New().String()
 
 	tokens, err := h.services.Authorization.GenerateTokens(user, session)
+	if errors.Is(err, service.ErrAccountDisabled) {
+		newErrorResponse(ctx, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
@@ -316,7 +570,11 @@ func (h *Handler) RefreshToken(ctx *gin.Context) {
 	}
 
 	session.RefreshToken = tokens[1]
-	err = h.services.UpdateSession(session)
+	err = h.services.UpdateSession(session, previousRefreshUUID)
+	if errors.Is(err, service.ErrRefreshTokenReused) {
+		h.revokeSessionFamily(ctx, session)
+		return
+	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
@@ -333,3 +591,20 @@ func (h *Handler) RefreshToken(ctx *gin.Context) {
 		"refresh_token": tokens[1],
 	})
 }
+
+// revokeSessionFamily responds to the reuse of an already rotated refresh token
+// by revoking the whole session, since either the client or an attacker holds a stolen token
+func (h *Handler) revokeSessionFamily(ctx *gin.Context, session models.Session) {
+	if err := h.services.RevokeSessionFamily(session, ctx.ClientIP()); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "auth.go",
+			"function": "revokeSessionFamily",
+			"message":  err,
+		}).Errorf("failed to revoke session")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	newErrorResponse(ctx, http.StatusUnauthorized, service.ErrRefreshTokenReused.Error())
+}
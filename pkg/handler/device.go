@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+)
+
+// @Summary Device authorization
+// @Security ClientBasicAuth
+// @Tags oauth
+// @Description Device authorization endpoint (RFC 8628). Issues a device code for polling the token endpoint
+// @Description and a user code that the user enters on the verification page
+// @ID device-authorization
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param scope formData string false "requested scope"
+// @Param client_id formData string false "client id of a public client"
+// @Success 200 {object} models.DeviceAuthorizationResponse
+// @Failure 400 {object} oauthErrorResponse
+// @Failure 401 {object} oauthErrorResponse
+// @Failure 500 {object} oauthErrorResponse
+// @Router /oauth/device_authorization [post]
+func (h *Handler) DeviceAuthorization(ctx *gin.Context) {
+	application, err := getApplication(ctx)
+	if err != nil {
+		return
+	}
+
+	response, err := h.services.CreateDeviceAuthorization(application, ctx.PostForm("scope"))
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "DeviceAuthorization")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, response)
+}
+
+// @Summary Device verification
+// @Tags oauth
+// @Description Verification page of the device authorization grant
+// @ID device-verification
+// @Produce html
+// @Param user_code query string false "code shown on the device"
+// @Success 200
+// @Router /oauth/device [get]
+func (h *Handler) DeviceVerification(ctx *gin.Context) {
+	userCode := ctx.Query("user_code")
+	if userCode == "" {
+		renderDevicePage(ctx, http.StatusOK, devicePageData{})
+		return
+	}
+
+	code, err := h.services.GetDeviceAuthorization(userCode)
+	if err != nil {
+		h.renderDeviceError(ctx, userCode, err, "DeviceVerification")
+		return
+	}
+
+	renderDevicePage(ctx, http.StatusOK, devicePageData{ApplicationName: code.AppName, UserCode: userCode})
+}
+
+// @Summary Device verification (sign in)
+// @Tags oauth
+// @Description Submits the form of the device verification page
+// @ID device-verification-sign-in
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param user_code formData string true "code shown on the device"
+// @Param username formData string false "username"
+// @Param password formData string false "password"
+// @Param mfa_token formData string false "challenge of the second step of the sign-in"
+// @Param code formData string false "verification code of the second step"
+// @Param action formData string true "approve or deny"
+// @Success 200
+// @Failure 400
+// @Failure 401
+// @Router /oauth/device [post]
+func (h *Handler) DeviceVerificationSignIn(ctx *gin.Context) {
+	userCode := ctx.PostForm("user_code")
+
+	code, err := h.services.GetDeviceAuthorization(userCode)
+	if err != nil {
+		h.renderDeviceError(ctx, userCode, err, "DeviceVerificationSignIn")
+		return
+	}
+
+	user, _, mfaToken, err := h.formSignIn(ctx, code.AppId, "DeviceVerificationSignIn")
+	if err != nil {
+		if isSignInError(err) {
+			renderDevicePage(ctx, http.StatusUnauthorized, devicePageData{
+				ApplicationName: code.AppName,
+				UserCode:        userCode,
+				Error:           err.Error(),
+				MFAToken:        mfaToken,
+			})
+			return
+		}
+
+		h.renderDeviceError(ctx, userCode, err, "DeviceVerificationSignIn")
+		return
+	}
+	if mfaToken != "" {
+		renderDevicePage(ctx, http.StatusOK, devicePageData{
+			ApplicationName: code.AppName,
+			UserCode:        userCode,
+			MFAToken:        mfaToken,
+		})
+		return
+	}
+
+	approve := ctx.PostForm("action") == "approve"
+	if err := h.services.CompleteDeviceAuthorization(userCode, user.Id, approve); err != nil {
+		h.renderDeviceError(ctx, userCode, err, "DeviceVerificationSignIn")
+		return
+	}
+
+	message := "The device has been denied access. You can close this page."
+	if approve {
+		message = "The device is now connected to your account. You can return to it."
+	}
+	renderDevicePage(ctx, http.StatusOK, devicePageData{ApplicationName: code.AppName, Message: message})
+}
+
+type deviceApprovalInput struct {
+	UserCode string `json:"user_code" binding:"required"`
+	Approve  bool   `json:"approve"`
+}
+
+// @Summary Approve device
+// @Security ApiKeyAuth
+// @Tags account
+// @Description Approves or denies a device of the device authorization grant on behalf of the signed in user
+// @ID approve-device
+// @Accept json
+// @Produce json
+// @Param input body deviceApprovalInput true "user code shown on the device"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/device [post]
+func (h *Handler) ApproveDevice(ctx *gin.Context) {
+	var input deviceApprovalInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.CompleteDeviceAuthorization(input.UserCode, uint(userId), input.Approve); err != nil {
+		if errors.Is(err, service.ErrInvalidUserCode) {
+			newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "device.go",
+			"function": "ApproveDevice",
+			"message":  err,
+		}).Errorf("error while completing device authorization")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the device authorization has been completed",
+	})
+}
+
+func (h *Handler) exchangeDeviceCode(ctx *gin.Context, application models.Application, input tokenInput) {
+	code, err := h.services.PollDeviceCode(application, input.DeviceCode)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeDeviceCode")
+		return
+	}
+
+	user, err := h.services.GetUserById(*code.UserId)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeDeviceCode")
+		return
+	}
+
+	scope, err := h.services.GrantedScope(user.Id, application.AllowedScopes, code.Scope)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeDeviceCode")
+		return
+	}
+
+	tokens, err := h.startSession(ctx, user, application, code.Scope, false)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeDeviceCode")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, h.services.NewTokenResponse(tokens, scope))
+}
+
+func (h *Handler) renderDeviceError(ctx *gin.Context, userCode string, err error, function string) {
+	if errors.Is(err, service.ErrInvalidUserCode) {
+		renderDevicePage(ctx, http.StatusBadRequest, devicePageData{UserCode: userCode, Error: err.Error()})
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"package":  "handler",
+		"file":     "device.go",
+		"function": function,
+		"message":  err,
+	}).Errorf("error while processing device authorization")
+	renderDevicePage(ctx, http.StatusInternalServerError, devicePageData{UserCode: userCode,
+		Error: "something went wrong, please try again"})
+}
+
+func renderDevicePage(ctx *gin.Context, statusCode int, data devicePageData) {
+	var page bytes.Buffer
+	if err := devicePage.Execute(&page, data); err != nil {
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the page accepts credentials, so it must not be embedded by other sites
+	ctx.Header("X-Frame-Options", "DENY")
+	ctx.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Data(statusCode, "text/html; charset=utf-8", page.Bytes())
+	ctx.Abort()
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
 	"github.com/swaggo/files"
 	"github.com/swaggo/gin-swagger"
 	"github.com/th2empty/auth_service/pkg/service"
@@ -9,6 +10,10 @@ import (
 	_ "github.com/th2empty/auth_service/docs"
 )
 
+// trustedProxies are the addresses and networks of the reverse proxies in front of the server. The client IP of
+// requests is taken from X-Forwarded-For only if they come from one of them, otherwise the header could be forged
+var trustedProxies = viper.GetStringSlice("trusted_proxies")
+
 type Handler struct {
 	services *service.Service
 }
@@ -17,24 +22,106 @@ func NewHandler(services *service.Service) *Handler {
 	return &Handler{services: services}
 }
 
-func (h *Handler) InitRoutes() *gin.Engine {
+func (h *Handler) InitRoutes() (*gin.Engine, error) {
 	router := gin.New()
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, err
+	}
 
 	auth := router.Group("/auth")
 	{
 		auth.POST("/sign-up", h.SignUp)
 		auth.POST("/sign-in", h.SignIn)
+		auth.POST("/sign-in/mfa", h.SignInMFA)
+		auth.POST("/sign-in/mfa/webauthn/begin", h.BeginWebAuthnMFA)
+		auth.POST("/sign-in/mfa/webauthn/finish", h.FinishWebAuthnMFA)
+		auth.POST("/passkey/begin", h.BeginPasskeySignIn)
+		auth.POST("/passkey/finish", h.FinishPasskeySignIn)
 		auth.POST("/identity", h.userIdentity)
 		auth.POST("/refresh-token", h.RefreshToken)
 	}
 
-	account := router.Group("/account", h.userIdentity)
+	account := router.Group("/account", h.userIdentity, firstPartyOnly)
 	{
 		account.GET("/sessions", h.GetSessionsDetails)
+		account.DELETE("/sessions/:id", h.RevokeSession)
+		account.POST("/sessions/revoke-others", h.RevokeOtherSessions)
+		account.GET("/login-history", h.GetLoginHistory)
 		account.POST("/logout", h.Logout)
+		account.POST("/device", h.ApproveDevice)
+
+		mfa := account.Group("/mfa")
+		{
+			mfa.POST("/totp", h.EnrollTOTP)
+			mfa.POST("/totp/confirm", h.ConfirmTOTP)
+			mfa.DELETE("/totp", h.DisableTOTP)
+			mfa.POST("/recovery-codes", h.RegenerateRecoveryCodes)
+		}
+
+		webAuthn := account.Group("/webauthn")
+		{
+			webAuthn.POST("/register/begin", h.BeginWebAuthnRegistration)
+			webAuthn.POST("/register/finish", h.FinishWebAuthnRegistration)
+			webAuthn.GET("/credentials", h.GetWebAuthnCredentials)
+			webAuthn.DELETE("/credentials/:id", h.DeleteWebAuthnCredential)
+		}
+	}
+
+	admin := router.Group("/admin", h.userIdentity, firstPartyOnly, RequirePermission(service.PermissionManageAccounts))
+	{
+		users := admin.Group("/users")
+		{
+			users.GET("", h.AdminListUsers)
+			users.GET("/:id", h.AdminGetUser)
+			users.PUT("/:id/role", h.AdminSetUserRole)
+			users.POST("/:id/disable", h.AdminDisableUser)
+			users.POST("/:id/enable", h.AdminEnableUser)
+			users.POST("/:id/logout", h.AdminLogoutUser)
+			users.DELETE("/:id", h.AdminDeleteUser)
+		}
+
+		roles := admin.Group("/roles")
+		{
+			roles.GET("", h.AdminListRoles)
+			roles.POST("", h.AdminCreateRole)
+			roles.GET("/:id", h.AdminGetRole)
+			roles.PUT("/:id", h.AdminRenameRole)
+			roles.PUT("/:id/permissions", h.AdminSetRolePermissions)
+			roles.DELETE("/:id", h.AdminDeleteRole)
+			roles.GET("/:id/users", h.AdminListRoleUsers)
+		}
+
+		permissions := admin.Group("/permissions")
+		{
+			permissions.GET("", h.AdminListPermissions)
+			permissions.POST("", h.AdminCreatePermission)
+			permissions.PUT("/:id", h.AdminUpdatePermission)
+			permissions.DELETE("/:id", h.AdminDeletePermission)
+		}
+
+		admin.GET("/audit-log", h.AdminGetAuditLog)
+		admin.GET("/jobs", h.AdminGetJobs)
+		admin.POST("/keys/rotate", RequirePermission(service.PermissionRotateKeys), h.AdminRotateKeys)
 	}
 
+	oauth := router.Group("/oauth")
+	{
+		oauth.POST("/introspect", h.confidentialClientIdentity, h.IntrospectToken)
+		oauth.POST("/revoke", h.clientIdentity, h.RevokeToken)
+		oauth.GET("/authorize", h.Authorize)
+		oauth.POST("/authorize", h.AuthorizeSignIn)
+		oauth.POST("/token", h.clientIdentity, h.Token)
+		oauth.POST("/device_authorization", h.clientIdentity, h.DeviceAuthorization)
+		oauth.GET("/device", h.DeviceVerification)
+		oauth.POST("/device", h.DeviceVerificationSignIn)
+		oauth.GET("/userinfo", h.userIdentity, h.UserInfo)
+		oauth.POST("/userinfo", h.userIdentity, h.UserInfo)
+	}
+
+	router.GET("/.well-known/jwks.json", h.GetJWKS)
+	router.GET("/.well-known/openid-configuration", h.GetOpenIDConfiguration)
+
 	router.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	return router
+	return router, nil
 }
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/th2empty/auth_service/pkg/service"
+)
+
+// TestClientIP checks that X-Forwarded-For is only used when the request comes from a configured proxy
+func TestClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		proxies      []string
+		forwardedFor string
+		want         string
+	}{
+		{"no trusted proxies", []string{}, "203.0.113.7", "192.0.2.1"},
+		{"request from another address", []string{"198.51.100.0/24"}, "203.0.113.7", "192.0.2.1"},
+		{"request from a trusted proxy", []string{"192.0.2.1"}, "10.0.0.1, 203.0.113.7", "203.0.113.7"},
+		{"forged address behind a trusted proxy", []string{"192.0.2.1"}, "203.0.113.7, 192.0.2.2", "192.0.2.2"},
+		{"request through trusted proxies", []string{"192.0.2.0/24"}, "10.0.0.1, 203.0.113.7, 192.0.2.2",
+			"203.0.113.7"},
+	}
+
+	defer func(proxies []string) { trustedProxies = proxies }(trustedProxies)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = tt.proxies
+			router, err := NewHandler(&service.Service{}).InitRoutes()
+			if err != nil {
+				t.Fatalf("InitRoutes: %v", err)
+			}
+
+			var clientIP string
+			router.GET("/client-ip", func(ctx *gin.Context) {
+				clientIP = ctx.ClientIP()
+			})
+
+			request := httptest.NewRequest(http.MethodGet, "/client-ip", nil)
+			request.RemoteAddr = "192.0.2.1:51234"
+			request.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			router.ServeHTTP(httptest.NewRecorder(), request)
+
+			if clientIP != tt.want {
+				t.Errorf("got client IP %q, want %q", clientIP, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitRoutesRejectsInvalidTrustedProxies(t *testing.T) {
+	defer func(proxies []string) { trustedProxies = proxies }(trustedProxies)
+
+	trustedProxies = []string{"proxy.example.com"}
+	if _, err := NewHandler(&service.Service{}).InitRoutes(); err == nil {
+		t.Fatal("got no error for a host name")
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+	"strconv"
+)
+
+type loginHistoryQuery struct {
+	Page    int `form:"page"`
+	PerPage int `form:"per_page"`
+}
+
+// @Summary Get login history
+// @Security ApiKeyAuth
+// @Tags account
+// @Description Sign-in attempts on the account of the signed in user, newest first, including failed ones.
+// @Description The history is kept after the sessions have ended
+// @ID login-history
+// @Produce json
+// @Param page query integer false "page number, starting at 1"
+// @Param per_page query integer false "entries per page, 50 by default and at most 100"
+// @Success 200 {object} models.LoginHistory
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/login-history [get]
+func (h *Handler) GetLoginHistory(ctx *gin.Context) {
+	var query loginHistoryQuery
+
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	history, err := h.services.GetLoginHistory(uint(userId), query.Page, query.PerPage)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "login_history.go",
+			"function": "GetLoginHistory",
+			"message":  err,
+		}).Errorf("error while getting login history")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, history)
+}
+
+// getAppId returns the application given by the app_id header, the first one if the header is missing
+func getAppId(ctx *gin.Context) uint {
+	appId, err := strconv.Atoi(ctx.GetHeader("app_id"))
+	if err != nil || appId < 1 {
+		return 1
+	}
+
+	return uint(appId)
+}
+
+// newLoginEvent describes a sign-in attempt made with the request
+func newLoginEvent(ctx *gin.Context, userId uint, result, mfa string, methods []string) models.LoginEvent {
+	return models.LoginEvent{
+		UserId:    userId,
+		AppId:     getAppId(ctx),
+		Result:    result,
+		MFA:       mfa,
+		Methods:   methods,
+		IpAddress: ctx.ClientIP(),
+		UserAgent: ctx.Request.UserAgent(),
+		OS:        ctx.GetHeader("os_name"),
+	}
+}
+
+// newLoginFailure describes a failed sign-in attempt. Errors that are not caused by the credentials
+// of the attempt are not failures of the user and give false
+func newLoginFailure(ctx *gin.Context, err error, mfa string) (models.LoginEvent, bool) {
+	var reason string
+	switch {
+	case errors.Is(err, service.ErrInvalidCredentials):
+		reason = models.LoginFailureInvalidCredentials
+	case errors.Is(err, service.ErrAccountDisabled):
+		reason = models.LoginFailureAccountDisabled
+	case errors.Is(err, service.ErrInvalidMFACode):
+		reason = models.LoginFailureInvalidMFACode
+	case errors.Is(err, service.ErrMFALocked):
+		reason = models.LoginFailureMFALocked
+	case errors.Is(err, service.ErrInvalidMFAChallenge):
+		reason = models.LoginFailureMFAChallengeExpired
+	case errors.Is(err, service.ErrInvalidWebAuthnChallenge), errors.Is(err, service.ErrInvalidWebAuthnResponse):
+		reason = models.LoginFailureInvalidSecurityKey
+	default:
+		return models.LoginEvent{}, false
+	}
+
+	event := newLoginEvent(ctx, 0, models.LoginResultFailure, mfa, nil)
+	event.FailureReason = reason
+	return event, true
+}
+
+// logLoginEventError logs a failure to record a sign-in attempt, which does not fail the sign-in itself
+func logLoginEventError(err error, function string) {
+	if err == nil {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"package":  "handler",
+		"file":     "login_history.go",
+		"function": function,
+		"message":  err,
+	}).Errorf("failed to record login event")
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+)
+
+// @Summary Enroll TOTP
+// @Security ApiKeyAuth
+// @Tags mfa
+// @Description Generates a TOTP secret for an authenticator app. Two-factor authentication is enabled
+// @Description once the secret is confirmed with a code
+// @ID enroll-totp
+// @Produce json
+// @Success 200 {object} models.TOTPEnrollment
+// @Failure 401 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/mfa/totp [post]
+func (h *Handler) EnrollTOTP(ctx *gin.Context) {
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	user, err := h.services.GetUserById(uint(userId))
+	if err != nil {
+		newMFAErrorResponse(ctx, err, "EnrollTOTP")
+		return
+	}
+
+	enrollment, err := h.services.BeginTOTPEnrollment(user)
+	if err != nil {
+		newMFAErrorResponse(ctx, err, "EnrollTOTP")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+type totpCodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// @Summary Confirm TOTP
+// @Security ApiKeyAuth
+// @Tags mfa
+// @Description Enables two-factor authentication with a code of the authenticator app.
+// @Description Returns recovery codes, which are shown only once
+// @ID confirm-totp
+// @Accept json
+// @Produce json
+// @Param input body totpCodeInput true "verification code"
+// @Success 200 {object} recoveryCodesResponse
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/mfa/totp/confirm [post]
+func (h *Handler) ConfirmTOTP(ctx *gin.Context) {
+	var input totpCodeInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	recoveryCodes, err := h.services.ConfirmTOTPEnrollment(uint(userId), input.Code)
+	if err != nil {
+		newMFAErrorResponse(ctx, err, "ConfirmTOTP")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+// @Summary Disable TOTP
+// @Security ApiKeyAuth
+// @Tags mfa
+// @Description Disables two-factor authentication, which requires a current code or a recovery code
+// @ID disable-totp
+// @Accept json
+// @Produce json
+// @Param input body totpCodeInput true "verification code or recovery code"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 429 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/mfa/totp [delete]
+func (h *Handler) DisableTOTP(ctx *gin.Context) {
+	var input totpCodeInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.DisableTOTP(uint(userId), input.Code, ctx.ClientIP()); err != nil {
+		newMFAErrorResponse(ctx, err, "DisableTOTP")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "two-factor authentication is disabled",
+	})
+}
+
+// @Summary Regenerate recovery codes
+// @Security ApiKeyAuth
+// @Tags mfa
+// @Description Replaces all recovery codes with a new set, which requires a current code or a recovery code.
+// @Description The new codes are shown only once
+// @ID regenerate-recovery-codes
+// @Accept json
+// @Produce json
+// @Param input body totpCodeInput true "verification code or recovery code"
+// @Success 200 {object} recoveryCodesResponse
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 429 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/mfa/recovery-codes [post]
+func (h *Handler) RegenerateRecoveryCodes(ctx *gin.Context) {
+	var input totpCodeInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	recoveryCodes, err := h.services.RegenerateRecoveryCodes(uint(userId), input.Code, ctx.ClientIP())
+	if err != nil {
+		newMFAErrorResponse(ctx, err, "RegenerateRecoveryCodes")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+func newMFAErrorResponse(ctx *gin.Context, err error, function string) {
+	switch {
+	case errors.Is(err, service.ErrInvalidMFACode):
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrMFANotEnabled):
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		newErrorResponse(ctx, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrMFALocked):
+		newErrorResponse(ctx, http.StatusTooManyRequests, err.Error())
+	default:
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "mfa.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("error while managing second factor")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// formSignIn authenticates the user of an HTML sign-in form in one or two steps. The first step checks
+// the password; if the user has a second factor, a challenge token is returned instead of the user and
+// the form is shown again asking for the code. The user is only returned once all factors are verified.
+// Every attempt is recorded in the login history of the user like the sign-ins of the API, for the application
+// the user signs in to
+func (h *Handler) formSignIn(ctx *gin.Context, appId uint, function string) (user models.User, amr []string,
+	mfaToken string, err error) {
+	if mfaToken = ctx.PostForm("mfa_token"); mfaToken != "" {
+		user, amr, err = h.services.VerifyMFAChallenge(mfaToken, ctx.PostForm("code"), ctx.ClientIP())
+		if err != nil {
+			if event, ok := newLoginFailure(ctx, err, models.LoginMFAFailed); ok {
+				event.AppId = appId
+				logLoginEventError(h.services.RecordMFAFailure(mfaToken, event), function)
+			}
+			if errors.Is(err, service.ErrInvalidMFAChallenge) {
+				mfaToken = ""
+			}
+			return models.User{}, nil, mfaToken, err
+		}
+
+		h.recordFormSignIn(ctx, appId, user.Id, models.LoginResultSuccess, models.LoginMFAPassed, amr, function)
+		return user, amr, "", nil
+	}
+
+	username := ctx.PostForm("username")
+	user, err = h.services.GetUser(username, ctx.PostForm("password"))
+	if err != nil {
+		if event, ok := newLoginFailure(ctx, err, models.LoginMFANotReached); ok {
+			event.AppId = appId
+			logLoginEventError(h.services.RecordPasswordFailure(username, event), function)
+		}
+		return models.User{}, nil, "", err
+	}
+
+	amr = []string{service.AuthMethodPassword}
+	mfaEnabled, err := h.services.IsMFAEnabled(user.Id)
+	if err != nil {
+		return models.User{}, nil, "", err
+	}
+	if mfaEnabled {
+		mfaToken, err = h.services.CreateMFAChallenge(user.Id)
+		if err == nil {
+			h.recordFormSignIn(ctx, appId, user.Id, models.LoginResultMFARequired, models.LoginMFARequired, amr,
+				function)
+		}
+		return models.User{}, nil, mfaToken, err
+	}
+
+	h.recordFormSignIn(ctx, appId, user.Id, models.LoginResultSuccess, models.LoginMFANotEnrolled, amr, function)
+	return user, amr, "", nil
+}
+
+func (h *Handler) recordFormSignIn(ctx *gin.Context, appId, userId uint, result, mfa string, methods []string,
+	function string) {
+	event := newLoginEvent(ctx, userId, result, mfa, methods)
+	event.AppId = appId
+	logLoginEventError(h.services.RecordLoginEvent(event), function)
+}
+
+// isSignInError reports whether the error of formSignIn should be shown to the user
+func isSignInError(err error) bool {
+	return errors.Is(err, service.ErrInvalidCredentials) || errors.Is(err, service.ErrAccountDisabled) ||
+		errors.Is(err, service.ErrInvalidMFACode) || errors.Is(err, service.ErrInvalidMFAChallenge) ||
+		errors.Is(err, service.ErrMFALocked)
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+)
+
+// TestFormSignInRecordsLoginEvents checks that the sign-in forms of the authorization endpoint and
+// the device verification page write the login history like the sign-in of the API
+func TestFormSignInRecordsLoginEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		want   recordedLoginEvent
+		userId uint
+	}{
+		{
+			name: "wrong password",
+			form: url.Values{"username": {"alice"}, "password": {"wrong"}},
+			want: recordedLoginEvent{username: "alice", event: models.LoginEvent{Result: models.LoginResultFailure,
+				FailureReason: models.LoginFailureInvalidCredentials, MFA: models.LoginMFANotReached}},
+		},
+		{
+			name: "password without second factor",
+			form: url.Values{"username": {"alice"}, "password": {"secret"}},
+			want: recordedLoginEvent{event: models.LoginEvent{UserId: 1, Result: models.LoginResultSuccess,
+				MFA: models.LoginMFANotEnrolled}},
+			userId: 1,
+		},
+		{
+			name: "password with second factor",
+			form: url.Values{"username": {"bob"}, "password": {"secret"}},
+			want: recordedLoginEvent{event: models.LoginEvent{UserId: 2, Result: models.LoginResultMFARequired,
+				MFA: models.LoginMFARequired}},
+		},
+		{
+			name: "wrong code",
+			form: url.Values{"mfa_token": {"challenge"}, "code": {"000000"}},
+			want: recordedLoginEvent{mfaToken: "challenge", event: models.LoginEvent{Result: models.LoginResultFailure,
+				FailureReason: models.LoginFailureInvalidMFACode, MFA: models.LoginMFAFailed}},
+		},
+		{
+			name: "code",
+			form: url.Values{"mfa_token": {"challenge"}, "code": {"123456"}},
+			want: recordedLoginEvent{event: models.LoginEvent{UserId: 2, Result: models.LoginResultSuccess,
+				MFA: models.LoginMFAPassed}},
+			userId: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := &fakeLoginHistory{}
+			h := NewHandler(&service.Service{
+				Authorization: &fakeAuthorization{},
+				MFA:           &fakeMFA{},
+				LoginHistory:  history,
+			})
+
+			var user models.User
+			router := gin.New()
+			router.POST("/oauth/authorize", func(ctx *gin.Context) {
+				user, _, _, _ = h.formSignIn(ctx, 7, "AuthorizeSignIn")
+			})
+
+			request := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(tt.form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			router.ServeHTTP(httptest.NewRecorder(), request)
+
+			if user.Id != tt.userId {
+				t.Errorf("signed in user %d, want %d", user.Id, tt.userId)
+			}
+			if len(history.events) != 1 {
+				t.Fatalf("recorded %d login events, want 1", len(history.events))
+			}
+
+			got := history.events[0]
+			if got.username != tt.want.username || got.mfaToken != tt.want.mfaToken {
+				t.Errorf("recorded for username %q and mfa token %q, want %q and %q",
+					got.username, got.mfaToken, tt.want.username, tt.want.mfaToken)
+			}
+			if got.event.AppId != 7 {
+				t.Errorf("got app id %d, want 7", got.event.AppId)
+			}
+			if got.event.UserId != tt.want.event.UserId || got.event.Result != tt.want.event.Result ||
+				got.event.FailureReason != tt.want.event.FailureReason || got.event.MFA != tt.want.event.MFA {
+				t.Errorf("got event %+v, want %+v", got.event, tt.want.event)
+			}
+		})
+	}
+}
+
+// fakeAuthorization knows alice and bob, both with the password "secret"
+type fakeAuthorization struct {
+	service.Authorization
+}
+
+func (s *fakeAuthorization) GetUser(username, password string) (models.User, error) {
+	users := map[string]models.User{
+		"alice": {Id: 1, Username: "alice"},
+		"bob":   {Id: 2, Username: "bob"},
+	}
+
+	user, ok := users[username]
+	if !ok || password != "secret" {
+		return models.User{}, service.ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// fakeMFA enables two-factor authentication for bob, whose code is 123456
+type fakeMFA struct {
+	service.MFA
+}
+
+func (s *fakeMFA) IsMFAEnabled(userId uint) (bool, error) {
+	return userId == 2, nil
+}
+
+func (s *fakeMFA) CreateMFAChallenge(userId uint) (string, error) {
+	return "challenge", nil
+}
+
+func (s *fakeMFA) VerifyMFAChallenge(challengeToken, code, ipAddress string) (models.User, []string, error) {
+	if challengeToken != "challenge" {
+		return models.User{}, nil, service.ErrInvalidMFAChallenge
+	}
+	if code != "123456" {
+		return models.User{}, nil, service.ErrInvalidMFACode
+	}
+
+	return models.User{Id: 2, Username: "bob"}, []string{service.AuthMethodPassword, service.AuthMethodOTP}, nil
+}
+
+type recordedLoginEvent struct {
+	username string
+	mfaToken string
+	event    models.LoginEvent
+}
+
+type fakeLoginHistory struct {
+	service.LoginHistory
+	events []recordedLoginEvent
+}
+
+func (s *fakeLoginHistory) RecordLoginEvent(event models.LoginEvent) error {
+	s.events = append(s.events, recordedLoginEvent{event: event})
+	return nil
+}
+
+func (s *fakeLoginHistory) RecordPasswordFailure(username string, event models.LoginEvent) error {
+	s.events = append(s.events, recordedLoginEvent{username: username, event: event})
+	return nil
+}
+
+func (s *fakeLoginHistory) RecordMFAFailure(challengeToken string, event models.LoginEvent) error {
+	s.events = append(s.events, recordedLoginEvent{mfaToken: challengeToken, event: event})
+	return nil
+}
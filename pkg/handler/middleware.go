@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/service"
 	"net/http"
 	"strings"
 )
@@ -11,6 +12,7 @@ import (
 const (
 	authorizationHeader = "Authorization"
 	userCtx             = "userId"
+	claimsCtx           = "claims"
 )
 
 // @Summary Identity
@@ -38,11 +40,17 @@ func (h *Handler) userIdentity(ctx *gin.Context) {
 
 	claims, err := h.services.Authorization.ParseAccessToken(headerParts[1])
 	if err != nil {
-		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		newTokenErrorResponse(ctx, err)
 		return
 	}
 
-	if _, err := h.services.GetSessionById(claims.SessionId); err != nil {
+	// tokens of the client credentials grant do not act on behalf of a user
+	if claims.IsMachineToken() {
+		newTokenErrorResponse(ctx, service.ErrWrongTokenType)
+		return
+	}
+
+	if _, err := h.services.UseSession(claims.SessionId); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "handler",
 			"file":     "middleware.go",
@@ -52,6 +60,42 @@ func (h *Handler) userIdentity(ctx *gin.Context) {
 		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
 		return
 	}
+
+	ctx.Set(userCtx, int(claims.UserId))
+	ctx.Set(claimsCtx, claims)
+}
+
+// firstPartyOnly rejects access tokens issued to OAuth clients. It has to run after userIdentity on the endpoints
+// that manage the account, its credentials and sessions, which third-party applications must not use whatever
+// scope the user has consented to
+func firstPartyOnly(ctx *gin.Context) {
+	value, ok := ctx.Get(claimsCtx)
+	if !ok {
+		newErrorResponse(ctx, http.StatusUnauthorized, "access token not found")
+		return
+	}
+
+	if claims := value.(*service.AccessTokenClaims); claims.ClientId != "" {
+		newErrorResponse(ctx, http.StatusForbidden, "tokens issued to OAuth clients can not be used for this endpoint")
+		return
+	}
+}
+
+// RequirePermission rejects requests whose access token does not carry the permission of the user's role.
+// It has to run after userIdentity, e.g. router.Group("/admin", h.userIdentity, RequirePermission("manage_accounts"))
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		value, ok := ctx.Get(claimsCtx)
+		if !ok {
+			newErrorResponse(ctx, http.StatusUnauthorized, "access token not found")
+			return
+		}
+
+		if claims := value.(*service.AccessTokenClaims); !claims.HasPermission(permission) {
+			newErrorResponse(ctx, http.StatusForbidden, "the role of the user does not have the "+permission+" permission")
+			return
+		}
+	}
 }
 
 func getUserId(ctx *gin.Context) (int, error) {
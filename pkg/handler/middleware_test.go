@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/th2empty/auth_service/pkg/service"
+)
+
+func TestFirstPartyOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		claims *service.AccessTokenClaims
+		want   int
+	}{
+		{"first-party token", &service.AccessTokenClaims{UserId: 1, SessionId: 1}, http.StatusOK},
+		{"token of an OAuth client", &service.AccessTokenClaims{UserId: 1, SessionId: 1, ClientId: "app",
+			Scope: "openid " + service.PermissionManageAccounts}, http.StatusForbidden},
+		{"no token", nil, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/account/sessions", func(ctx *gin.Context) {
+				if tt.claims != nil {
+					ctx.Set(claimsCtx, tt.claims)
+				}
+			}, firstPartyOnly, func(ctx *gin.Context) {
+				ctx.Status(http.StatusOK)
+			})
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/account/sessions", nil))
+
+			if recorder.Code != tt.want {
+				t.Errorf("got status %d, want %d", recorder.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+	"net/url"
+)
+
+const (
+	applicationCtx = "application"
+)
+
+// clientIdentity authenticates the OAuth client with HTTP Basic authentication (client_secret_basic)
+// or with client_id and client_secret form parameters (client_secret_post).
+// Public clients only pass their client_id
+func (h *Handler) clientIdentity(ctx *gin.Context) {
+	clientId, clientSecret, ok := ctx.Request.BasicAuth()
+	if ok {
+		var err error
+		if clientId, err = url.QueryUnescape(clientId); err == nil {
+			clientSecret, err = url.QueryUnescape(clientSecret)
+		}
+		if err != nil {
+			ctx.Header("WWW-Authenticate", `Basic realm="oauth"`)
+			newOAuthErrorResponse(ctx, http.StatusUnauthorized, "invalid_client", "malformed client credentials")
+			return
+		}
+	} else {
+		clientId, clientSecret = ctx.PostForm("client_id"), ctx.PostForm("client_secret")
+	}
+
+	application, err := h.services.AuthenticateClient(clientId, clientSecret)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidClient) {
+			ctx.Header("WWW-Authenticate", `Basic realm="oauth"`)
+			newOAuthErrorResponse(ctx, http.StatusUnauthorized, "invalid_client", err.Error())
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "oauth.go",
+			"function": "clientIdentity",
+			"message":  err,
+		}).Errorf("error while authenticating client")
+		newOAuthErrorResponse(ctx, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	ctx.Set(applicationCtx, application)
+}
+
+// confidentialClientIdentity only lets through clients that have authenticated with a client secret
+func (h *Handler) confidentialClientIdentity(ctx *gin.Context) {
+	h.clientIdentity(ctx)
+	if ctx.IsAborted() {
+		return
+	}
+
+	application, err := getApplication(ctx)
+	if err != nil {
+		return
+	}
+
+	if !application.IsConfidential() {
+		ctx.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		newOAuthErrorResponse(ctx, http.StatusUnauthorized, "invalid_client",
+			"the endpoint is only available to confidential clients")
+	}
+}
+
+func getApplication(ctx *gin.Context) (models.Application, error) {
+	application, ok := ctx.Get(applicationCtx)
+	if !ok {
+		newOAuthErrorResponse(ctx, http.StatusInternalServerError, "server_error", "client not found")
+		return models.Application{}, errors.New("client not found")
+	}
+
+	app, ok := application.(models.Application)
+	if !ok {
+		newOAuthErrorResponse(ctx, http.StatusInternalServerError, "server_error", "client not found")
+		return models.Application{}, errors.New("client not found")
+	}
+
+	return app, nil
+}
+
+type introspectionInput struct {
+	Token         string `form:"token" binding:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+}
+
+// @Summary Introspect token
+// @Security ClientBasicAuth
+// @Tags oauth
+// @Description Token introspection (RFC 7662). The calling client must authenticate with its client credentials
+// @ID introspect-token
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "access or refresh token"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Success 200 {object} models.TokenIntrospection
+// @Failure 400 {object} oauthErrorResponse
+// @Failure 401 {object} oauthErrorResponse
+// @Router /oauth/introspect [post]
+func (h *Handler) IntrospectToken(ctx *gin.Context) {
+	var input introspectionInput
+
+	if err := ctx.ShouldBind(&input); err != nil {
+		newOAuthErrorResponse(ctx, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, h.services.IntrospectToken(input.Token, input.TokenTypeHint))
+}
+
+type revocationInput struct {
+	Token         string `form:"token" binding:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+}
+
+// @Summary Revoke token
+// @Security ClientBasicAuth
+// @Tags oauth
+// @Description Token revocation (RFC 7009). Revokes the session of an access or refresh token issued to the client.
+// @Description Public clients pass their client_id instead of authenticating
+// @ID revoke-token
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "access or refresh token"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Param client_id formData string false "client id of a public client"
+// @Success 200
+// @Failure 400 {object} oauthErrorResponse
+// @Failure 401 {object} oauthErrorResponse
+// @Failure 500 {object} oauthErrorResponse
+// @Router /oauth/revoke [post]
+func (h *Handler) RevokeToken(ctx *gin.Context) {
+	var input revocationInput
+
+	if err := ctx.ShouldBind(&input); err != nil {
+		newOAuthErrorResponse(ctx, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	application, err := getApplication(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.RevokeToken(application, input.Token, input.TokenTypeHint); err != nil {
+		if errors.Is(err, service.ErrUnauthorizedClient) {
+			newOAuthErrorResponse(ctx, http.StatusBadRequest, "unauthorized_client", err.Error())
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "oauth.go",
+			"function": "RevokeToken",
+			"message":  err,
+		}).Errorf("failed to revoke token")
+		newOAuthErrorResponse(ctx, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+// @Summary Authorize
+// @Tags oauth
+// @Description Authorization endpoint of the authorization code grant (RFC 6749) with mandatory PKCE (RFC 7636).
+// @Description Shows the sign-in page; after a successful sign-in the user is redirected to redirect_uri with a code
+// @ID authorize
+// @Produce html
+// @Param response_type query string true "must be 'code'"
+// @Param client_id query string true "client id"
+// @Param redirect_uri query string true "registered redirect uri"
+// @Param scope query string false "requested scope"
+// @Param state query string false "opaque value returned to the client"
+// @Param code_challenge query string true "BASE64URL(SHA256(code_verifier))"
+// @Param code_challenge_method query string true "must be 'S256'"
+// @Param nonce query string false "OpenID Connect nonce, returned in the id_token"
+// @Success 200
+// @Failure 302
+// @Failure 400
+// @Router /oauth/authorize [get]
+func (h *Handler) Authorize(ctx *gin.Context) {
+	request, application, ok := h.authorizationRequest(ctx)
+	if !ok {
+		return
+	}
+
+	renderLoginPage(ctx, http.StatusOK, loginPageData{ApplicationName: application.Name, Request: request})
+}
+
+// @Summary Authorize (sign in)
+// @Tags oauth
+// @Description Submits the sign-in form of the authorization endpoint
+// @ID authorize-sign-in
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param username formData string false "username"
+// @Param password formData string false "password"
+// @Param mfa_token formData string false "challenge of the second step of the sign-in"
+// @Param code formData string false "verification code of the second step"
+// @Success 302
+// @Failure 400
+// @Failure 401
+// @Router /oauth/authorize [post]
+func (h *Handler) AuthorizeSignIn(ctx *gin.Context) {
+	request, application, ok := h.authorizationRequest(ctx)
+	if !ok {
+		return
+	}
+
+	user, amr, mfaToken, err := h.formSignIn(ctx, application.Id, "AuthorizeSignIn")
+	if err != nil {
+		if isSignInError(err) {
+			renderLoginPage(ctx, http.StatusUnauthorized, loginPageData{
+				ApplicationName: application.Name,
+				Error:           err.Error(),
+				Request:         request,
+				MFAToken:        mfaToken,
+			})
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "oauth.go",
+			"function": "AuthorizeSignIn",
+			"message":  err,
+		}).Errorf("error while signing in user")
+		redirectWithError(ctx, request, "server_error", "")
+		return
+	}
+	if mfaToken != "" {
+		renderLoginPage(ctx, http.StatusOK, loginPageData{
+			ApplicationName: application.Name,
+			Request:         request,
+			MFAToken:        mfaToken,
+		})
+		return
+	}
+
+	code, err := h.services.CreateAuthorizationCode(application, user.Id, amr, request)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "oauth.go",
+			"function": "AuthorizeSignIn",
+			"message":  err,
+		}).Errorf("error while creating authorization code")
+		redirectWithError(ctx, request, "server_error", "")
+		return
+	}
+
+	redirectWithParams(ctx, request.RedirectURI, url.Values{"code": {code}, "state": {request.State}})
+}
+
+// authorizationRequest binds and validates the parameters of the authorization endpoint.
+// Requests with an unknown client or redirect uri are answered with an error page,
+// other invalid requests are redirected back to the client with an error
+func (h *Handler) authorizationRequest(ctx *gin.Context) (models.AuthorizationRequest, models.Application, bool) {
+	var request models.AuthorizationRequest
+
+	if err := ctx.ShouldBind(&request); err != nil {
+		renderLoginPage(ctx, http.StatusBadRequest, loginPageData{Error: err.Error()})
+		return request, models.Application{}, false
+	}
+
+	application, err := h.services.GetAuthorizationClient(request.ClientId, request.RedirectURI)
+	if errors.Is(err, service.ErrUnauthorizedClient) {
+		// the redirect URI is already verified, so the error can be sent to the client
+		redirectWithError(ctx, request, "unauthorized_client", "the client is not allowed to use the authorization_code grant")
+		return request, models.Application{}, false
+	}
+	if err != nil {
+		if !errors.Is(err, service.ErrInvalidClient) && !errors.Is(err, service.ErrInvalidRedirectURI) {
+			logrus.WithFields(logrus.Fields{
+				"package":  "handler",
+				"file":     "oauth.go",
+				"function": "authorizationRequest",
+				"message":  err,
+			}).Errorf("error while getting client")
+		}
+		renderLoginPage(ctx, http.StatusBadRequest, loginPageData{Error: err.Error()})
+		return request, models.Application{}, false
+	}
+
+	if err := h.services.ValidateAuthorizationRequest(application, request); err != nil {
+		var oauthErr *service.OAuthError
+		if errors.As(err, &oauthErr) {
+			redirectWithError(ctx, request, oauthErr.Code, oauthErr.Description)
+		} else {
+			redirectWithError(ctx, request, "server_error", "")
+		}
+		return request, models.Application{}, false
+	}
+
+	return request, application, true
+}
+
+func renderLoginPage(ctx *gin.Context, statusCode int, data loginPageData) {
+	var page bytes.Buffer
+	if err := loginPage.Execute(&page, data); err != nil {
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the page accepts credentials, so it must not be embedded by other sites
+	ctx.Header("X-Frame-Options", "DENY")
+	ctx.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Data(statusCode, "text/html; charset=utf-8", page.Bytes())
+	ctx.Abort()
+}
+
+func redirectWithError(ctx *gin.Context, request models.AuthorizationRequest, code, description string) {
+	params := url.Values{"error": {code}}
+	if description != "" {
+		params.Set("error_description", description)
+	}
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+
+	redirectWithParams(ctx, request.RedirectURI, params)
+}
+
+func redirectWithParams(ctx *gin.Context, redirectURI string, params url.Values) {
+	location, err := url.Parse(redirectURI)
+	if err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := location.Query()
+	for key, values := range params {
+		if len(values) != 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	location.RawQuery = query.Encode()
+
+	ctx.Redirect(http.StatusFound, location.String())
+	ctx.Abort()
+}
+
+type tokenInput struct {
+	GrantType    string `form:"grant_type" binding:"required"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	Scope        string `form:"scope"`
+	DeviceCode   string `form:"device_code"`
+	RefreshToken string `form:"refresh_token"`
+}
+
+// @Summary Token
+// @Security ClientBasicAuth
+// @Tags oauth
+// @Description Token endpoint (RFC 6749). Supported grant types: authorization_code (with PKCE), refresh_token,
+// @Description client_credentials and urn:ietf:params:oauth:grant-type:device_code.
+// @Description Public clients pass their client_id instead of authenticating
+// @ID token
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "grant type"
+// @Param code formData string false "authorization code"
+// @Param redirect_uri formData string false "redirect uri of the authorization request"
+// @Param code_verifier formData string false "PKCE code verifier"
+// @Param scope formData string false "space separated scopes requested with the client_credentials grant"
+// @Param device_code formData string false "device code of the device authorization grant"
+// @Param refresh_token formData string false "refresh token issued to the client"
+// @Param client_id formData string false "client id of a public client"
+// @Success 200 {object} models.TokenResponse
+// @Failure 400 {object} oauthErrorResponse
+// @Failure 401 {object} oauthErrorResponse
+// @Failure 500 {object} oauthErrorResponse
+// @Router /oauth/token [post]
+func (h *Handler) Token(ctx *gin.Context) {
+	var input tokenInput
+
+	if err := ctx.ShouldBind(&input); err != nil {
+		newOAuthErrorResponse(ctx, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	application, err := getApplication(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Pragma", "no-cache")
+
+	switch input.GrantType {
+	case service.GrantTypeAuthorizationCode:
+		h.exchangeAuthorizationCode(ctx, application, input)
+	case service.GrantTypeRefreshToken:
+		h.refreshClientSession(ctx, application, input)
+	case service.GrantTypeClientCredentials:
+		h.issueClientCredentialsToken(ctx, application, input)
+	case service.GrantTypeDeviceCode:
+		h.exchangeDeviceCode(ctx, application, input)
+	default:
+		newOAuthErrorResponse(ctx, http.StatusBadRequest, "unsupported_grant_type",
+			"the grant type is not supported")
+	}
+}
+
+func (h *Handler) exchangeAuthorizationCode(ctx *gin.Context, application models.Application, input tokenInput) {
+	code, err := h.services.ExchangeAuthorizationCode(application, input.Code, input.RedirectURI, input.CodeVerifier)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeAuthorizationCode")
+		return
+	}
+
+	user, err := h.services.GetUserById(code.UserId)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeAuthorizationCode")
+		return
+	}
+
+	// everything that can fail is done before the session is started, so that a failed exchange
+	// does not leave a session behind whose tokens the client never received
+	scope, err := h.services.GrantedScope(user.Id, application.AllowedScopes, code.Scope)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeAuthorizationCode")
+		return
+	}
+
+	var idToken string
+	if service.HasScope(code.Scope, service.ScopeOpenID) {
+		if idToken, err = h.services.GenerateIdToken(user, application, code); err != nil {
+			newOAuthServiceErrorResponse(ctx, err, "exchangeAuthorizationCode")
+			return
+		}
+	}
+
+	tokens, err := h.startSession(ctx, user, application, code.Scope, false)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "exchangeAuthorizationCode")
+		return
+	}
+
+	response := h.services.NewTokenResponse(tokens, scope)
+	response.IdToken = idToken
+
+	ctx.JSON(http.StatusOK, response)
+}
+
+func (h *Handler) refreshClientSession(ctx *gin.Context, application models.Application, input tokenInput) {
+	response, err := h.services.RefreshClientSession(application, input.RefreshToken, input.Scope, ctx.ClientIP())
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "refreshClientSession")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, response)
+}
+
+func (h *Handler) issueClientCredentialsToken(ctx *gin.Context, application models.Application, input tokenInput) {
+	response, err := h.services.IssueClientCredentialsToken(application, input.Scope)
+	if err != nil {
+		newOAuthServiceErrorResponse(ctx, err, "issueClientCredentialsToken")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, response)
+}
+
+// newOAuthServiceErrorResponse responds with the OAuth error returned by the service,
+// other errors are logged and reported as server_error
+func newOAuthServiceErrorResponse(ctx *gin.Context, err error, function string) {
+	var oauthErr *service.OAuthError
+	if errors.As(err, &oauthErr) {
+		newOAuthErrorResponse(ctx, http.StatusBadRequest, oauthErr.Code, oauthErr.Description)
+		return
+	}
+	if errors.Is(err, service.ErrAccountDisabled) {
+		newOAuthErrorResponse(ctx, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"package":  "handler",
+		"file":     "oauth.go",
+		"function": function,
+		"message":  err,
+	}).Errorf("error while processing oauth request")
+	newOAuthErrorResponse(ctx, http.StatusInternalServerError, "server_error", err.Error())
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+)
+
+// @Summary OpenID configuration
+// @Tags openid
+// @Description OpenID Provider metadata (OpenID Connect Discovery 1.0)
+// @ID openid-configuration
+// @Produce json
+// @Success 200 {object} models.OpenIDConfiguration
+// @Failure 404 {object} errorResponse
+// @Router /.well-known/openid-configuration [get]
+func (h *Handler) GetOpenIDConfiguration(ctx *gin.Context) {
+	configuration, err := h.services.GetOpenIDConfiguration()
+	if err != nil {
+		newErrorResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	}
+
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, configuration)
+}
+
+// @Summary UserInfo
+// @Security ApiKeyAuth
+// @Tags openid
+// @Description Claims about the signed in user (OpenID Connect Core 1.0, section 5.3).
+// @Description Tokens issued to OAuth clients need the openid scope
+// @ID userinfo
+// @Produce json
+// @Success 200 {object} models.UserInfo
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /oauth/userinfo [get]
+// @Router /oauth/userinfo [post]
+func (h *Handler) UserInfo(ctx *gin.Context) {
+	value, ok := ctx.Get(claimsCtx)
+	if !ok {
+		newErrorResponse(ctx, http.StatusUnauthorized, "access token not found")
+		return
+	}
+	claims := value.(*service.AccessTokenClaims)
+
+	// first-party tokens see all claims, tokens of OAuth clients need the openid scope
+	if claims.ClientId != "" && !service.HasScope(claims.Scope, service.ScopeOpenID) {
+		ctx.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		newErrorResponse(ctx, http.StatusForbidden, "the access token was not granted the openid scope")
+		return
+	}
+
+	info, err := h.services.GetUserInfo(claims)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "openid.go",
+			"function": "UserInfo",
+			"message":  err,
+		}).Errorf("error while getting user info")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, info)
+}
@@ -1,15 +1,43 @@
 package handler
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
 )
 
 type errorResponse struct {
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
 }
 
 func newErrorResponse(ctx *gin.Context, statusCode int, message string) {
 	logrus.Error(message)
-	ctx.AbortWithStatusJSON(statusCode, errorResponse{message})
+	ctx.AbortWithStatusJSON(statusCode, errorResponse{Message: message})
+}
+
+// newTokenErrorResponse responds to a rejected token. The reason is passed in the code field,
+// so that clients can e.g. tell an expired token from a revoked one
+func newTokenErrorResponse(ctx *gin.Context, err error) {
+	var tokenErr *service.TokenError
+	if !errors.As(err, &tokenErr) {
+		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	logrus.Error(tokenErr.Message)
+	ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{Message: tokenErr.Message, Code: tokenErr.Code})
+}
+
+// oauthErrorResponse is the error format defined by RFC 6749, section 5.2
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func newOAuthErrorResponse(ctx *gin.Context, statusCode int, code, description string) {
+	logrus.Error(code + ": " + description)
+	ctx.AbortWithStatusJSON(statusCode, oauthErrorResponse{code, description})
 }
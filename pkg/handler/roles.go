@@ -0,0 +1,435 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type roleInput struct {
+	Name        string   `json:"name" binding:"required,max=48"`
+	Permissions []string `json:"permissions"`
+}
+
+type roleNameInput struct {
+	Name string `json:"name" binding:"required,max=48"`
+}
+
+type rolePermissionsInput struct {
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+type pageQuery struct {
+	Page    int `form:"page"`
+	PerPage int `form:"per_page"`
+}
+
+type permissionInput struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+type permissionDescriptionInput struct {
+	Description string `json:"description"`
+}
+
+// @Summary List permissions
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description The permission catalogue with the number of roles granting each permission.
+// @Description Requires the manage_accounts permission
+// @ID admin-list-permissions
+// @Produce json
+// @Success 200 {array} models.Permission
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/permissions [get]
+func (h *Handler) AdminListPermissions(ctx *gin.Context) {
+	permissions, err := h.services.GetPermissions()
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminListPermissions")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, permissions)
+}
+
+// @Summary Create permission
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Adds a permission to the catalogue. Names are namespaced with colons, e.g. vault:read,
+// @Description and a * segment is a wildcard, e.g. vault:*. Requires the manage_accounts permission
+// @ID admin-create-permission
+// @Accept json
+// @Produce json
+// @Param input body permissionInput true "permission name and description"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/permissions [post]
+func (h *Handler) AdminCreatePermission(ctx *gin.Context) {
+	var input permissionInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	id, err := h.services.CreatePermission(uint(adminId), input.Name, input.Description, ctx.ClientIP())
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminCreatePermission")
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, map[string]interface{}{
+		"id": id,
+	})
+}
+
+// @Summary Update permission
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Changes the description of a permission. Requires the manage_accounts permission
+// @ID admin-update-permission
+// @Accept json
+// @Produce json
+// @Param id path integer true "permission id"
+// @Param input body permissionDescriptionInput true "description"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/permissions/{id} [put]
+func (h *Handler) AdminUpdatePermission(ctx *gin.Context) {
+	var input permissionDescriptionInput
+
+	permissionId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.UpdatePermission(uint(adminId), permissionId, input.Description, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, "AdminUpdatePermission")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the permission has been updated",
+	})
+}
+
+// @Summary Delete permission
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Removes a permission from the catalogue and from every role granting it.
+// @Description Requires the manage_accounts permission
+// @ID admin-delete-permission
+// @Produce json
+// @Param id path integer true "permission id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/permissions/{id} [delete]
+func (h *Handler) AdminDeletePermission(ctx *gin.Context) {
+	permissionId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.DeletePermission(uint(adminId), permissionId, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, "AdminDeletePermission")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the permission has been deleted",
+	})
+}
+
+// @Summary List roles
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Roles with their permissions and the number of users holding them.
+// @Description Requires the manage_accounts permission
+// @ID admin-list-roles
+// @Produce json
+// @Success 200 {array} models.RoleDetails
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles [get]
+func (h *Handler) AdminListRoles(ctx *gin.Context) {
+	roles, err := h.services.GetRoles()
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminListRoles")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, roles)
+}
+
+// @Summary Create role
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Creates a role granting the permissions. Requires the manage_accounts permission
+// @ID admin-create-role
+// @Accept json
+// @Produce json
+// @Param input body roleInput true "role name and permissions"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles [post]
+func (h *Handler) AdminCreateRole(ctx *gin.Context) {
+	var input roleInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	id, err := h.services.CreateRole(uint(adminId), input.Name, input.Permissions, ctx.ClientIP())
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminCreateRole")
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, map[string]interface{}{
+		"id": id,
+	})
+}
+
+// @Summary Get role
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description The role with its permissions. Requires the manage_accounts permission
+// @ID admin-get-role
+// @Produce json
+// @Param id path integer true "role id"
+// @Success 200 {object} models.RoleDetails
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles/{id} [get]
+func (h *Handler) AdminGetRole(ctx *gin.Context) {
+	roleId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	role, err := h.services.GetRole(roleId)
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminGetRole")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, role)
+}
+
+// @Summary Rename role
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Renames the role. The default role of new users can not be renamed.
+// @Description Requires the manage_accounts permission
+// @ID admin-rename-role
+// @Accept json
+// @Produce json
+// @Param id path integer true "role id"
+// @Param input body roleNameInput true "new name"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles/{id} [put]
+func (h *Handler) AdminRenameRole(ctx *gin.Context) {
+	var input roleNameInput
+
+	roleId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.RenameRole(uint(adminId), roleId, input.Name, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, "AdminRenameRole")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the role has been renamed",
+	})
+}
+
+// @Summary Set role permissions
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Replaces the permissions of the catalogue granted by the role, which takes effect with the next
+// @Description token refresh.
+// @Description manage_accounts can not be taken away from the last active user who has it.
+// @Description Requires the manage_accounts permission
+// @ID admin-set-role-permissions
+// @Accept json
+// @Produce json
+// @Param id path integer true "role id"
+// @Param input body rolePermissionsInput true "permission names"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles/{id}/permissions [put]
+func (h *Handler) AdminSetRolePermissions(ctx *gin.Context) {
+	var input rolePermissionsInput
+
+	roleId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.SetRolePermissions(uint(adminId), roleId, input.Permissions, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, "AdminSetRolePermissions")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the permissions of the role have been changed",
+	})
+}
+
+// @Summary Delete role
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Deletes a role that is not assigned to any user. The default role of new users can not be deleted.
+// @Description Requires the manage_accounts permission
+// @ID admin-delete-role
+// @Produce json
+// @Param id path integer true "role id"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles/{id} [delete]
+func (h *Handler) AdminDeleteRole(ctx *gin.Context) {
+	roleId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	adminId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.DeleteRole(uint(adminId), roleId, ctx.ClientIP()); err != nil {
+		newAdminErrorResponse(ctx, err, "AdminDeleteRole")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "the role has been deleted",
+	})
+}
+
+// @Summary List role users
+// @Security ApiKeyAuth
+// @Tags admin
+// @Description Paginated list of the users holding the role. Requires the manage_accounts permission
+// @ID admin-list-role-users
+// @Produce json
+// @Param id path integer true "role id"
+// @Param page query integer false "page number, starting at 1"
+// @Param per_page query integer false "users per page, 50 by default and at most 100"
+// @Success 200 {object} models.UserList
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 403 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /admin/roles/{id}/users [get]
+func (h *Handler) AdminListRoleUsers(ctx *gin.Context) {
+	var query pageQuery
+
+	roleId, ok := getIdParam(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, err := h.services.GetRoleUsers(roleId, query.Page, query.PerPage)
+	if err != nil {
+		newAdminErrorResponse(ctx, err, "AdminListRoleUsers")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, users)
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"github.com/th2empty/auth_service/pkg/models"
+	"html/template"
+)
+
+// loginPage is shown by the authorization endpoint, so that clients never handle the user's credentials
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Sign in</title>
+</head>
+<body>
+	<main>
+		<h1>Sign in to {{.ApplicationName}}</h1>
+		{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+		{{if .Request.ClientId}}
+		<form method="post" action="/oauth/authorize">
+			<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+			<input type="hidden" name="client_id" value="{{.Request.ClientId}}">
+			<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+			<input type="hidden" name="scope" value="{{.Request.Scope}}">
+			<input type="hidden" name="state" value="{{.Request.State}}">
+			<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+			<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+			<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+			{{if .MFAToken}}
+			<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+			<label>Verification code or recovery code <input type="text" name="code" autocomplete="one-time-code" required autofocus></label>
+			<button type="submit">Verify</button>
+			{{else}}
+			<label>Username <input type="text" name="username" autocomplete="username" required autofocus></label>
+			<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+			<button type="submit">Sign in</button>
+			{{end}}
+		</form>
+		{{end}}
+	</main>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	ApplicationName string
+	Error           string
+	Request         models.AuthorizationRequest
+	MFAToken        string
+}
+
+// devicePage is the verification page of the device authorization grant, where the user
+// signs in and approves or denies the code shown on the device
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Connect a device</title>
+</head>
+<body>
+	<main>
+		<h1>Connect a device</h1>
+		{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+		{{if .Message}}<p>{{.Message}}</p>{{else}}
+		{{if .ApplicationName}}<p>{{.ApplicationName}} is requesting access to your account.</p>{{end}}
+		<form method="post" action="/oauth/device">
+			{{if .MFAToken}}
+			<input type="hidden" name="user_code" value="{{.UserCode}}">
+			<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+			<label>Verification code or recovery code <input type="text" name="code" autocomplete="one-time-code" required autofocus></label>
+			{{else}}
+			<label>Code shown on the device <input type="text" name="user_code" value="{{.UserCode}}" autocomplete="off" required></label>
+			<label>Username <input type="text" name="username" autocomplete="username" required autofocus></label>
+			<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+			{{end}}
+			<button type="submit" name="action" value="approve">Allow</button>
+			<button type="submit" name="action" value="deny">Deny</button>
+		</form>
+		{{end}}
+	</main>
+</body>
+</html>
+`))
+
+type devicePageData struct {
+	ApplicationName string
+	UserCode        string
+	Error           string
+	Message         string
+	MFAToken        string
+}
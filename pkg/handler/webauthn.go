@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/service"
+	"net/http"
+	"strconv"
+)
+
+type beginWebAuthnRegistrationInput struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// @Summary Begin security key registration
+// @Security ApiKeyAuth
+// @Tags webauthn
+// @Description Starts the registration of a security key or passkey. Users with two-factor authentication
+// @Description have to send a current code or a recovery code, other users their password.
+// @Description The options are passed to navigator.credentials.create(), the result is sent
+// @Description to /account/webauthn/register/finish
+// @ID begin-webauthn-registration
+// @Accept json
+// @Produce json
+// @Param input body beginWebAuthnRegistrationInput true "password, or verification code or recovery code"
+// @Success 200 {object} models.WebAuthnCeremony
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 429 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure 501 {object} errorResponse
+// @Router /account/webauthn/register/begin [post]
+func (h *Handler) BeginWebAuthnRegistration(ctx *gin.Context) {
+	var input beginWebAuthnRegistrationInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	user, err := h.services.GetUserById(uint(userId))
+	if err != nil {
+		newWebAuthnErrorResponse(ctx, err, "BeginWebAuthnRegistration")
+		return
+	}
+
+	ceremony, err := h.services.BeginWebAuthnRegistration(user, input.Password, input.Code, ctx.ClientIP())
+	if err != nil {
+		newWebAuthnErrorResponse(ctx, err, "BeginWebAuthnRegistration")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ceremony)
+}
+
+type finishWebAuthnRegistrationInput struct {
+	ChallengeId string          `json:"challenge_id" binding:"required"`
+	Name        string          `json:"name"`
+	Credential  json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+}
+
+// @Summary Finish security key registration
+// @Security ApiKeyAuth
+// @Tags webauthn
+// @Description Stores the security key or passkey created by the browser. If it is the first second factor
+// @Description of the account, two-factor authentication is enabled and recovery codes are returned once
+// @ID finish-webauthn-registration
+// @Accept json
+// @Produce json
+// @Param input body finishWebAuthnRegistrationInput true "challenge id, name and the PublicKeyCredential"
+// @Success 200 {object} models.WebAuthnRegistration
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure 501 {object} errorResponse
+// @Router /account/webauthn/register/finish [post]
+func (h *Handler) FinishWebAuthnRegistration(ctx *gin.Context) {
+	var input finishWebAuthnRegistrationInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	user, err := h.services.GetUserById(uint(userId))
+	if err != nil {
+		newWebAuthnErrorResponse(ctx, err, "FinishWebAuthnRegistration")
+		return
+	}
+
+	registration, err := h.services.FinishWebAuthnRegistration(user, input.ChallengeId, input.Name, input.Credential)
+	if err != nil {
+		newWebAuthnErrorResponse(ctx, err, "FinishWebAuthnRegistration")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, registration)
+}
+
+// @Summary Get security keys
+// @Security ApiKeyAuth
+// @Tags webauthn
+// @Description Returns the security keys and passkeys of the account
+// @ID get-webauthn-credentials
+// @Produce json
+// @Success 200 {array} models.WebAuthnCredential
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/webauthn/credentials [get]
+func (h *Handler) GetWebAuthnCredentials(ctx *gin.Context) {
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	credentials, err := h.services.GetWebAuthnCredentials(uint(userId))
+	if err != nil {
+		newWebAuthnErrorResponse(ctx, err, "GetWebAuthnCredentials")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, credentials)
+}
+
+// @Summary Delete security key
+// @Security ApiKeyAuth
+// @Tags webauthn
+// @Description Removes a security key or passkey, which requires a current code or a recovery code.
+// @Description Removing the last second factor disables two-factor authentication and invalidates the recovery codes
+// @ID delete-webauthn-credential
+// @Accept json
+// @Produce json
+// @Param id path integer true "credential id"
+// @Param input body totpCodeInput true "verification code or recovery code"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 404 {object} errorResponse
+// @Failure 429 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /account/webauthn/credentials/{id} [delete]
+func (h *Handler) DeleteWebAuthnCredential(ctx *gin.Context) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, "invalid credential id")
+		return
+	}
+
+	var input totpCodeInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userId, err := getUserId(ctx)
+	if err != nil {
+		return
+	}
+
+	if err := h.services.DeleteWebAuthnCredential(uint(userId), uint(id), input.Code, ctx.ClientIP()); err != nil {
+		newWebAuthnErrorResponse(ctx, err, "DeleteWebAuthnCredential")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, map[string]string{
+		"message": "security key is removed",
+	})
+}
+
+type beginPasskeySignInInput struct {
+	Username string `json:"username"`
+}
+
+// @Summary Begin passkey sign-in
+// @Tags auth
+// @Description Starts a passwordless sign-in. With a username the passkeys of the account are offered,
+// @Description without one the browser lets the user pick a passkey stored for this site.
+// @Description The options are passed to navigator.credentials.get()
+// @ID begin-passkey-login
+// @Accept json
+// @Produce json
+// @Param input body beginPasskeySignInInput false "username"
+// @Success 200 {object} models.WebAuthnCeremony
+// @Failure 400 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure 501 {object} errorResponse
+// @Router /auth/passkey/begin [post]
+func (h *Handler) BeginPasskeySignIn(ctx *gin.Context) {
+	var input beginPasskeySignInInput
+
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.BindJSON(&input); err != nil {
+			newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ceremony, err := h.services.BeginPasskeyLogin(input.Username)
+	if err != nil {
+		newWebAuthnErrorResponse(ctx, err, "BeginPasskeySignIn")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ceremony)
+}
+
+type finishWebAuthnSignInInput struct {
+	ChallengeId string          `json:"challenge_id" binding:"required"`
+	Credential  json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+	RememberMe  bool            `json:"remember_me"`
+}
+
+// @Summary Finish passkey sign-in
+// @Tags auth
+// @Description Verifies the passkey and starts a session like a sign-in with a password
+// @ID finish-passkey-login
+// @Accept json
+// @Produce json
+// @Param app_id header integer true "application id"
+// @Param os_name header string true "Operating system name"
+// @Param input body finishWebAuthnSignInInput true "challenge id and the PublicKeyCredential"
+// @Success 200 {integer} integer 1
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /auth/passkey/finish [post]
+func (h *Handler) FinishPasskeySignIn(ctx *gin.Context) {
+	var input finishWebAuthnSignInInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, methods, err := h.services.FinishPasskeyLogin(input.ChallengeId, input.Credential)
+	if err != nil {
+		newWebAuthnSignInErrorResponse(ctx, err, "FinishPasskeySignIn")
+		return
+	}
+
+	h.signIn(ctx, user, methods, input.RememberMe, "FinishPasskeySignIn")
+}
+
+type beginWebAuthnMFAInput struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+}
+
+// @Summary Begin security key verification
+// @Tags auth
+// @Description Starts the second step of a sign-in with a security key instead of a code.
+// @Description The mfa_token is returned by sign-in after the password has been verified
+// @ID begin-login-mfa-webauthn
+// @Accept json
+// @Produce json
+// @Param input body beginWebAuthnMFAInput true "mfa token"
+// @Success 200 {object} models.WebAuthnCeremony
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /auth/sign-in/mfa/webauthn/begin [post]
+func (h *Handler) BeginWebAuthnMFA(ctx *gin.Context) {
+	var input beginWebAuthnMFAInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ceremony, err := h.services.BeginWebAuthnMFA(input.MFAToken)
+	if err != nil {
+		newWebAuthnSignInErrorResponse(ctx, err, "BeginWebAuthnMFA")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ceremony)
+}
+
+type finishWebAuthnMFAInput struct {
+	MFAToken    string          `json:"mfa_token" binding:"required"`
+	ChallengeId string          `json:"challenge_id" binding:"required"`
+	Credential  json.RawMessage `json:"credential" binding:"required" swaggertype:"object"`
+	RememberMe  bool            `json:"remember_me"`
+}
+
+// @Summary Finish security key verification
+// @Tags auth
+// @Description Completes a sign-in with two-factor authentication with a security key
+// @ID finish-login-mfa-webauthn
+// @Accept json
+// @Produce json
+// @Param app_id header integer true "application id"
+// @Param os_name header string true "Operating system name"
+// @Param input body finishWebAuthnMFAInput true "mfa token, challenge id and the PublicKeyCredential"
+// @Success 200 {integer} integer 1
+// @Failure 400 {object} errorResponse
+// @Failure 401 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Router /auth/sign-in/mfa/webauthn/finish [post]
+func (h *Handler) FinishWebAuthnMFA(ctx *gin.Context) {
+	var input finishWebAuthnMFAInput
+
+	if err := ctx.BindJSON(&input); err != nil {
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, methods, err := h.services.VerifyMFAChallengeWebAuthn(input.MFAToken, input.ChallengeId, input.Credential)
+	if err != nil {
+		if event, ok := newLoginFailure(ctx, err, models.LoginMFAFailed); ok {
+			logLoginEventError(h.services.RecordMFAFailure(input.MFAToken, event), "FinishWebAuthnMFA")
+		}
+
+		newWebAuthnSignInErrorResponse(ctx, err, "FinishWebAuthnMFA")
+		return
+	}
+
+	h.signIn(ctx, user, methods, input.RememberMe, "FinishWebAuthnMFA")
+}
+
+func newWebAuthnErrorResponse(ctx *gin.Context, err error, function string) {
+	switch {
+	case errors.Is(err, service.ErrInvalidWebAuthnChallenge), errors.Is(err, service.ErrInvalidWebAuthnResponse),
+		errors.Is(err, service.ErrPasskeyUnavailable), errors.Is(err, service.ErrInvalidMFACode),
+		errors.Is(err, service.ErrInvalidCredentials):
+		newErrorResponse(ctx, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrAccountDisabled):
+		newErrorResponse(ctx, http.StatusForbidden, err.Error())
+	case errors.Is(err, service.ErrMFALocked):
+		newErrorResponse(ctx, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, service.ErrWebAuthnCredentialNotFound):
+		newErrorResponse(ctx, http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrWebAuthnDisabled):
+		newErrorResponse(ctx, http.StatusNotImplemented, err.Error())
+	default:
+		logrus.WithFields(logrus.Fields{
+			"package":  "handler",
+			"file":     "webauthn.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("error while running webauthn ceremony")
+		newErrorResponse(ctx, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// newWebAuthnSignInErrorResponse answers failed sign-ins with 401 like the password sign-in does
+func newWebAuthnSignInErrorResponse(ctx *gin.Context, err error, function string) {
+	if errors.Is(err, service.ErrInvalidWebAuthnChallenge) || errors.Is(err, service.ErrInvalidWebAuthnResponse) ||
+		errors.Is(err, service.ErrInvalidMFAChallenge) || errors.Is(err, service.ErrWebAuthnCredentialNotFound) {
+		newErrorResponse(ctx, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	newWebAuthnErrorResponse(ctx, err, function)
+}
@@ -0,0 +1,78 @@
+package models
+
+import "time"
+
+const (
+	AuditActionUserRoleChanged     = "user_role_changed"
+	AuditActionUserDisabled        = "user_disabled"
+	AuditActionUserEnabled         = "user_enabled"
+	AuditActionUserSessionsRevoked = "user_sessions_revoked"
+	AuditActionUserDeleted         = "user_deleted"
+
+	AuditActionRoleCreated            = "role_created"
+	AuditActionRoleRenamed            = "role_renamed"
+	AuditActionRolePermissionsChanged = "role_permissions_changed"
+	AuditActionRoleDeleted            = "role_deleted"
+
+	AuditActionPermissionCreated = "permission_created"
+	AuditActionPermissionUpdated = "permission_updated"
+	AuditActionPermissionDeleted = "permission_deleted"
+
+	AuditActionSigningKeyRotated = "signing_key_rotated"
+)
+
+// UserAccount is a user as shown to administrators
+type UserAccount struct {
+	Id         uint       `json:"id" db:"id"`
+	Username   string     `json:"username" db:"username"`
+	Email      string     `json:"email" db:"email"`
+	RoleId     uint       `json:"role_id" db:"role_id"`
+	RoleName   string     `json:"role_name" db:"role_name"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	DisabledAt *time.Time `json:"disabled_at" db:"disabled_at"`
+}
+
+// UserAccountDetails adds the active sessions and second factors to the account
+type UserAccountDetails struct {
+	UserAccount
+	MFAMethods []string      `json:"mfa_methods"`
+	Sessions   []SessionItem `json:"sessions"`
+}
+
+// UserFilter selects users for the admin listing. Empty fields do not filter
+type UserFilter struct {
+	Username      string
+	Email         string
+	Role          string
+	RoleId        uint
+	CreatedFrom   *time.Time
+	CreatedBefore *time.Time
+	Disabled      *bool
+	Limit         int
+	Offset        int
+}
+
+type UserList struct {
+	Users   []UserAccount `json:"users"`
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+}
+
+// AuditLogEntry records an action of an administrator
+type AuditLogEntry struct {
+	Id           int64     `json:"id" db:"id"`
+	AdminId      uint      `json:"admin_id" db:"admin_id"`
+	Action       string    `json:"action" db:"action"`
+	TargetUserId uint      `json:"target_user_id" db:"target_user_id"`
+	Details      string    `json:"details" db:"details"`
+	IpAddress    string    `json:"ip_address" db:"ip_address"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+type AuditLog struct {
+	Entries []AuditLogEntry `json:"entries"`
+	Total   int             `json:"total"`
+	Page    int             `json:"page"`
+	PerPage int             `json:"per_page"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import "github.com/lib/pq"
+
+type Application struct {
+	Id               uint           `json:"id" db:"id"`
+	Name             string         `json:"name" db:"name"`
+	TypeId           uint           `json:"type_id" db:"type_id"`
+	OS               string         `json:"os" db:"os"`
+	ClientId         string         `json:"client_id" db:"client_id"`
+	ClientSecretHash *string        `json:"-" db:"client_secret_hash"`
+	RedirectURIs     pq.StringArray `json:"redirect_uris" db:"redirect_uris"`
+	GrantTypes       pq.StringArray `json:"grant_types" db:"grant_types"`
+	AllowedScopes    pq.StringArray `json:"allowed_scopes" db:"allowed_scopes"`
+}
+
+// IsConfidential reports whether the application can keep a client secret.
+// Public clients, such as mobile apps, only identify themselves with the client id
+func (a Application) IsConfidential() bool {
+	return a.ClientSecretHash != nil
+}
+
+// HasRedirectURI reports whether the redirect URI has been registered for the application.
+// URIs are compared as plain strings, as required by RFC 6749
+func (a Application) HasRedirectURI(uri string) bool {
+	for _, registered := range a.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a Application) HasGrantType(grantType string) bool {
+	for _, allowed := range a.GrantTypes {
+		if allowed == grantType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a Application) HasScope(scope string) bool {
+	for _, allowed := range a.AllowedScopes {
+		if allowed == scope {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"github.com/lib/pq"
+	"time"
+)
+
+type AuthorizationCode struct {
+	CodeHash      string         `json:"-" db:"code_hash"`
+	AppId         uint           `json:"app_id" db:"app_id"`
+	UserId        uint           `json:"user_id" db:"user_id"`
+	RedirectURI   string         `json:"redirect_uri" db:"redirect_uri"`
+	CodeChallenge string         `json:"code_challenge" db:"code_challenge"`
+	Scope         string         `json:"scope" db:"scope"`
+	Nonce         string         `json:"-" db:"nonce"`
+	AuthTime      time.Time      `json:"auth_time" db:"auth_time"`
+	AMR           pq.StringArray `json:"amr" db:"amr"`
+	CreatedAt     time.Time      `json:"created_at" db:"created_at"`
+	ExpiresAt     time.Time      `json:"expires_at" db:"expires_at"`
+}
+
+// AuthorizationRequest holds the parameters of a request to the authorization endpoint (RFC 6749, section 4.1.1)
+type AuthorizationRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientId            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Nonce               string `form:"nonce"`
+}
+
+// TokenResponse is the successful response of the token endpoint (RFC 6749, section 5.1)
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+}
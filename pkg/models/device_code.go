@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+const (
+	DeviceCodeStatusPending  = "pending"
+	DeviceCodeStatusApproved = "approved"
+	DeviceCodeStatusDenied   = "denied"
+)
+
+// DeviceCode is a pending authorization of the device authorization grant (RFC 8628).
+// The device polls with the device code, the user approves the request with the user code
+type DeviceCode struct {
+	DeviceCodeHash string     `json:"-" db:"device_code_hash"`
+	UserCode       string     `json:"user_code" db:"user_code"`
+	AppId          uint       `json:"app_id" db:"app_id"`
+	AppName        string     `json:"app_name" db:"app_name"`
+	UserId         *uint      `json:"user_id" db:"user_id"`
+	Scope          string     `json:"scope" db:"scope"`
+	Status         string     `json:"status" db:"status"`
+	PollInterval   int        `json:"poll_interval" db:"poll_interval"`
+	LastPolledAt   *time.Time `json:"last_polled_at" db:"last_polled_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at" db:"expires_at"`
+}
+
+// DeviceAuthorizationResponse is the response of the device authorization endpoint (RFC 8628, section 3.2)
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
@@ -0,0 +1,9 @@
+package models
+
+// GeoLocation is where an IP address is registered. Fields that could not be resolved are empty
+type GeoLocation struct {
+	City           string `json:"city"`
+	Country        string `json:"country"`
+	ASN            uint   `json:"asn"`
+	ASOrganization string `json:"as_organization"`
+}
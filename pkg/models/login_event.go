@@ -0,0 +1,55 @@
+package models
+
+import (
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	LoginResultSuccess     = "success"
+	LoginResultFailure     = "failure"
+	LoginResultMFARequired = "mfa_required"
+
+	// outcomes of the second factor of a sign-in
+	LoginMFANotReached  = "not_reached"
+	LoginMFANotEnrolled = "not_enrolled"
+	LoginMFARequired    = "required"
+	LoginMFAPassed      = "passed"
+	LoginMFAFailed      = "failed"
+
+	LoginFailureInvalidCredentials = "invalid_credentials"
+	LoginFailureAccountDisabled    = "account_disabled"
+	LoginFailureInvalidMFACode     = "invalid_mfa_code"
+	LoginFailureInvalidSecurityKey = "invalid_security_key"
+	LoginFailureMFALocked          = "mfa_locked"
+	// the second factor was answered too late or too often
+	LoginFailureMFAChallengeExpired = "mfa_challenge_expired"
+)
+
+// LoginEvent records a sign-in attempt on an account. Attempts whose password was correct but which still
+// need a second factor have the mfa_required result and are followed by a success or failure once it is answered
+type LoginEvent struct {
+	Id              int64          `json:"id" db:"id"`
+	UserId          uint           `json:"-" db:"user_id"`
+	AppId           uint           `json:"app_id" db:"app_id"`
+	ApplicationName string         `json:"application_name" db:"application_name"`
+	Result          string         `json:"result" db:"result"`
+	FailureReason   string         `json:"failure_reason,omitempty" db:"failure_reason"`
+	MFA             string         `json:"mfa" db:"mfa"`
+	Methods         pq.StringArray `json:"methods" db:"methods" swaggertype:"array,string"`
+	IpAddress       string         `json:"ip_address" db:"ip_address"`
+	City            string         `json:"city" db:"city"`
+	Country         string         `json:"country" db:"country"`
+	ASN             uint           `json:"asn" db:"asn"`
+	ASOrganization  string         `json:"as_organization" db:"as_organization"`
+	UserAgent       string         `json:"user_agent" db:"user_agent"`
+	OS              string         `json:"os" db:"os"`
+	CreatedAt       time.Time      `json:"created_at" db:"created_at"`
+}
+
+type LoginHistory struct {
+	Events  []LoginEvent `json:"events"`
+	Total   int          `json:"total"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+}
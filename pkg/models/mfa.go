@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// TOTPCredential is the TOTP authenticator of a user. The secret is encrypted, and the credential
+// is only used for sign-in once the user has confirmed it with a valid code
+type TOTPCredential struct {
+	UserId       uint       `json:"user_id" db:"user_id"`
+	Secret       []byte     `json:"-" db:"secret"`
+	ConfirmedAt  *time.Time `json:"confirmed_at" db:"confirmed_at"`
+	LastUsedStep int64      `json:"-" db:"last_used_step"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// TOTPEnrollment is shown to the user once to set up an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// MFAChallenge is issued after a successful password check of a user with a second factor.
+// Only the hash of the challenge token is stored
+type MFAChallenge struct {
+	TokenHash string    `json:"-" db:"token_hash"`
+	UserId    uint      `json:"user_id" db:"user_id"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// MFALockoutPolicy limits the second-factor attempts of a user. From the Threshold-th consecutive attempt on,
+// every attempt locks further ones for BaseDelay, doubled with each attempt up to MaxDelay. The count starts
+// over after a success or once no attempt has been made for Window
+type MFALockoutPolicy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// ReaperJobStatus describes the runs of a cleanup job on this instance. Runs skipped because another
+// instance held the lock of the job are counted, but do not change the other fields
+type ReaperJobStatus struct {
+	Name           string     `json:"name"`
+	Runs           int        `json:"runs"`
+	Skipped        int        `json:"skipped"`
+	Failures       int        `json:"failures"`
+	TotalDeleted   int64      `json:"total_deleted"`
+	LastRunAt      *time.Time `json:"last_run_at"`
+	LastDurationMs int64      `json:"last_duration_ms"`
+	LastDeleted    int64      `json:"last_deleted"`
+	LastError      string     `json:"last_error,omitempty"`
+}
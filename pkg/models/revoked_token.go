@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// RevokedToken is the id (jti) of a revoked access token, which is denied until the token expires
+type RevokedToken struct {
+	Jti       string    `db:"jti"`
+	ExpiresAt time.Time `db:"expires_at"`
+	RevokedAt time.Time `db:"revoked_at"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import "github.com/lib/pq"
+
+type Role struct {
+	Id   uint   `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+}
+
+// Permission is an entry of the permission catalogue. Names are namespaced with colons, e.g. vault:read
+type Permission struct {
+	Id          uint   `json:"id" db:"id"`
+	Name        string `json:"name" db:"name"`
+	Description string `json:"description" db:"description"`
+	RoleCount   int    `json:"role_count" db:"role_count"`
+}
+
+// RoleDetails is a role with its permissions and the number of users holding it, as shown to administrators
+type RoleDetails struct {
+	Id          uint           `json:"id" db:"id"`
+	Name        string         `json:"name" db:"name"`
+	Permissions pq.StringArray `json:"permissions" db:"permissions" swaggertype:"array,string"`
+	UserCount   int            `json:"user_count" db:"user_count"`
+}
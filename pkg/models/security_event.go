@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse"
+	SecurityEventRecoveryCodeUsed  = "mfa_recovery_code_used"
+	SecurityEventMFACodeRejected   = "mfa_code_rejected"
+)
+
+type SecurityEvent struct {
+	Id        int64     `json:"id" db:"id"`
+	UserId    uint      `json:"user_id" db:"user_id"`
+	SessionId uint      `json:"session_id" db:"session_id"`
+	Type      string    `json:"type" db:"type"`
+	IpAddress string    `json:"ip_address" db:"ip_address"`
+	Details   string    `json:"details" db:"details"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
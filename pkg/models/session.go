@@ -1,9 +1,39 @@
 package models
 
+import (
+	"github.com/lib/pq"
+	"time"
+)
+
 type Session struct {
-	SessionId    uint   `json:"session_id" db:"id"`
-	UserId       uint   `json:"user_id" db:"user_id"`
-	RefreshToken string `json:"refresh_token" db:"refresh_token"`
-	RefreshUUID  string `json:"refresh_uuid" db:"refresh_uuid"`
-	IssusedAt    uint64 `json:"issused_at" db:"issused_at"`
+	SessionId    uint      `json:"session_id" db:"id"`
+	UserId       uint      `json:"user_id" db:"user_id"`
+	RefreshToken string    `json:"refresh_token" db:"refresh_token"`
+	RefreshUUID  string    `json:"refresh_uuid" db:"refresh_uuid"`
+	IssusedAt    uint64    `json:"issused_at" db:"issused_at"`
+	Scope        string    `json:"scope" db:"scope"`
+	ClientId     string    `json:"client_id" db:"client_id"`
+	RememberMe   bool      `json:"remember_me" db:"remember_me"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt   time.Time `json:"last_used_at" db:"last_used_at"`
+
+	// AllowedScopes and Lifetime hold the settings of the application the session was started in
+	AllowedScopes pq.StringArray  `json:"-" db:"allowed_scopes"`
+	Lifetime      SessionLifetime `json:"-" db:"lifetime"`
+}
+
+// SessionLifetime overrides the configured session lifetimes for an application, in seconds. Nil keeps the configured value
+type SessionLifetime struct {
+	IdleTimeout           *int64 `json:"session_idle_timeout" db:"session_idle_timeout"`
+	MaxLifetime           *int64 `json:"session_max_lifetime" db:"session_max_lifetime"`
+	RememberMeIdleTimeout *int64 `json:"remember_me_idle_timeout" db:"remember_me_idle_timeout"`
+	RememberMeMaxLifetime *int64 `json:"remember_me_max_lifetime" db:"remember_me_max_lifetime"`
+}
+
+// SessionPolicy holds the configured session lifetimes, 0 meaning no limit
+type SessionPolicy struct {
+	IdleTimeout           time.Duration
+	MaxLifetime           time.Duration
+	RememberMeIdleTimeout time.Duration
+	RememberMeMaxLifetime time.Duration
 }
@@ -1,12 +1,19 @@
 package models
 
+import "time"
+
 type SessionItem struct {
-	SessionId       int    `json:"session_id" db:"id"`
-	UserId          uint   `json:"user_id" db:"user_id"`
-	ApplicationName string `json:"application_name" db:"name"`
-	ApplicationType string `json:"application_type" db:"type"`
-	IpAddress       string `json:"ip_address" db:"ip_address"`
-	City            string `json:"city" db:"city"`
-	OS              string `json:"os" db:"os"`
-	Time            uint64 `json:"time" db:"time"`
+	SessionId       int       `json:"session_id" db:"id"`
+	UserId          uint      `json:"user_id" db:"user_id"`
+	RememberMe      bool      `json:"remember_me" db:"remember_me"`
+	LastUsedAt      time.Time `json:"last_used_at" db:"last_used_at"`
+	ApplicationName string    `json:"application_name" db:"name"`
+	ApplicationType string    `json:"application_type" db:"type"`
+	IpAddress       string    `json:"ip_address" db:"ip_address"`
+	City            string    `json:"city" db:"city"`
+	Country         string    `json:"country" db:"country"`
+	ASN             uint      `json:"asn" db:"asn"`
+	ASOrganization  string    `json:"as_organization" db:"as_organization"`
+	OS              string    `json:"os" db:"os"`
+	Time            uint64    `json:"time" db:"time"`
 }
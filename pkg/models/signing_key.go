@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type SigningKey struct {
+	Id         string     `json:"id" db:"id"`
+	Algorithm  string     `json:"algorithm" db:"algorithm"`
+	PrivateKey []byte     `json:"-" db:"private_key"`
+	PublicKey  []byte     `json:"-" db:"public_key"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	RetiredAt  *time.Time `json:"retired_at" db:"retired_at"`
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+}
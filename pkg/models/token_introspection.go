@@ -0,0 +1,20 @@
+package models
+
+// TokenIntrospection is the response of the token introspection endpoint (RFC 7662)
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Nbf       int64  `json:"nbf,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+	UserId    uint   `json:"user_id,omitempty"`
+	SessionId uint   `json:"session_id,omitempty"`
+	RoleId    uint   `json:"role_id,omitempty"`
+}
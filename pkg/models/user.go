@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type User struct {
 	Id       uint   `json:"-" db:"id"`
 	Username string `json:"username" binding:"required" db:"username"`
@@ -7,4 +9,6 @@ type User struct {
 	Password string `json:"password" binding:"required" db:"password_hash"`
 	AvatarId uint   `json:"avatar_id" db:"avatar_id"`
 	RoleId   uint   `json:"role_id" db:"role_id"`
+	// DisabledAt is set when an administrator has disabled the account
+	DisabledAt *time.Time `json:"-" db:"disabled_at"`
 }
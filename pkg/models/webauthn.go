@@ -0,0 +1,50 @@
+package models
+
+import (
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	WebAuthnCeremonyRegistration = "registration"
+	WebAuthnCeremonyLogin        = "login"
+)
+
+// WebAuthnCredential is a public key credential (security key or passkey) registered by a user
+type WebAuthnCredential struct {
+	Id              uint           `json:"id" db:"id"`
+	UserId          uint           `json:"-" db:"user_id"`
+	CredentialId    []byte         `json:"credential_id" db:"credential_id"`
+	PublicKey       []byte         `json:"-" db:"public_key"`
+	AttestationType string         `json:"attestation_type" db:"attestation_type"`
+	AAGUID          []byte         `json:"aaguid" db:"aaguid"`
+	SignCount       int64          `json:"-" db:"sign_count"`
+	Transports      pq.StringArray `json:"transports" db:"transports" swaggertype:"array,string"`
+	Name            string         `json:"name" db:"name"`
+	CreatedAt       time.Time      `json:"created_at" db:"created_at"`
+	LastUsedAt      *time.Time     `json:"last_used_at" db:"last_used_at"`
+}
+
+// WebAuthnChallenge keeps the state of a registration or login ceremony between its two requests
+type WebAuthnChallenge struct {
+	Id          string    `db:"id"`
+	UserId      uint      `db:"user_id"`
+	Ceremony    string    `db:"ceremony"`
+	SessionData []byte    `db:"session_data"`
+	CreatedAt   time.Time `db:"created_at"`
+	ExpiresAt   time.Time `db:"expires_at"`
+}
+
+// WebAuthnCeremony is returned when a ceremony starts. The options are passed to
+// navigator.credentials.create() or get(), the challenge id is sent back with the result
+type WebAuthnCeremony struct {
+	ChallengeId string      `json:"challenge_id"`
+	Options     interface{} `json:"options"`
+}
+
+// WebAuthnRegistration is the result of a registration. Recovery codes are only
+// returned when the credential is the first second factor of the user
+type WebAuthnRegistration struct {
+	Credential    WebAuthnCredential `json:"credential"`
+	RecoveryCodes []string           `json:"recovery_codes,omitempty"`
+}
@@ -0,0 +1,478 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"strings"
+)
+
+type AdminPostgres struct {
+	db *sqlx.DB
+}
+
+func NewAdminPostgres(db *sqlx.DB) *AdminPostgres {
+	return &AdminPostgres{db: db}
+}
+
+const userAccountColumns = `u.id, u.username, COALESCE(u.email, '') AS email, u.role_id, r.name AS role_name,
+								u.created_at, u.disabled_at`
+
+// GetUsers returns a page of the users matching the filter, ordered by id, and the number of all matching users
+func (r *AdminPostgres) GetUsers(filter models.UserFilter) ([]models.UserAccount, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Username != "" {
+		addCondition("u.username ILIKE $%d", "%"+escapeLike(filter.Username)+"%")
+	}
+	if filter.Email != "" {
+		addCondition("u.email ILIKE $%d", "%"+escapeLike(filter.Email)+"%")
+	}
+	if filter.Role != "" {
+		addCondition("r.name = $%d", filter.Role)
+	}
+	if filter.RoleId != 0 {
+		addCondition("u.role_id = $%d", filter.RoleId)
+	}
+	if filter.CreatedFrom != nil {
+		addCondition("u.created_at >= $%d", *filter.CreatedFrom)
+	}
+	if filter.CreatedBefore != nil {
+		addCondition("u.created_at < $%d", *filter.CreatedBefore)
+	}
+	if filter.Disabled != nil {
+		addCondition("(u.disabled_at IS NOT NULL) = $%d", *filter.Disabled)
+	}
+
+	where := ""
+	if len(conditions) != 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	countQuery := fmt.Sprintf(`SELECT count(*) FROM %s u INNER JOIN %s r ON r.id = u.role_id %s`,
+		usersTable, rolesTable, where)
+	if err := r.db.Get(&total, countQuery, args...); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": "GetUsers",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, 0, err
+	}
+
+	users := []models.UserAccount{}
+	query := fmt.Sprintf(`SELECT %s FROM %s u INNER JOIN %s r ON r.id = u.role_id %s
+								ORDER BY u.id LIMIT $%d OFFSET $%d`, userAccountColumns, usersTable, rolesTable, where, len(args)+1, len(args)+2)
+	if err := r.db.Select(&users, query, append(args, filter.Limit, filter.Offset)...); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": "GetUsers",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func (r *AdminPostgres) GetUserAccount(userId uint) (models.UserAccount, error) {
+	var user models.UserAccount
+
+	query := fmt.Sprintf(`SELECT %s FROM %s u INNER JOIN %s r ON r.id = u.role_id WHERE u.id=$1`,
+		userAccountColumns, usersTable, rolesTable)
+	err := r.db.Get(&user, query, userId)
+
+	return user, err
+}
+
+func (r *AdminPostgres) GetRoleById(id uint) (models.Role, error) {
+	var role models.Role
+
+	query := fmt.Sprintf("SELECT id, name FROM %s WHERE id=$1", rolesTable)
+	err := r.db.Get(&role, query, id)
+
+	return role, err
+}
+
+// UpdateUserRole assigns the role to the user. It reports false if the user does not exist
+// and fails with ErrNoAccountManager if the user was the last one able to manage accounts
+func (r *AdminPostgres) UpdateUserRole(userId, roleId uint, entry models.AuditLogEntry) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET role_id=$1 WHERE id=$2`, usersTable)
+
+	return r.audited("UpdateUserRole", entry, keepingAccountManager(execAction(query, roleId, userId)))
+}
+
+// SetUserDisabled disables or enables the account. Disabling also deletes all sessions of the user,
+// which invalidates their tokens. It reports false if the user does not exist
+// and fails with ErrNoAccountManager if the user was the last one able to manage accounts
+func (r *AdminPostgres) SetUserDisabled(userId uint, disabled bool, entry models.AuditLogEntry) (bool, error) {
+	if !disabled {
+		query := fmt.Sprintf(`UPDATE %s SET disabled_at=NULL WHERE id=$1`, usersTable)
+		return r.execAudited("SetUserDisabled", entry, query, userId)
+	}
+
+	query := fmt.Sprintf(`WITH deleted AS (DELETE FROM %s WHERE user_id=$1)
+								UPDATE %s SET disabled_at=COALESCE(disabled_at, now()) WHERE id=$1`,
+		sessionsTable, usersTable)
+
+	return r.audited("SetUserDisabled", entry, keepingAccountManager(execAction(query, userId)))
+}
+
+// DeleteUserSessions signs the user out of all sessions. It is recorded even if the user has no sessions
+func (r *AdminPostgres) DeleteUserSessions(userId uint, entry models.AuditLogEntry) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE user_id=$1`, sessionsTable)
+	_, err := r.audited("DeleteUserSessions", entry, func(tx *sql.Tx) (bool, error) {
+		_, err := tx.Exec(query, userId)
+		return err == nil, err
+	})
+
+	return err
+}
+
+// DeleteUser deletes the user with all data that belongs to the account. It reports false if the user does not exist
+// and fails with ErrNoAccountManager if the user was the last one able to manage accounts
+func (r *AdminPostgres) DeleteUser(userId uint, entry models.AuditLogEntry) (bool, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id=$1`, usersTable)
+
+	return r.audited("DeleteUser", entry, keepingAccountManager(execAction(query, userId)))
+}
+
+const roleDetailsQuery = `SELECT r.id, r.name,
+								COALESCE(array_agg(p.name ORDER BY p.name) FILTER (WHERE p.id IS NOT NULL), '{}')
+								AS permissions,
+								(SELECT count(*) FROM %s u WHERE u.role_id = r.id) AS user_count
+								FROM %s r LEFT JOIN %s rp ON rp.role_id = r.id LEFT JOIN %s p ON p.id = rp.permission_id`
+
+// GetRoles returns all roles with their permissions, ordered by id
+func (r *AdminPostgres) GetRoles() ([]models.RoleDetails, error) {
+	roles := []models.RoleDetails{}
+
+	query := fmt.Sprintf(roleDetailsQuery+` GROUP BY r.id ORDER BY r.id`,
+		usersTable, rolesTable, rolePermissionsTable, permissionsTable)
+	if err := r.db.Select(&roles, query); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": "GetRoles",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (r *AdminPostgres) GetRoleDetails(id uint) (models.RoleDetails, error) {
+	var role models.RoleDetails
+
+	query := fmt.Sprintf(roleDetailsQuery+` WHERE r.id=$1 GROUP BY r.id`,
+		usersTable, rolesTable, rolePermissionsTable, permissionsTable)
+	err := r.db.Get(&role, query, id)
+
+	return role, err
+}
+
+func (r *AdminPostgres) GetRoleByName(name string) (models.Role, error) {
+	var role models.Role
+
+	query := fmt.Sprintf("SELECT id, name FROM %s WHERE name=$1", rolesTable)
+	err := r.db.Get(&role, query, name)
+
+	return role, err
+}
+
+// CreateRole creates the role granting the permissions of the catalogue with the given names and returns its id
+func (r *AdminPostgres) CreateRole(name string, permissions []string, entry models.AuditLogEntry) (uint, error) {
+	var id uint
+
+	query := fmt.Sprintf(`INSERT INTO %s (name) VALUES ($1) RETURNING id`, rolesTable)
+	_, err := r.audited("CreateRole", entry, func(tx *sql.Tx) (bool, error) {
+		if err := tx.QueryRow(query, name).Scan(&id); err != nil {
+			return false, err
+		}
+
+		return true, addRolePermissions(tx, id, permissions)
+	})
+
+	return id, err
+}
+
+// RenameRole reports false if the role does not exist
+func (r *AdminPostgres) RenameRole(id uint, name string, entry models.AuditLogEntry) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET name=$1 WHERE id=$2`, rolesTable)
+
+	return r.execAudited("RenameRole", entry, query, name, id)
+}
+
+// UpdateRolePermissions replaces the permissions of the role. It reports false if the role does not exist
+// and fails with ErrNoAccountManager if no active user would be able to manage accounts afterwards
+func (r *AdminPostgres) UpdateRolePermissions(id uint, permissions []string, entry models.AuditLogEntry) (bool, error) {
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE role_id=$1`, rolePermissionsTable)
+	lockQuery := fmt.Sprintf(`SELECT id FROM %s WHERE id=$1 FOR UPDATE`, rolesTable)
+
+	return r.audited("UpdateRolePermissions", entry, keepingAccountManager(func(tx *sql.Tx) (bool, error) {
+		var locked uint
+		if err := tx.QueryRow(lockQuery, id).Scan(&locked); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		if _, err := tx.Exec(deleteQuery, id); err != nil {
+			return false, err
+		}
+
+		return true, addRolePermissions(tx, id, permissions)
+	}))
+}
+
+// DeleteRole deletes the role. It reports false if the role does not exist.
+// Roles that are still assigned to users can not be deleted because of the foreign key of the users table
+func (r *AdminPostgres) DeleteRole(id uint, entry models.AuditLogEntry) (bool, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id=$1`, rolesTable)
+
+	return r.execAudited("DeleteRole", entry, query, id)
+}
+
+func addRolePermissions(tx *sql.Tx, roleId uint, permissions []string) error {
+	query := fmt.Sprintf(`INSERT INTO %s (role_id, permission_id) SELECT $1, id FROM %s WHERE name = ANY($2)`,
+		rolePermissionsTable, permissionsTable)
+	_, err := tx.Exec(query, roleId, pq.Array(permissions))
+
+	return err
+}
+
+// GetPermissions returns the permission catalogue ordered by name,
+// with the number of roles granting each permission
+func (r *AdminPostgres) GetPermissions() ([]models.Permission, error) {
+	permissions := []models.Permission{}
+
+	query := fmt.Sprintf(`SELECT p.id, p.name, p.description,
+								(SELECT count(*) FROM %s rp WHERE rp.permission_id = p.id) AS role_count
+								FROM %s p ORDER BY p.name`, rolePermissionsTable, permissionsTable)
+	if err := r.db.Select(&permissions, query); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": "GetPermissions",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (r *AdminPostgres) GetPermissionById(id uint) (models.Permission, error) {
+	var permission models.Permission
+
+	query := fmt.Sprintf(`SELECT p.id, p.name, p.description,
+								(SELECT count(*) FROM %s rp WHERE rp.permission_id = p.id) AS role_count
+								FROM %s p WHERE p.id=$1`, rolePermissionsTable, permissionsTable)
+	err := r.db.Get(&permission, query, id)
+
+	return permission, err
+}
+
+// CreatePermission adds the permission to the catalogue and returns its id
+func (r *AdminPostgres) CreatePermission(permission models.Permission, entry models.AuditLogEntry) (uint, error) {
+	var id uint
+
+	query := fmt.Sprintf(`INSERT INTO %s (name, description) VALUES ($1, $2) RETURNING id`, permissionsTable)
+	_, err := r.audited("CreatePermission", entry, func(tx *sql.Tx) (bool, error) {
+		err := tx.QueryRow(query, permission.Name, permission.Description).Scan(&id)
+		return err == nil, err
+	})
+
+	return id, err
+}
+
+// UpdatePermissionDescription reports false if the permission does not exist
+func (r *AdminPostgres) UpdatePermissionDescription(id uint, description string, entry models.AuditLogEntry) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET description=$1 WHERE id=$2`, permissionsTable)
+
+	return r.execAudited("UpdatePermissionDescription", entry, query, description, id)
+}
+
+// DeletePermission removes the permission from the catalogue and from every role granting it. It reports false
+// if the permission does not exist and fails with ErrNoAccountManager if no active user would be able
+// to manage accounts afterwards
+func (r *AdminPostgres) DeletePermission(id uint, entry models.AuditLogEntry) (bool, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id=$1`, permissionsTable)
+
+	return r.audited("DeletePermission", entry, keepingAccountManager(execAction(query, id)))
+}
+
+// GetAuditLog returns a page of the audit log, newest first. A target user id of 0 returns the entries of all users
+func (r *AdminPostgres) GetAuditLog(targetUserId uint, limit, offset int) ([]models.AuditLogEntry, int, error) {
+	var total int
+	countQuery := fmt.Sprintf(`SELECT count(*) FROM %s WHERE $1 = 0 OR target_user_id = $1`, adminAuditLogTable)
+	if err := r.db.Get(&total, countQuery, targetUserId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": "GetAuditLog",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, 0, err
+	}
+
+	entries := []models.AuditLogEntry{}
+	query := fmt.Sprintf(`SELECT id, COALESCE(admin_id, 0) AS admin_id, action,
+								COALESCE(target_user_id, 0) AS target_user_id, COALESCE(details, '') AS details,
+								COALESCE(ip_address, '') AS ip_address, created_at
+								FROM %s WHERE $1 = 0 OR target_user_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3`,
+		adminAuditLogTable)
+	if err := r.db.Select(&entries, query, targetUserId, limit, offset); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": "GetAuditLog",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
+
+// execAudited executes the statement and records the audit log entry in the same transaction. It reports false
+// if the statement did not affect any row, in which case nothing is recorded
+// AddAuditLogEntry records an action that is not taken in the database, e.g. a rotation of the signing keys
+func (r *AdminPostgres) AddAuditLogEntry(entry models.AuditLogEntry) error {
+	_, err := r.audited("AddAuditLogEntry", entry, func(tx *sql.Tx) (bool, error) {
+		return true, nil
+	})
+
+	return err
+}
+
+func (r *AdminPostgres) execAudited(function string, entry models.AuditLogEntry, query string,
+	args ...interface{}) (bool, error) {
+	return r.audited(function, entry, execAction(query, args...))
+}
+
+// execAction executes the statement and reports whether it affected any row
+func execAction(query string, args ...interface{}) func(tx *sql.Tx) (bool, error) {
+	return func(tx *sql.Tx) (bool, error) {
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			return false, err
+		}
+
+		rows, err := result.RowsAffected()
+		return rows != 0, err
+	}
+}
+
+// accountManagersLock is the key of the advisory lock that serializes changes to who can manage accounts
+const accountManagersLock = 0x61646d696e
+
+// keepingAccountManager makes the action fail with ErrNoAccountManager if no active user would be able
+// to manage accounts after it. The check holds an advisory lock until the transaction ends,
+// so that two administrators can not take the permission from each other at the same time
+func keepingAccountManager(action func(tx *sql.Tx) (bool, error)) func(tx *sql.Tx) (bool, error) {
+	// manage_accounts is only covered by itself and by the * wildcard
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s u INNER JOIN %s rp ON rp.role_id = u.role_id
+								INNER JOIN %s p ON p.id = rp.permission_id
+								WHERE p.name IN ('manage_accounts', '*') AND u.disabled_at IS NULL)`,
+		usersTable, rolePermissionsTable, permissionsTable)
+
+	return func(tx *sql.Tx) (bool, error) {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, accountManagersLock); err != nil {
+			return false, err
+		}
+
+		ok, err := action(tx)
+		if err != nil || !ok {
+			return ok, err
+		}
+
+		var exists bool
+		if err := tx.QueryRow(query).Scan(&exists); err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, ErrNoAccountManager
+		}
+
+		return true, nil
+	}
+}
+
+// audited runs the action and records the audit log entry in the same transaction,
+// so that no action is taken without being recorded
+func (r *AdminPostgres) audited(function string, entry models.AuditLogEntry,
+	action func(tx *sql.Tx) (bool, error)) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("error while starting transaction")
+		return false, err
+	}
+
+	ok, err := action(tx)
+	if errors.Is(err, ErrNoAccountManager) {
+		tx.Rollback()
+		return false, err
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("failed to execute query")
+
+		tx.Rollback()
+		return false, err
+	}
+	if !ok {
+		return false, tx.Rollback()
+	}
+
+	if err := addAuditLogEntry(tx, entry); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "admin_postgres.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("failed to record audit log entry")
+
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func addAuditLogEntry(tx *sql.Tx, entry models.AuditLogEntry) error {
+	query := fmt.Sprintf(`INSERT INTO %s (admin_id, action, target_user_id, details, ip_address)
+								VALUES(NULLIF($1, 0), $2, NULLIF($3, 0), $4, $5)`, adminAuditLogTable)
+	_, err := tx.Exec(query, entry.AdminId, entry.Action, entry.TargetUserId, entry.Details, entry.IpAddress)
+
+	return err
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, so that user input is matched literally
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
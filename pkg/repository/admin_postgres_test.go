@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/th2empty/auth_service/pkg/models"
+)
+
+func newMockAdminPostgres(t *testing.T) (*AdminPostgres, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewAdminPostgres(sqlx.NewDb(db, "postgres")), mock
+}
+
+// TestAssignRole runs the queries of assigning a role to a user: the role is looked up
+// and the assignment is checked to keep an account manager and recorded in the audit log
+func TestAssignRole(t *testing.T) {
+	r, mock := newMockAdminPostgres(t)
+	entry := models.AuditLogEntry{
+		AdminId:      1,
+		Action:       models.AuditActionUserRoleChanged,
+		TargetUserId: 2,
+		Details:      "role of bob changed from user to admin",
+		IpAddress:    "192.0.2.1",
+	}
+
+	mock.ExpectQuery(`^SELECT id, name FROM roles WHERE id=\$1$`).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(3, "admin"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).
+		WithArgs(accountManagersLock).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE users SET role_id=\$1 WHERE id=\$2`).
+		WithArgs(3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(`INSERT INTO admin_audit_log`).
+		WithArgs(entry.AdminId, entry.Action, entry.TargetUserId, entry.Details, entry.IpAddress).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	role, err := r.GetRoleById(3)
+	if err != nil {
+		t.Fatalf("GetRoleById: %v", err)
+	}
+	if role.Id != 3 || role.Name != "admin" {
+		t.Errorf("got role %+v", role)
+	}
+
+	ok, err := r.UpdateUserRole(2, role.Id, entry)
+	if err != nil || !ok {
+		t.Fatalf("UpdateUserRole: %v, %v", ok, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssignRoleKeepsAccountManager(t *testing.T) {
+	r, mock := newMockAdminPostgres(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE users SET role_id=\$1 WHERE id=\$2`).
+		WithArgs(3, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectRollback()
+
+	_, err := r.UpdateUserRole(1, 3, models.AuditLogEntry{AdminId: 2, TargetUserId: 1})
+	if !errors.Is(err, ErrNoAccountManager) {
+		t.Fatalf("got error %v, want %v", err, ErrNoAccountManager)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddAuditLogEntry(t *testing.T) {
+	r, mock := newMockAdminPostgres(t)
+	entry := models.AuditLogEntry{
+		AdminId:   1,
+		Action:    models.AuditActionSigningKeyRotated,
+		Details:   "signing key replaced by 3f2c",
+		IpAddress: "192.0.2.1",
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO admin_audit_log`).
+		WithArgs(entry.AdminId, entry.Action, entry.TargetUserId, entry.Details, entry.IpAddress).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := r.AddAuditLogEntry(entry); err != nil {
+		t.Fatalf("AddAuditLogEntry: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
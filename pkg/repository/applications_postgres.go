@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+)
+
+type ApplicationsPostgres struct {
+	db *sqlx.DB
+}
+
+func NewApplicationsPostgres(db *sqlx.DB) *ApplicationsPostgres {
+	return &ApplicationsPostgres{db: db}
+}
+
+func (r *ApplicationsPostgres) GetApplicationByClientId(clientId string) (models.Application, error) {
+	var application models.Application
+
+	query := fmt.Sprintf(
+		`SELECT id, name, type_id, os, client_id, client_secret_hash, redirect_uris, grant_types, allowed_scopes 
+			FROM %s WHERE client_id=$1`, applicationsTable)
+	err := r.db.Get(&application, query, clientId)
+
+	return application, err
+}
+
+func (r *ApplicationsPostgres) SetClientSecret(clientId, secretHash string) error {
+	query := fmt.Sprintf("UPDATE %s SET client_secret_hash=$1 WHERE client_id=$2", applicationsTable)
+	result, err := r.db.Exec(query, secretHash, clientId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "applications_postgres.go",
+			"function": "SetClientSecret",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return fmt.Errorf("application with client id %q not found", clientId)
+	}
+
+	return nil
+}
@@ -33,7 +33,7 @@ func (r *AuthPostgres) CreateUser(user models.User) (int, error) {
 	createSettingsQuery := fmt.Sprintf(`INSERT INTO %s (user_id, data_encryption_enabled, cloud_notifications_enabled)
 											VALUES($1, $2, $3) RETURNING user_id`, settingsTable)
 
-	row := tx.QueryRow(createUserQuery, user.Username, user.Email, user.Password, user.AvatarId, 0)
+	row := tx.QueryRow(createUserQuery, user.Username, user.Email, user.Password, user.AvatarId, user.RoleId)
 	if err := row.Scan(&id); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "repository",
@@ -62,11 +62,12 @@ func (r *AuthPostgres) CreateUser(user models.User) (int, error) {
 	return id, tx.Commit()
 }
 
-func (r *AuthPostgres) GetUser(username, password string) (models.User, error) {
+func (r *AuthPostgres) GetUser(username string) (models.User, error) {
 	var user models.User
 
-	query := fmt.Sprintf("SELECT id FROM %s WHERE username=$1 AND password_hash=$2", usersTable)
-	err := r.db.Get(&user, query, username, password)
+	query := fmt.Sprintf(
+		"SELECT id, username, email, password_hash, avatar_id, role_id, disabled_at FROM %s WHERE username=$1", usersTable)
+	err := r.db.Get(&user, query, username)
 
 	return user, err
 }
@@ -74,13 +75,68 @@ func (r *AuthPostgres) GetUser(username, password string) (models.User, error) {
 func (r *AuthPostgres) GetUserById(id uint) (models.User, error) {
 	var user models.User
 
-	query := fmt.Sprintf("SELECT id, username, email, password_hash, avatar_id, role_id FROM %s WHERE id=$1", usersTable)
+	query := fmt.Sprintf("SELECT id, username, email, password_hash, avatar_id, role_id, disabled_at FROM %s WHERE id=$1", usersTable)
 	err := r.db.Get(&user, query, id)
 
 	return user, err
 }
 
-func (r *AuthPostgres) AddSession(session models.Session, historyItem models.SessionHistoryItem) (uint, error) {
+func (r *AuthPostgres) GetRoleByName(name string) (models.Role, error) {
+	var role models.Role
+
+	query := fmt.Sprintf("SELECT id, name FROM %s WHERE name=$1", rolesTable)
+	err := r.db.Get(&role, query, name)
+
+	return role, err
+}
+
+// GetUserPermissions returns the names of the permissions granted by the role of the user
+func (r *AuthPostgres) GetUserPermissions(userId uint) ([]string, error) {
+	var permissions []string
+
+	query := fmt.Sprintf(`SELECT p.name FROM %s u INNER JOIN %s rp ON rp.role_id = u.role_id
+								INNER JOIN %s p ON p.id = rp.permission_id WHERE u.id=$1 ORDER BY p.name`,
+		usersTable, rolePermissionsTable, permissionsTable)
+	err := r.db.Select(&permissions, query, userId)
+
+	return permissions, err
+}
+
+func (r *AuthPostgres) UpdatePasswordHash(userId uint, passwordHash string) error {
+	query := fmt.Sprintf("UPDATE %s SET password_hash=$1 WHERE id=$2", usersTable)
+	if _, err := r.db.Exec(query, passwordHash, userId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "auth_postgres.go",
+			"function": "UpdatePasswordHash",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// NextSessionId allocates the id of a new session from the sequence of the sessions table
+func (r *AuthPostgres) NextSessionId() (uint, error) {
+	var id uint
+
+	query := fmt.Sprintf(`SELECT nextval(pg_get_serial_sequence('%s', 'id'))`, sessionsTable)
+	if err := r.db.Get(&id, query); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "auth_postgres.go",
+			"function": "NextSessionId",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// AddSession stores the session with the id allocated by NextSessionId and its history item under the same id
+func (r *AuthPostgres) AddSession(session models.Session, historyItem models.SessionHistoryItem) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -89,31 +145,33 @@ func (r *AuthPostgres) AddSession(session models.Session, historyItem models.Ses
 			"function": "AddSession",
 			"message":  err,
 		}).Errorf("error while starting transaction")
-		return 0, err
+		return err
 	}
 
-	var id uint
-	createSessionQuery := fmt.Sprintf(`INSERT INTO %s (user_id, refresh_token, refresh_uuid, issused_at) 
-								values($1, $2, $3, $4) RETURNING id`, sessionsTable)
-	addSessionToHistoryQuery := fmt.Sprintf(`INSERT INTO %s (app_id, ip_address, city, os, time)
-													VALUES($1, $2, $3, $4, $5) RETURNING id`, sessionsHistoryTable)
+	createSessionQuery := fmt.Sprintf(`INSERT INTO %s (id, user_id, refresh_token, refresh_uuid, issused_at, scope,
+								client_id, remember_me) values($1, $2, $3, $4, $5, $6, $7, $8)`, sessionsTable)
+	addSessionToHistoryQuery := fmt.Sprintf(`INSERT INTO %s (id, app_id, ip_address, city, os, time, country, asn,
+								as_organization) VALUES($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, 0),
+								NULLIF($9, ''))`, sessionsHistoryTable)
 
-	row := tx.QueryRow(createSessionQuery,
-		session.UserId, session.RefreshToken, session.RefreshUUID, session.IssusedAt)
-	if err := row.Scan(&id); err != nil {
+	_, err = tx.Exec(createSessionQuery, session.SessionId,
+		session.UserId, session.RefreshToken, session.RefreshUUID, session.IssusedAt, session.Scope, session.ClientId,
+		session.RememberMe)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "repository",
 			"file":     "auth_postgres.go",
 			"function": "AddSession",
 			"message":  err,
-		}).Errorf("scan scopies returned error")
+		}).Errorf("error while execute query")
 
 		tx.Rollback()
-		return 0, err
+		return err
 	}
 
-	_, err = tx.Exec(addSessionToHistoryQuery,
-		historyItem.AppId, historyItem.IpAddress, historyItem.City, historyItem.OS, historyItem.Time)
+	_, err = tx.Exec(addSessionToHistoryQuery, session.SessionId,
+		historyItem.AppId, historyItem.IpAddress, historyItem.City, historyItem.OS, historyItem.Time,
+		historyItem.Country, historyItem.ASN, historyItem.ASOrganization)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "repository",
@@ -123,13 +181,16 @@ func (r *AuthPostgres) AddSession(session models.Session, historyItem models.Ses
 		}).Errorf("error while execute query")
 
 		tx.Rollback()
-		return 0, err
+		return err
 	}
 
-	return id, tx.Commit()
+	return tx.Commit()
 }
 
-func (r *AuthPostgres) UpdateSession(session models.Session) error {
+// UpdateSession stores the rotated refresh token of the session and remembers the previous one,
+// so that its reuse can be detected. ErrStaleRefreshToken is returned if the session
+// has been refreshed with previousRefreshUUID in the meantime
+func (r *AuthPostgres) UpdateSession(session models.Session, previousRefreshUUID string) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -141,9 +202,12 @@ func (r *AuthPostgres) UpdateSession(session models.Session) error {
 		return err
 	}
 
-	updateSessionQuery := fmt.Sprintf(`UPDATE %s SET refresh_token=$1, refresh_uuid=$2, issused_at=$3 WHERE id=$4`, sessionsTable)
+	updateSessionQuery := fmt.Sprintf(`UPDATE %s SET refresh_token=$1, refresh_uuid=$2, issused_at=$3,
+								last_used_at=now() WHERE id=$4 AND refresh_uuid=$5`, sessionsTable)
+	addHistoryQuery := fmt.Sprintf(`INSERT INTO %s (refresh_uuid, session_id) VALUES($1, $2)`, refreshTokenHistoryTable)
 
-	_, err = tx.Exec(updateSessionQuery, session.RefreshToken, session.RefreshUUID, session.IssusedAt, session.SessionId)
+	result, err := tx.Exec(updateSessionQuery, session.RefreshToken, session.RefreshUUID, session.IssusedAt,
+		session.SessionId, previousRefreshUUID)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"package":  "repository",
@@ -156,14 +220,45 @@ func (r *AuthPostgres) UpdateSession(session models.Session) error {
 		return err
 	}
 
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return ErrStaleRefreshToken
+	}
+
+	if _, err := tx.Exec(addHistoryQuery, previousRefreshUUID, session.SessionId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "auth_postgres.go",
+			"function": "UpdateSession",
+			"message":  err,
+		}).Errorf("failed to execute query")
+
+		tx.Rollback()
+		return err
+	}
+
 	return tx.Commit()
 }
 
+func (r *AuthPostgres) IsRefreshTokenRotated(sessionId uint, refreshUUID string) (bool, error) {
+	var rotated bool
+
+	query := fmt.Sprintf(
+		"SELECT EXISTS(SELECT 1 FROM %s WHERE session_id=$1 AND refresh_uuid=$2)", refreshTokenHistoryTable)
+	err := r.db.Get(&rotated, query, sessionId, refreshUUID)
+
+	return rotated, err
+}
+
 func (r *AuthPostgres) GetSessions(ownerId uint) ([]models.Session, error) {
 	var sessions []models.Session
 
 	query := fmt.Sprintf(
-		"SELECT id, user_id, refresh_token, refresh_uuid, issused_at from %s WHERE user_id=$1", sessionsTable)
+		`SELECT id, user_id, refresh_token, refresh_uuid, issused_at, scope, client_id, remember_me, created_at,
+			last_used_at from %s WHERE user_id=$1`, sessionsTable)
 
 	//err := r.db.Get(&sessions, query, ownerId)
 	err := r.db.Select(&sessions, query, ownerId)
@@ -173,7 +268,10 @@ func (r *AuthPostgres) GetSessions(ownerId uint) ([]models.Session, error) {
 
 func (r *AuthPostgres) GetSessionsDetails(userId uint) ([]models.SessionItem, error) {
 	var sessions []models.SessionItem
-	getSessionQuery := fmt.Sprintf(`SELECT s.id, s.user_id, sh.ip_address, sh.city, sh.os, sh.time, a.name, at.type FROM %s s 
+	getSessionQuery := fmt.Sprintf(`SELECT s.id, s.user_id, s.remember_me, s.last_used_at, sh.ip_address, sh.city,
+												COALESCE(sh.country, '') AS country, COALESCE(sh.asn, 0) AS asn,
+												COALESCE(sh.as_organization, '') AS as_organization,
+												sh.os, sh.time, a.name, at.type FROM %s s 
 												INNER JOIN %s sh ON s.id = sh.id INNER JOIN %s a ON sh.app_id = a.id
 													INNER JOIN %s at ON a.type_id = at.id
 													WHERE s.user_id=$1`,
@@ -191,17 +289,52 @@ func (r *AuthPostgres) GetSessionsDetails(userId uint) ([]models.SessionItem, er
 	return sessions, nil
 }
 
+// GetSessionById returns the session together with the allowed scopes and lifetime overrides of the application
+// it was started in
 func (r *AuthPostgres) GetSessionById(id uint) (models.Session, error) {
 	var session models.Session
 
-	query := fmt.Sprintf(
-		"SELECT id, user_id, refresh_token, refresh_uuid, issused_at from %s WHERE id=$1", sessionsTable)
+	query := fmt.Sprintf(`SELECT s.id, s.user_id, s.refresh_token, s.refresh_uuid, s.issused_at, s.scope, s.client_id,
+			s.remember_me, s.created_at, s.last_used_at, a.allowed_scopes,
+			a.session_idle_timeout "lifetime.session_idle_timeout",
+			a.session_max_lifetime "lifetime.session_max_lifetime",
+			a.remember_me_idle_timeout "lifetime.remember_me_idle_timeout",
+			a.remember_me_max_lifetime "lifetime.remember_me_max_lifetime"
+		FROM %s s LEFT JOIN %s sh ON sh.id = s.id LEFT JOIN %s a ON a.id = sh.app_id WHERE s.id=$1`,
+		sessionsTable, sessionsHistoryTable, applicationsTable)
 
 	err := r.db.Get(&session, query, id)
 
 	return session, err
 }
 
+// TouchSession records the use of the session. Uses within a minute of the recorded one are not written,
+// so that authenticated requests do not each update the session
+func (r *AuthPostgres) TouchSession(sessionId uint) error {
+	query := fmt.Sprintf(`UPDATE %s SET last_used_at=now() WHERE id=$1 AND last_used_at < now() - interval '1 minute'`,
+		sessionsTable)
+	if _, err := r.db.Exec(query, sessionId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "auth_postgres.go",
+			"function": "TouchSession",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+func (r *AuthPostgres) GetSessionAppId(sessionId uint) (uint, error) {
+	var appId uint
+
+	query := fmt.Sprintf("SELECT app_id FROM %s WHERE id=$1", sessionsHistoryTable)
+	err := r.db.Get(&appId, query, sessionId)
+
+	return appId, err
+}
+
 func (r *AuthPostgres) Logout(sessionId uint) error {
 	tx, err := r.db.Begin()
 	if err != nil {
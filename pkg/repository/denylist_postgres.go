@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+type DenylistPostgres struct {
+	db *sqlx.DB
+}
+
+func NewDenylistPostgres(db *sqlx.DB) *DenylistPostgres {
+	return &DenylistPostgres{db: db}
+}
+
+func (r *DenylistPostgres) AddRevokedToken(jti string, expiresAt time.Time) error {
+	query := fmt.Sprintf(`INSERT INTO %s (jti, expires_at) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING`,
+		revokedTokensTable)
+	if _, err := r.db.Exec(query, jti, expiresAt); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "denylist_postgres.go",
+			"function": "AddRevokedToken",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// GetRevokedTokenExpiration returns when the revoked token expires, or nil if the token has not been revoked
+func (r *DenylistPostgres) GetRevokedTokenExpiration(jti string) (*time.Time, error) {
+	var expiresAt []time.Time
+
+	query := fmt.Sprintf(`SELECT expires_at FROM %s WHERE jti=$1`, revokedTokensTable)
+	if err := r.db.Select(&expiresAt, query, jti); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "denylist_postgres.go",
+			"function": "GetRevokedTokenExpiration",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, err
+	}
+
+	if len(expiresAt) == 0 {
+		return nil, nil
+	}
+
+	return &expiresAt[0], nil
+}
+
+// GetRevokedTokens returns the tokens revoked since the given time that have not expired yet
+func (r *DenylistPostgres) GetRevokedTokens(since time.Time) ([]models.RevokedToken, error) {
+	var tokens []models.RevokedToken
+
+	query := fmt.Sprintf(`SELECT jti, expires_at, revoked_at FROM %s WHERE revoked_at >= $1 AND expires_at > now()`,
+		revokedTokensTable)
+	if err := r.db.Select(&tokens, query, since); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "denylist_postgres.go",
+			"function": "GetRevokedTokens",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, err
+	}
+
+	return tokens, nil
+}
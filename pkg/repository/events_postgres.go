@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+)
+
+type EventsPostgres struct {
+	db *sqlx.DB
+}
+
+func NewEventsPostgres(db *sqlx.DB) *EventsPostgres {
+	return &EventsPostgres{db: db}
+}
+
+func (r *EventsPostgres) AddSecurityEvent(event models.SecurityEvent) error {
+	query := fmt.Sprintf(`INSERT INTO %s (user_id, session_id, type, ip_address, details)
+								VALUES(NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5)`, securityEventsTable)
+	_, err := r.db.Exec(query, event.UserId, event.SessionId, event.Type, event.IpAddress, event.Details)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "events_postgres.go",
+			"function": "AddSecurityEvent",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
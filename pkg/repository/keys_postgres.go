@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+// signingKeysLockId identifies the advisory lock held while the key ring is modified
+const signingKeysLockId = 7001
+
+type KeysPostgres struct {
+	db *sqlx.DB
+}
+
+func NewKeysPostgres(db *sqlx.DB) *KeysPostgres {
+	return &KeysPostgres{db: db}
+}
+
+func (r *KeysPostgres) GetSigningKeys() ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+
+	query := fmt.Sprintf(`SELECT id, algorithm, private_key, public_key, created_at, retired_at, expires_at FROM %s
+								WHERE expires_at IS NULL OR expires_at > now() ORDER BY created_at`, signingKeysTable)
+	if err := r.db.Select(&keys, query); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "GetSigningKeys",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RotateSigningKey makes key the current signing key unless another instance has already
+// added a key after notBefore. Retired keys stay valid for verification until expiresAt
+func (r *KeysPostgres) RotateSigningKey(key models.SigningKey, notBefore, expiresAt time.Time) (bool, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "RotateSigningKey",
+			"message":  err,
+		}).Errorf("error while starting transaction")
+		return false, err
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", signingKeysLockId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "RotateSigningKey",
+			"message":  err,
+		}).Errorf("failed to acquire lock")
+
+		tx.Rollback()
+		return false, err
+	}
+
+	var newer int
+	countQuery := fmt.Sprintf(`SELECT count(*) FROM %s WHERE retired_at IS NULL AND created_at > $1`, signingKeysTable)
+	if err := tx.Get(&newer, countQuery, notBefore); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "RotateSigningKey",
+			"message":  err,
+		}).Errorf("failed to execute query")
+
+		tx.Rollback()
+		return false, err
+	}
+	if newer != 0 {
+		return false, tx.Rollback()
+	}
+
+	retireQuery := fmt.Sprintf(`UPDATE %s SET retired_at=now(), expires_at=$1 WHERE retired_at IS NULL`, signingKeysTable)
+	insertQuery := fmt.Sprintf(`INSERT INTO %s (id, algorithm, private_key, public_key)
+								VALUES($1, $2, $3, $4)`, signingKeysTable)
+
+	if _, err := tx.Exec(retireQuery, expiresAt); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "RotateSigningKey",
+			"message":  err,
+		}).Errorf("failed to execute query")
+
+		tx.Rollback()
+		return false, err
+	}
+
+	if _, err := tx.Exec(insertQuery, key.Id, key.Algorithm, key.PrivateKey, key.PublicKey); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "RotateSigningKey",
+			"message":  err,
+		}).Errorf("failed to execute query")
+
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (r *KeysPostgres) DeleteExpiredSigningKeys() error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE expires_at <= now()`, signingKeysTable)
+	if _, err := r.db.Exec(query); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "keys_postgres.go",
+			"function": "DeleteExpiredSigningKeys",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+)
+
+type LoginEventsPostgres struct {
+	db *sqlx.DB
+}
+
+func NewLoginEventsPostgres(db *sqlx.DB) *LoginEventsPostgres {
+	return &LoginEventsPostgres{db: db}
+}
+
+// AddLoginEvent records the sign-in attempt. An application id that does not exist is stored as NULL
+func (r *LoginEventsPostgres) AddLoginEvent(event models.LoginEvent) error {
+	query := fmt.Sprintf(`INSERT INTO %s (user_id, app_id, result, failure_reason, mfa, methods, ip_address,
+								user_agent, os, city, country, asn, as_organization)
+								VALUES($1, (SELECT id FROM %s WHERE id=$2), $3, NULLIF($4, ''), $5, $6, $7, $8, $9,
+								NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, 0), NULLIF($13, ''))`,
+		loginEventsTable, applicationsTable)
+	_, err := r.db.Exec(query, event.UserId, event.AppId, event.Result, event.FailureReason, event.MFA,
+		event.Methods, event.IpAddress, event.UserAgent, event.OS, event.City, event.Country, event.ASN,
+		event.ASOrganization)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "login_events_postgres.go",
+			"function": "AddLoginEvent",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// GetLoginEvents returns a page of the sign-in attempts of the user, newest first, and their total number
+func (r *LoginEventsPostgres) GetLoginEvents(userId uint, limit, offset int) ([]models.LoginEvent, int, error) {
+	var total int
+	countQuery := fmt.Sprintf(`SELECT count(*) FROM %s WHERE user_id=$1`, loginEventsTable)
+	if err := r.db.Get(&total, countQuery, userId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "login_events_postgres.go",
+			"function": "GetLoginEvents",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, 0, err
+	}
+
+	events := []models.LoginEvent{}
+	query := fmt.Sprintf(`SELECT le.id, le.user_id, COALESCE(le.app_id, 0) AS app_id,
+								COALESCE(a.name, '') AS application_name, le.result,
+								COALESCE(le.failure_reason, '') AS failure_reason, le.mfa, le.methods,
+								COALESCE(le.ip_address, '') AS ip_address, COALESCE(le.city, '') AS city,
+								COALESCE(le.country, '') AS country, COALESCE(le.asn, 0) AS asn,
+								COALESCE(le.as_organization, '') AS as_organization,
+								COALESCE(le.user_agent, '') AS user_agent,
+								COALESCE(le.os, '') AS os, le.created_at
+								FROM %s le LEFT JOIN %s a ON a.id = le.app_id
+								WHERE le.user_id=$1 ORDER BY le.id DESC LIMIT $2 OFFSET $3`,
+		loginEventsTable, applicationsTable)
+	if err := r.db.Select(&events, query, userId, limit, offset); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "login_events_postgres.go",
+			"function": "GetLoginEvents",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
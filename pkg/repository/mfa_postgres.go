@@ -0,0 +1,283 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+type MFAPostgres struct {
+	db *sqlx.DB
+}
+
+func NewMFAPostgres(db *sqlx.DB) *MFAPostgres {
+	return &MFAPostgres{db: db}
+}
+
+func (r *MFAPostgres) GetTOTPCredential(userId uint) (models.TOTPCredential, error) {
+	var credential models.TOTPCredential
+
+	query := fmt.Sprintf(`SELECT user_id, secret, confirmed_at, last_used_step, created_at FROM %s
+								WHERE user_id=$1`, totpCredentialsTable)
+	err := r.db.Get(&credential, query, userId)
+
+	return credential, err
+}
+
+// SaveTOTPCredential stores a new unconfirmed secret of the user. It reports false
+// without changing anything if the user already has a confirmed credential
+func (r *MFAPostgres) SaveTOTPCredential(userId uint, secret []byte) (bool, error) {
+	query := fmt.Sprintf(`INSERT INTO %[1]s (user_id, secret) VALUES($1, $2)
+								ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, last_used_step=0, created_at=now()
+								WHERE %[1]s.confirmed_at IS NULL`, totpCredentialsTable)
+	result, err := r.db.Exec(query, userId, secret)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "SaveTOTPCredential",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+func (r *MFAPostgres) ConfirmTOTPCredential(userId uint, step int64) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET confirmed_at=now(), last_used_step=$1
+								WHERE user_id=$2 AND confirmed_at IS NULL`, totpCredentialsTable)
+	result, err := r.db.Exec(query, step, userId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "ConfirmTOTPCredential",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+// UseTOTPStep records the time step of an accepted code. It reports false if a code of the same
+// or a later step has already been accepted, so every code can be used only once
+func (r *MFAPostgres) UseTOTPStep(userId uint, step int64) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET last_used_step=$1 WHERE user_id=$2 AND last_used_step < $1`,
+		totpCredentialsTable)
+	result, err := r.db.Exec(query, step, userId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "UseTOTPStep",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+func (r *MFAPostgres) DeleteTOTPCredential(userId uint) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE user_id=$1`, totpCredentialsTable)
+	if _, err := r.db.Exec(query, userId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "DeleteTOTPCredential",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+func (r *MFAPostgres) AddMFAChallenge(challenge models.MFAChallenge) error {
+	query := fmt.Sprintf(`INSERT INTO %s (token_hash, user_id, expires_at) VALUES($1, $2, $3)`, mfaChallengesTable)
+	if _, err := r.db.Exec(query, challenge.TokenHash, challenge.UserId, challenge.ExpiresAt); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "AddMFAChallenge",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// AttemptMFAChallenge counts an attempt to answer the challenge and returns it. sql.ErrNoRows is returned
+// if the challenge does not exist, has expired or has run out of attempts
+func (r *MFAPostgres) AttemptMFAChallenge(tokenHash string, maxAttempts int) (models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+
+	query := fmt.Sprintf(`UPDATE %s SET attempts=attempts+1 WHERE token_hash=$1 AND attempts < $2 AND expires_at > $3
+								RETURNING token_hash, user_id, attempts, created_at, expires_at`, mfaChallengesTable)
+	err := r.db.Get(&challenge, query, tokenHash, maxAttempts, time.Now())
+
+	return challenge, err
+}
+
+// GetMFAChallengeUserId returns the user of the challenge, whether or not it can still be answered
+func (r *MFAPostgres) GetMFAChallengeUserId(tokenHash string) (uint, error) {
+	var userId uint
+
+	query := fmt.Sprintf(`SELECT user_id FROM %s WHERE token_hash=$1`, mfaChallengesTable)
+	err := r.db.Get(&userId, query, tokenHash)
+
+	return userId, err
+}
+
+func (r *MFAPostgres) DeleteMFAChallenge(tokenHash string) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE token_hash=$1`, mfaChallengesTable)
+	if _, err := r.db.Exec(query, tokenHash); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "DeleteMFAChallenge",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// AttemptSecondFactor counts an attempt of the user to pass the second factor and returns the number
+// of consecutive attempts including it. The attempt is counted before the code is checked, and the lock
+// is set in the same statement, so that concurrent requests can not get past it. sql.ErrNoRows
+// is returned while the user is locked out
+func (r *MFAPostgres) AttemptSecondFactor(userId uint, policy models.MFALockoutPolicy) (int, error) {
+	var attempts int
+
+	nextAttempts := `CASE WHEN l.last_attempt_at < now() - make_interval(secs => $5::float8) THEN 1
+						ELSE l.attempts + 1 END`
+	lockedUntil := func(attempts string) string {
+		return fmt.Sprintf(`CASE WHEN %[1]s >= $2::int
+						THEN now() + make_interval(secs => least($3::float8 * power(2, %[1]s - $2::int), $4::float8))
+						END`, attempts)
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s AS l (user_id, attempts, last_attempt_at, locked_until)
+								VALUES($1, 1, now(), %s)
+								ON CONFLICT (user_id) DO UPDATE SET attempts = %s, last_attempt_at = now(),
+									locked_until = %s
+								WHERE l.locked_until IS NULL OR l.locked_until <= now()
+								RETURNING attempts`,
+		mfaLockoutsTable, lockedUntil("1"), nextAttempts, lockedUntil(nextAttempts))
+	err := r.db.Get(&attempts, query, userId, policy.Threshold, policy.BaseDelay.Seconds(),
+		policy.MaxDelay.Seconds(), policy.Window.Seconds())
+
+	return attempts, err
+}
+
+// ResetSecondFactorAttempts starts the count of consecutive attempts over after the user passed the second factor
+func (r *MFAPostgres) ResetSecondFactorAttempts(userId uint) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE user_id=$1`, mfaLockoutsTable)
+	if _, err := r.db.Exec(query, userId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "ResetSecondFactorAttempts",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes invalidates all recovery codes of the user and stores the new set
+func (r *MFAPostgres) ReplaceRecoveryCodes(userId uint, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "ReplaceRecoveryCodes",
+			"message":  err,
+		}).Errorf("error while starting transaction")
+		return err
+	}
+
+	deleteQuery := fmt.Sprintf(`DELETE FROM %s WHERE user_id=$1`, recoveryCodesTable)
+	if _, err := tx.Exec(deleteQuery, userId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "ReplaceRecoveryCodes",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		tx.Rollback()
+		return err
+	}
+
+	insertQuery := fmt.Sprintf(`INSERT INTO %s (user_id, code_hash) VALUES($1, $2)`, recoveryCodesTable)
+	for _, codeHash := range codeHashes {
+		if _, err := tx.Exec(insertQuery, userId, codeHash); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "repository",
+				"file":     "mfa_postgres.go",
+				"function": "ReplaceRecoveryCodes",
+				"message":  err,
+			}).Errorf("failed to execute query")
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used. It reports false if there is no such code
+func (r *MFAPostgres) UseRecoveryCode(userId uint, codeHash string) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`,
+		recoveryCodesTable)
+	result, err := r.db.Exec(query, userId, codeHash)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "UseRecoveryCode",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of the user
+func (r *MFAPostgres) CountRecoveryCodes(userId uint) (int, error) {
+	var count int
+
+	query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE user_id=$1 AND used_at IS NULL`, recoveryCodesTable)
+	err := r.db.Get(&count, query, userId)
+
+	return count, err
+}
+
+func (r *MFAPostgres) DeleteRecoveryCodes(userId uint) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE user_id=$1`, recoveryCodesTable)
+	if _, err := r.db.Exec(query, userId); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "mfa_postgres.go",
+			"function": "DeleteRecoveryCodes",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+type OAuthPostgres struct {
+	db *sqlx.DB
+}
+
+func NewOAuthPostgres(db *sqlx.DB) *OAuthPostgres {
+	return &OAuthPostgres{db: db}
+}
+
+func (r *OAuthPostgres) AddAuthorizationCode(code models.AuthorizationCode) error {
+	query := fmt.Sprintf(`INSERT INTO %s (code_hash, app_id, user_id, redirect_uri, code_challenge, scope,
+								nonce, auth_time, amr, expires_at)
+								VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, authorizationCodesTable)
+	_, err := r.db.Exec(query, code.CodeHash, code.AppId, code.UserId, code.RedirectURI, code.CodeChallenge,
+		code.Scope, code.Nonce, code.AuthTime, code.AMR, code.ExpiresAt)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "oauth_postgres.go",
+			"function": "AddAuthorizationCode",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeAuthorizationCode deletes the code and returns it, so that every code can be exchanged only once
+func (r *OAuthPostgres) ConsumeAuthorizationCode(codeHash string) (models.AuthorizationCode, error) {
+	var code models.AuthorizationCode
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE code_hash=$1 
+								RETURNING code_hash, app_id, user_id, redirect_uri, code_challenge, scope, nonce, auth_time, amr,
+									created_at, expires_at`,
+		authorizationCodesTable)
+	err := r.db.Get(&code, query, codeHash)
+
+	return code, err
+}
+
+func (r *OAuthPostgres) AddDeviceCode(code models.DeviceCode) error {
+	query := fmt.Sprintf(`INSERT INTO %s (device_code_hash, user_code, app_id, scope, poll_interval, expires_at)
+								VALUES($1, $2, $3, $4, $5, $6)`, deviceCodesTable)
+	_, err := r.db.Exec(query, code.DeviceCodeHash, code.UserCode, code.AppId, code.Scope, code.PollInterval,
+		code.ExpiresAt)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "oauth_postgres.go",
+			"function": "AddDeviceCode",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+func (r *OAuthPostgres) GetDeviceCode(deviceCodeHash string) (models.DeviceCode, error) {
+	var code models.DeviceCode
+
+	query := fmt.Sprintf(`SELECT dc.device_code_hash, dc.user_code, dc.app_id, a.name AS app_name, dc.user_id, dc.scope,
+								dc.status, dc.poll_interval, dc.last_polled_at, dc.created_at, dc.expires_at
+								FROM %s dc INNER JOIN %s a ON a.id = dc.app_id WHERE dc.device_code_hash=$1`,
+		deviceCodesTable, applicationsTable)
+	err := r.db.Get(&code, query, deviceCodeHash)
+
+	return code, err
+}
+
+func (r *OAuthPostgres) GetDeviceCodeByUserCode(userCode string) (models.DeviceCode, error) {
+	var code models.DeviceCode
+
+	query := fmt.Sprintf(`SELECT dc.device_code_hash, dc.user_code, dc.app_id, a.name AS app_name, dc.user_id, dc.scope,
+								dc.status, dc.poll_interval, dc.last_polled_at, dc.created_at, dc.expires_at
+								FROM %s dc INNER JOIN %s a ON a.id = dc.app_id WHERE dc.user_code=$1`,
+		deviceCodesTable, applicationsTable)
+	err := r.db.Get(&code, query, userCode)
+
+	return code, err
+}
+
+// UpdateDeviceCodePoll records a poll of the device. The update only succeeds if no other poll has been
+// recorded since previousPolledAt was read, so concurrent polls can not bypass the polling interval
+func (r *OAuthPostgres) UpdateDeviceCodePoll(deviceCodeHash string, previousPolledAt *time.Time, polledAt time.Time,
+	interval int) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET last_polled_at=$1, poll_interval=$2
+								WHERE device_code_hash=$3 AND last_polled_at IS NOT DISTINCT FROM $4`, deviceCodesTable)
+	result, err := r.db.Exec(query, polledAt, interval, deviceCodeHash, previousPolledAt)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "oauth_postgres.go",
+			"function": "UpdateDeviceCodePoll",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+// SetDeviceCodeStatus approves or denies a pending device code on behalf of the user.
+// It reports false if the code does not exist, is no longer pending or has expired
+func (r *OAuthPostgres) SetDeviceCodeStatus(userCode string, userId uint, status string) (bool, error) {
+	query := fmt.Sprintf(`UPDATE %s SET status=$1, user_id=$2
+								WHERE user_code=$3 AND status=$4 AND expires_at > $5`, deviceCodesTable)
+	result, err := r.db.Exec(query, status, userId, userCode, models.DeviceCodeStatusPending, time.Now())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "oauth_postgres.go",
+			"function": "SetDeviceCodeStatus",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+// ConsumeDeviceCode deletes a device code that is no longer pending and returns it,
+// so that an approved code is exchanged for tokens only once
+func (r *OAuthPostgres) ConsumeDeviceCode(deviceCodeHash string) (models.DeviceCode, error) {
+	var code models.DeviceCode
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE device_code_hash=$1 AND status <> $2
+								RETURNING device_code_hash, user_code, app_id, user_id, scope, status, poll_interval,
+									last_polled_at, created_at, expires_at`, deviceCodesTable)
+	err := r.db.Get(&code, query, deviceCodeHash, models.DeviceCodeStatusPending)
+
+	return code, err
+}
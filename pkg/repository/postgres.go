@@ -1,17 +1,40 @@
 package repository
 
 import (
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 )
 
 const (
-	usersTable            = "users"
-	settingsTable         = "settings"
-	sessionsTable         = "sessions"
-	sessionsHistoryTable  = "sessions_history"
-	applicationsTable     = "applications"
-	applicationTypesTable = "application_types"
+	usersTable               = "users"
+	settingsTable            = "settings"
+	rolesTable               = "roles"
+	permissionsTable         = "permissions"
+	rolePermissionsTable     = "role_permissions"
+	sessionsTable            = "sessions"
+	sessionsHistoryTable     = "sessions_history"
+	applicationsTable        = "applications"
+	applicationTypesTable    = "application_types"
+	signingKeysTable         = "signing_keys"
+	refreshTokenHistoryTable = "refresh_token_history"
+	securityEventsTable      = "security_events"
+	revokedTokensTable       = "revoked_tokens"
+	authorizationCodesTable  = "authorization_codes"
+	deviceCodesTable         = "device_codes"
+	totpCredentialsTable     = "totp_credentials"
+	mfaChallengesTable       = "mfa_challenges"
+	recoveryCodesTable       = "mfa_recovery_codes"
+	webAuthnCredentialsTable = "webauthn_credentials"
+	webAuthnChallengesTable  = "webauthn_challenges"
+	adminAuditLogTable       = "admin_audit_log"
+	loginEventsTable         = "login_events"
+	mfaLockoutsTable         = "mfa_lockouts"
+)
+
+var (
+	ErrStaleRefreshToken = errors.New("refresh token has already been rotated")
+	ErrNoAccountManager  = errors.New("no active user would be left to manage accounts")
 )
 
 type Config struct {
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+// reaperLockClass is the first key of the advisory locks of the reaper jobs, the second one is derived from the job name
+const reaperLockClass = 7002
+
+type ReaperPostgres struct {
+	db *sqlx.DB
+}
+
+func NewReaperPostgres(db *sqlx.DB) *ReaperPostgres {
+	return &ReaperPostgres{db: db}
+}
+
+// RunExclusive runs the job unless another instance is running a job with the same name, in which case
+// false is returned. The advisory lock is held on a connection of its own for the duration of the job
+func (r *ReaperPostgres) RunExclusive(job string, run func() error) (bool, error) {
+	ctx := context.Background()
+
+	conn, err := r.db.Connx(ctx)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "reaper_postgres.go",
+			"function": "RunExclusive",
+			"message":  err,
+		}).Errorf("failed to get a connection")
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.GetContext(ctx, &locked, `SELECT pg_try_advisory_lock($1, hashtext($2))`,
+		reaperLockClass, job); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "reaper_postgres.go",
+			"function": "RunExclusive",
+			"message":  err,
+		}).Errorf("failed to acquire lock")
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1, hashtext($2))`, reaperLockClass, job); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "repository",
+				"file":     "reaper_postgres.go",
+				"function": "RunExclusive",
+				"message":  err,
+			}).Errorf("failed to release lock")
+		}
+	}()
+
+	return true, run()
+}
+
+// DeleteExpiredSessions deletes up to limit sessions that have been idle for longer than their idle timeout,
+// have outlived their absolute lifetime or whose refresh token has expired. The lifetimes of an application
+// take precedence over the policy, like in the checks of the service. The history and the rotated refresh tokens
+// of the sessions are deleted with them
+func (r *ReaperPostgres) DeleteExpiredSessions(policy models.SessionPolicy, refreshTokenTTL time.Duration,
+	limit int) (int64, error) {
+	query := fmt.Sprintf(`WITH expired AS (
+			SELECT s.id FROM %s s
+				LEFT JOIN %s sh ON sh.id = s.id
+				LEFT JOIN %s a ON a.id = sh.app_id,
+				LATERAL (SELECT
+					CASE WHEN s.remember_me
+						THEN coalesce(a.remember_me_idle_timeout, a.session_idle_timeout, $3)
+						ELSE coalesce(a.session_idle_timeout, $1) END AS idle_timeout,
+					CASE WHEN s.remember_me
+						THEN coalesce(a.remember_me_max_lifetime, a.session_max_lifetime, $4)
+						ELSE coalesce(a.session_max_lifetime, $2) END AS max_lifetime) l
+			WHERE $5 > 0 AND s.last_used_at < now() - make_interval(secs => $5)
+				OR l.idle_timeout > 0 AND s.last_used_at < now() - make_interval(secs => l.idle_timeout)
+				OR l.max_lifetime > 0 AND s.created_at < now() - make_interval(secs => l.max_lifetime)
+			LIMIT $6
+		)
+		DELETE FROM %s WHERE id IN (SELECT id FROM expired)`,
+		sessionsTable, sessionsHistoryTable, applicationsTable, sessionsTable)
+
+	result, err := r.db.Exec(query, int64(policy.IdleTimeout.Seconds()), int64(policy.MaxLifetime.Seconds()),
+		int64(policy.RememberMeIdleTimeout.Seconds()), int64(policy.RememberMeMaxLifetime.Seconds()),
+		int64(refreshTokenTTL.Seconds()), limit)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "reaper_postgres.go",
+			"function": "DeleteExpiredSessions",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (r *ReaperPostgres) DeleteExpiredAuthorizationCodes(before time.Time, limit int) (int64, error) {
+	return r.deleteExpired("DeleteExpiredAuthorizationCodes", authorizationCodesTable, before, limit)
+}
+
+func (r *ReaperPostgres) DeleteExpiredDeviceCodes(before time.Time, limit int) (int64, error) {
+	return r.deleteExpired("DeleteExpiredDeviceCodes", deviceCodesTable, before, limit)
+}
+
+func (r *ReaperPostgres) DeleteExpiredMFAChallenges(before time.Time, limit int) (int64, error) {
+	return r.deleteExpired("DeleteExpiredMFAChallenges", mfaChallengesTable, before, limit)
+}
+
+func (r *ReaperPostgres) DeleteExpiredWebAuthnChallenges(before time.Time, limit int) (int64, error) {
+	return r.deleteExpired("DeleteExpiredWebAuthnChallenges", webAuthnChallengesTable, before, limit)
+}
+
+func (r *ReaperPostgres) DeleteExpiredRevokedTokens(before time.Time, limit int) (int64, error) {
+	return r.deleteExpired("DeleteExpiredRevokedTokens", revokedTokensTable, before, limit)
+}
+
+// deleteExpired deletes up to limit rows of the table that expired before the given time
+func (r *ReaperPostgres) deleteExpired(function, table string, before time.Time, limit int) (int64, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE ctid IN (SELECT ctid FROM %s WHERE expires_at <= $1 LIMIT $2)`,
+		table, table)
+
+	result, err := r.db.Exec(query, before, limit)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "reaper_postgres.go",
+			"function": function,
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -3,26 +3,153 @@ package repository
 import (
 	"github.com/jmoiron/sqlx"
 	"github.com/th2empty/auth_service/pkg/models"
+	"time"
 )
 
 type Authorization interface {
 	CreateUser(user models.User) (int, error)
-	GetUser(username, password string) (models.User, error)
+	GetUser(username string) (models.User, error)
 	GetUserById(id uint) (models.User, error)
+	GetRoleByName(name string) (models.Role, error)
+	GetUserPermissions(userId uint) ([]string, error)
+	UpdatePasswordHash(userId uint, passwordHash string) error
 	GetSessions(ownerId uint) ([]models.Session, error)
 	GetSessionById(id uint) (models.Session, error)
-	AddSession(session models.Session, historyItem models.SessionHistoryItem) (uint, error)
-	UpdateSession(session models.Session) error
+	NextSessionId() (uint, error)
+	AddSession(session models.Session, historyItem models.SessionHistoryItem) error
+	UpdateSession(session models.Session, previousRefreshUUID string) error
+	TouchSession(sessionId uint) error
+	IsRefreshTokenRotated(sessionId uint, refreshUUID string) (bool, error)
 	GetSessionsDetails(userId uint) ([]models.SessionItem, error)
+	GetSessionAppId(sessionId uint) (uint, error)
 	Logout(sessionId uint) error
 }
 
+type SigningKeys interface {
+	GetSigningKeys() ([]models.SigningKey, error)
+	RotateSigningKey(key models.SigningKey, notBefore, expiresAt time.Time) (bool, error)
+	DeleteExpiredSigningKeys() error
+}
+
+type SecurityEvents interface {
+	AddSecurityEvent(event models.SecurityEvent) error
+}
+
+type Applications interface {
+	GetApplicationByClientId(clientId string) (models.Application, error)
+	SetClientSecret(clientId, secretHash string) error
+}
+
+type Denylist interface {
+	AddRevokedToken(jti string, expiresAt time.Time) error
+	GetRevokedTokenExpiration(jti string) (*time.Time, error)
+	GetRevokedTokens(since time.Time) ([]models.RevokedToken, error)
+}
+
+type OAuth interface {
+	AddAuthorizationCode(code models.AuthorizationCode) error
+	ConsumeAuthorizationCode(codeHash string) (models.AuthorizationCode, error)
+	AddDeviceCode(code models.DeviceCode) error
+	GetDeviceCode(deviceCodeHash string) (models.DeviceCode, error)
+	GetDeviceCodeByUserCode(userCode string) (models.DeviceCode, error)
+	UpdateDeviceCodePoll(deviceCodeHash string, previousPolledAt *time.Time, polledAt time.Time, interval int) (bool, error)
+	SetDeviceCodeStatus(userCode string, userId uint, status string) (bool, error)
+	ConsumeDeviceCode(deviceCodeHash string) (models.DeviceCode, error)
+}
+
+type MFA interface {
+	GetTOTPCredential(userId uint) (models.TOTPCredential, error)
+	SaveTOTPCredential(userId uint, secret []byte) (bool, error)
+	ConfirmTOTPCredential(userId uint, step int64) (bool, error)
+	UseTOTPStep(userId uint, step int64) (bool, error)
+	DeleteTOTPCredential(userId uint) error
+	AddMFAChallenge(challenge models.MFAChallenge) error
+	AttemptMFAChallenge(tokenHash string, maxAttempts int) (models.MFAChallenge, error)
+	GetMFAChallengeUserId(tokenHash string) (uint, error)
+	DeleteMFAChallenge(tokenHash string) error
+	AttemptSecondFactor(userId uint, policy models.MFALockoutPolicy) (int, error)
+	ResetSecondFactorAttempts(userId uint) error
+	ReplaceRecoveryCodes(userId uint, codeHashes []string) error
+	UseRecoveryCode(userId uint, codeHash string) (bool, error)
+	CountRecoveryCodes(userId uint) (int, error)
+	DeleteRecoveryCodes(userId uint) error
+}
+
+type WebAuthn interface {
+	GetWebAuthnCredentials(userId uint) ([]models.WebAuthnCredential, error)
+	GetWebAuthnCredentialByCredentialId(credentialId []byte) (models.WebAuthnCredential, error)
+	AddWebAuthnCredential(credential models.WebAuthnCredential) (uint, error)
+	UpdateWebAuthnCredentialUse(id uint, signCount int64) error
+	DeleteWebAuthnCredential(userId, id uint) (bool, error)
+	AddWebAuthnChallenge(challenge models.WebAuthnChallenge) error
+	ConsumeWebAuthnChallenge(id, ceremony string) (models.WebAuthnChallenge, error)
+}
+
+type Admin interface {
+	GetUsers(filter models.UserFilter) ([]models.UserAccount, int, error)
+	GetUserAccount(userId uint) (models.UserAccount, error)
+	GetRoleById(id uint) (models.Role, error)
+	UpdateUserRole(userId, roleId uint, entry models.AuditLogEntry) (bool, error)
+	SetUserDisabled(userId uint, disabled bool, entry models.AuditLogEntry) (bool, error)
+	DeleteUserSessions(userId uint, entry models.AuditLogEntry) error
+	DeleteUser(userId uint, entry models.AuditLogEntry) (bool, error)
+	GetAuditLog(targetUserId uint, limit, offset int) ([]models.AuditLogEntry, int, error)
+	AddAuditLogEntry(entry models.AuditLogEntry) error
+	GetRoles() ([]models.RoleDetails, error)
+	GetRoleDetails(id uint) (models.RoleDetails, error)
+	GetRoleByName(name string) (models.Role, error)
+	CreateRole(name string, permissions []string, entry models.AuditLogEntry) (uint, error)
+	RenameRole(id uint, name string, entry models.AuditLogEntry) (bool, error)
+	UpdateRolePermissions(id uint, permissions []string, entry models.AuditLogEntry) (bool, error)
+	DeleteRole(id uint, entry models.AuditLogEntry) (bool, error)
+	GetPermissions() ([]models.Permission, error)
+	GetPermissionById(id uint) (models.Permission, error)
+	CreatePermission(permission models.Permission, entry models.AuditLogEntry) (uint, error)
+	UpdatePermissionDescription(id uint, description string, entry models.AuditLogEntry) (bool, error)
+	DeletePermission(id uint, entry models.AuditLogEntry) (bool, error)
+}
+
+type Reaper interface {
+	RunExclusive(job string, run func() error) (bool, error)
+	DeleteExpiredSessions(policy models.SessionPolicy, refreshTokenTTL time.Duration, limit int) (int64, error)
+	DeleteExpiredAuthorizationCodes(before time.Time, limit int) (int64, error)
+	DeleteExpiredDeviceCodes(before time.Time, limit int) (int64, error)
+	DeleteExpiredMFAChallenges(before time.Time, limit int) (int64, error)
+	DeleteExpiredWebAuthnChallenges(before time.Time, limit int) (int64, error)
+	DeleteExpiredRevokedTokens(before time.Time, limit int) (int64, error)
+}
+
+type LoginEvents interface {
+	AddLoginEvent(event models.LoginEvent) error
+	GetLoginEvents(userId uint, limit, offset int) ([]models.LoginEvent, int, error)
+}
+
 type Repository struct {
 	Authorization
+	SigningKeys
+	SecurityEvents
+	Applications
+	Denylist
+	OAuth
+	MFA
+	WebAuthn
+	Admin
+	Reaper
+	LoginEvents
 }
 
 func NewRepository(db *sqlx.DB) *Repository {
 	return &Repository{
-		Authorization: NewAuthPostgres(db),
+		Authorization:  NewAuthPostgres(db),
+		SigningKeys:    NewKeysPostgres(db),
+		SecurityEvents: NewEventsPostgres(db),
+		Applications:   NewApplicationsPostgres(db),
+		Denylist:       NewDenylistPostgres(db),
+		OAuth:          NewOAuthPostgres(db),
+		MFA:            NewMFAPostgres(db),
+		WebAuthn:       NewWebAuthnPostgres(db),
+		Admin:          NewAdminPostgres(db),
+		Reaper:         NewReaperPostgres(db),
+		LoginEvents:    NewLoginEventsPostgres(db),
 	}
 }
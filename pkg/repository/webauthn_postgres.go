@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+type WebAuthnPostgres struct {
+	db *sqlx.DB
+}
+
+func NewWebAuthnPostgres(db *sqlx.DB) *WebAuthnPostgres {
+	return &WebAuthnPostgres{db: db}
+}
+
+func (r *WebAuthnPostgres) GetWebAuthnCredentials(userId uint) ([]models.WebAuthnCredential, error) {
+	var credentials []models.WebAuthnCredential
+
+	query := fmt.Sprintf(`SELECT id, user_id, credential_id, public_key, attestation_type, aaguid, sign_count, transports,
+								name, created_at, last_used_at FROM %s WHERE user_id=$1 ORDER BY id`, webAuthnCredentialsTable)
+	err := r.db.Select(&credentials, query, userId)
+
+	return credentials, err
+}
+
+// GetWebAuthnCredentialByCredentialId looks up a credential by the id the authenticator returned,
+// which is how the user of a passkey sign-in without a username is found
+func (r *WebAuthnPostgres) GetWebAuthnCredentialByCredentialId(credentialId []byte) (models.WebAuthnCredential, error) {
+	var credential models.WebAuthnCredential
+
+	query := fmt.Sprintf(`SELECT id, user_id, credential_id, public_key, attestation_type, aaguid, sign_count, transports,
+								name, created_at, last_used_at FROM %s WHERE credential_id=$1`, webAuthnCredentialsTable)
+	err := r.db.Get(&credential, query, credentialId)
+
+	return credential, err
+}
+
+func (r *WebAuthnPostgres) AddWebAuthnCredential(credential models.WebAuthnCredential) (uint, error) {
+	var id uint
+
+	query := fmt.Sprintf(`INSERT INTO %s (user_id, credential_id, public_key, attestation_type, aaguid, sign_count,
+								transports, name) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		webAuthnCredentialsTable)
+	row := r.db.QueryRow(query, credential.UserId, credential.CredentialId, credential.PublicKey,
+		credential.AttestationType, credential.AAGUID, credential.SignCount, credential.Transports, credential.Name)
+	if err := row.Scan(&id); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "webauthn_postgres.go",
+			"function": "AddWebAuthnCredential",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// UpdateWebAuthnCredentialUse stores the signature counter of the credential after a successful login
+func (r *WebAuthnPostgres) UpdateWebAuthnCredentialUse(id uint, signCount int64) error {
+	query := fmt.Sprintf(`UPDATE %s SET sign_count=$1, last_used_at=now() WHERE id=$2`, webAuthnCredentialsTable)
+	if _, err := r.db.Exec(query, signCount, id); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "webauthn_postgres.go",
+			"function": "UpdateWebAuthnCredentialUse",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// DeleteWebAuthnCredential deletes a credential of the user. It reports false if the user has no such credential
+func (r *WebAuthnPostgres) DeleteWebAuthnCredential(userId, id uint) (bool, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id=$1 AND user_id=$2`, webAuthnCredentialsTable)
+	result, err := r.db.Exec(query, id, userId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "webauthn_postgres.go",
+			"function": "DeleteWebAuthnCredential",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows != 0, err
+}
+
+func (r *WebAuthnPostgres) AddWebAuthnChallenge(challenge models.WebAuthnChallenge) error {
+	query := fmt.Sprintf(`INSERT INTO %s (id, user_id, ceremony, session_data, expires_at)
+								VALUES($1, NULLIF($2, 0), $3, $4, $5)`, webAuthnChallengesTable)
+	_, err := r.db.Exec(query, challenge.Id, challenge.UserId, challenge.Ceremony, challenge.SessionData,
+		challenge.ExpiresAt)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "repository",
+			"file":     "webauthn_postgres.go",
+			"function": "AddWebAuthnChallenge",
+			"message":  err,
+		}).Errorf("failed to execute query")
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeWebAuthnChallenge deletes the unexpired challenge of the ceremony and returns it,
+// so that every challenge can be answered only once
+func (r *WebAuthnPostgres) ConsumeWebAuthnChallenge(id, ceremony string) (models.WebAuthnChallenge, error) {
+	var challenge models.WebAuthnChallenge
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id=$1 AND ceremony=$2 AND expires_at > $3
+								RETURNING id, COALESCE(user_id, 0) AS user_id, ceremony, session_data, created_at, expires_at`,
+		webAuthnChallengesTable)
+	err := r.db.Get(&challenge, query, id, ceremony, time.Now())
+
+	return challenge, err
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrRoleNotFound    = errors.New("role not found")
+	ErrAdminSelfAction = errors.New("administrators can not disable, delete or change the role of their own account")
+)
+
+// AdminService lets administrators manage user accounts. Every change is recorded in the audit log
+// together with the administrator who made it
+type AdminService struct {
+	repo repository.Admin
+	auth Authorization
+	mfa  *MFAService
+	keys *KeyService
+}
+
+func NewAdminService(repo repository.Admin, auth Authorization, mfa *MFAService, keys *KeyService) *AdminService {
+	return &AdminService{repo: repo, auth: auth, mfa: mfa, keys: keys}
+}
+
+// GetUsers returns a page of the users matching the filter. Pages are numbered from 1
+func (s *AdminService) GetUsers(filter models.UserFilter, page, perPage int) (models.UserList, error) {
+	page, perPage = normalizePage(page, perPage)
+	filter.Limit, filter.Offset = perPage, (page-1)*perPage
+
+	users, total, err := s.repo.GetUsers(filter)
+	if err != nil {
+		return models.UserList{}, err
+	}
+
+	return models.UserList{Users: users, Total: total, Page: page, PerPage: perPage}, nil
+}
+
+func (s *AdminService) GetUserDetails(userId uint) (models.UserAccountDetails, error) {
+	account, err := s.getUserAccount(userId)
+	if err != nil {
+		return models.UserAccountDetails{}, err
+	}
+
+	sessions, err := s.auth.GetSessionsDetails(userId)
+	if err != nil {
+		return models.UserAccountDetails{}, err
+	}
+	if sessions == nil {
+		sessions = []models.SessionItem{}
+	}
+
+	mfaMethods, err := s.mfa.GetMFAMethods(userId)
+	if err != nil {
+		return models.UserAccountDetails{}, err
+	}
+	if mfaMethods == nil {
+		mfaMethods = []string{}
+	}
+
+	return models.UserAccountDetails{UserAccount: account, MFAMethods: mfaMethods, Sessions: sessions}, nil
+}
+
+// SetUserRole assigns a role to the user. The new permissions are put into the user's tokens on the next refresh.
+// Taking manage_accounts away from the last active user who has it fails with ErrLastAccountManager
+func (s *AdminService) SetUserRole(adminId, userId, roleId uint, ipAddress string) error {
+	if adminId == userId {
+		return ErrAdminSelfAction
+	}
+
+	account, err := s.getUserAccount(userId)
+	if err != nil {
+		return err
+	}
+
+	role, err := s.repo.GetRoleById(roleId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+
+	ok, err := s.repo.UpdateUserRole(userId, roleId, models.AuditLogEntry{
+		AdminId:      adminId,
+		Action:       models.AuditActionUserRoleChanged,
+		TargetUserId: userId,
+		Details:      fmt.Sprintf("role of %s changed from %s to %s", account.Username, account.RoleName, role.Name),
+		IpAddress:    ipAddress,
+	})
+
+	return userUpdated(ok, err)
+}
+
+// DisableUser prevents the user from signing in and signs them out of all sessions.
+// The last active user who can manage accounts can not be disabled
+func (s *AdminService) DisableUser(adminId, userId uint, ipAddress string) error {
+	return s.setUserDisabled(adminId, userId, true, ipAddress)
+}
+
+func (s *AdminService) EnableUser(adminId, userId uint, ipAddress string) error {
+	return s.setUserDisabled(adminId, userId, false, ipAddress)
+}
+
+// LogoutUser signs the user out of all sessions
+func (s *AdminService) LogoutUser(adminId, userId uint, ipAddress string) error {
+	account, err := s.getUserAccount(userId)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.DeleteUserSessions(userId, models.AuditLogEntry{
+		AdminId:      adminId,
+		Action:       models.AuditActionUserSessionsRevoked,
+		TargetUserId: userId,
+		Details:      fmt.Sprintf("all sessions of %s revoked", account.Username),
+		IpAddress:    ipAddress,
+	})
+}
+
+// DeleteUser deletes the account with its sessions, second factors and settings.
+// The last active user who can manage accounts can not be deleted
+func (s *AdminService) DeleteUser(adminId, userId uint, ipAddress string) error {
+	if adminId == userId {
+		return ErrAdminSelfAction
+	}
+
+	account, err := s.getUserAccount(userId)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.repo.DeleteUser(userId, models.AuditLogEntry{
+		AdminId:      adminId,
+		Action:       models.AuditActionUserDeleted,
+		TargetUserId: userId,
+		Details:      fmt.Sprintf("user %s deleted", account.Username),
+		IpAddress:    ipAddress,
+	})
+
+	return userUpdated(ok, err)
+}
+
+// GetAuditLog returns a page of the actions of administrators, newest first.
+// A target user id of 0 returns the actions on all users
+func (s *AdminService) GetAuditLog(targetUserId uint, page, perPage int) (models.AuditLog, error) {
+	page, perPage = normalizePage(page, perPage)
+
+	entries, total, err := s.repo.GetAuditLog(targetUserId, perPage, (page-1)*perPage)
+	if err != nil {
+		return models.AuditLog{}, err
+	}
+
+	return models.AuditLog{Entries: entries, Total: total, Page: page, PerPage: perPage}, nil
+}
+
+func (s *AdminService) setUserDisabled(adminId, userId uint, disabled bool, ipAddress string) error {
+	if adminId == userId {
+		return ErrAdminSelfAction
+	}
+
+	account, err := s.getUserAccount(userId)
+	if err != nil {
+		return err
+	}
+
+	entry := models.AuditLogEntry{
+		AdminId:      adminId,
+		Action:       models.AuditActionUserEnabled,
+		TargetUserId: userId,
+		Details:      fmt.Sprintf("user %s enabled", account.Username),
+		IpAddress:    ipAddress,
+	}
+	if disabled {
+		entry.Action = models.AuditActionUserDisabled
+		entry.Details = fmt.Sprintf("user %s disabled and signed out of all sessions", account.Username)
+	}
+
+	ok, err := s.repo.SetUserDisabled(userId, disabled, entry)
+
+	return userUpdated(ok, err)
+}
+
+func (s *AdminService) getUserAccount(userId uint) (models.UserAccount, error) {
+	account, err := s.repo.GetUserAccount(userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.UserAccount{}, ErrUserNotFound
+		}
+		return models.UserAccount{}, err
+	}
+
+	return account, nil
+}
+
+// userUpdated turns a change that did not affect any user into ErrUserNotFound,
+// which happens when the user is deleted concurrently
+func userUpdated(ok bool, err error) error {
+	if err == nil && !ok {
+		return ErrUserNotFound
+	}
+
+	return accountManagerError(err)
+}
+
+func normalizePage(page, perPage int) (int, int) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultPageSize
+	}
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+
+	return page, perPage
+}
+
+// RotateSigningKeys immediately replaces the current signing key, e.g. when it may have leaked, and returns
+// the id of the new key. Tokens signed with the previous key are accepted until they expire
+func (s *AdminService) RotateSigningKeys(adminId uint, ipAddress string) (string, error) {
+	if err := s.keys.RotateKeys(); err != nil {
+		return "", err
+	}
+	keyId := s.keys.signingKey().id
+
+	return keyId, s.repo.AddAuditLogEntry(models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionSigningKeyRotated,
+		Details:   fmt.Sprintf("signing key replaced by %s", keyId),
+		IpAddress: ipAddress,
+	})
+}
@@ -1,14 +1,18 @@
 package service
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/th2empty/auth_service/configs"
 	"github.com/th2empty/auth_service/pkg/models"
 	"github.com/th2empty/auth_service/pkg/repository"
 	"github.com/th2empty/auth_service/pkg/utils"
+	"strconv"
 	"time"
 )
 
@@ -20,7 +24,15 @@ var (
 	//salt            = viper.GetString("auth.salt")
 	accessTokenTTL  = viper.GetDuration("auth.access_token_ttl") * time.Minute
 	refreshTokenTTL = viper.GetDuration("auth.refresh_token_ttl") * time.Hour
-	signingKey      = viper.GetString("auth.signing_key")
+
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected, the session has been revoked")
+	ErrAccountDisabled    = errors.New("the account has been disabled")
+	ErrSessionNotFound    = errors.New("session not found")
+
+	// dummyPasswordHash is compared against when the user does not exist,
+	// so that the response time does not reveal which usernames are registered
+	dummyPasswordHash, _ = utils.GeneratePasswordHash("dummy password")
 )
 
 type AccessTokenClaims struct {
@@ -29,6 +41,15 @@ type AccessTokenClaims struct {
 	Username  string `json:"username"`
 	RoleId    uint   `json:"role_id"`
 	SessionId uint   `json:"session_id"`
+	Type      string `json:"typ"`
+	ClientId  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+// IsMachineToken reports whether the token was issued to a client for itself (client credentials grant)
+// rather than on behalf of a user
+func (c *AccessTokenClaims) IsMachineToken() bool {
+	return c.UserId == 0 && c.ClientId != ""
 }
 
 type RefreshTokenClaims struct {
@@ -38,23 +59,82 @@ type RefreshTokenClaims struct {
 	RoleId      uint   `json:"role_id"`
 	SessionID   uint   `json:"session_id"`
 	RefreshUUID string `json:"refresh_uuid"`
+	Type        string `json:"typ"`
 }
 
 type AuthService struct {
-	repo repository.Authorization
+	repo     repository.Authorization
+	events   repository.SecurityEvents
+	keys     *KeyService
+	denylist *DenylistService
+	notifier Notifier
+	locator  GeoLocator
 }
 
-func NewAuthService(repo repository.Authorization) *AuthService {
-	return &AuthService{repo: repo}
+func NewAuthService(repo repository.Authorization, events repository.SecurityEvents, keys *KeyService,
+	denylist *DenylistService, notifier Notifier, locator GeoLocator) *AuthService {
+	return &AuthService{repo: repo, events: events, keys: keys, denylist: denylist, notifier: notifier,
+		locator: locator}
 }
 
+// CreateUser registers the user with the default role (auth.default_role)
 func (s *AuthService) CreateUser(user models.User) (int, error) {
-	user.Password = utils.GeneratePasswordHash(user.Password)
+	role, err := s.getDefaultRole()
+	if err != nil {
+		return 0, err
+	}
+	user.RoleId = role.Id
+
+	passwordHash, err := utils.GeneratePasswordHash(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	user.Password = passwordHash
 	return s.repo.CreateUser(user)
 }
 
+// GetUser returns the user with the given credentials. Hashes created with an outdated algorithm
+// or weaker parameters are transparently replaced after a successful verification
 func (s *AuthService) GetUser(username, password string) (models.User, error) {
-	return s.repo.GetUser(username, password)
+	user, err := s.repo.GetUser(username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_, _ = utils.ComparePasswordHash(password, dummyPasswordHash)
+			return models.User{}, ErrInvalidCredentials
+		}
+		return models.User{}, err
+	}
+
+	ok, err := utils.ComparePasswordHash(password, user.Password)
+	if err != nil {
+		return models.User{}, err
+	}
+	if !ok {
+		return models.User{}, ErrInvalidCredentials
+	}
+	if user.DisabledAt != nil {
+		return models.User{}, ErrAccountDisabled
+	}
+
+	if utils.PasswordHashNeedsRehash(user.Password) {
+		passwordHash, err := utils.GeneratePasswordHash(password)
+		if err == nil {
+			err = s.repo.UpdatePasswordHash(user.Id, passwordHash)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "auth.go",
+				"function": "GetUser",
+				"message":  err,
+			}).Errorf("failed to upgrade password hash")
+		} else {
+			user.Password = passwordHash
+		}
+	}
+
+	return user, nil
 }
 
 func (s *AuthService) GetUserById(id uint) (models.User, error) {
@@ -73,81 +153,211 @@ func (s *AuthService) GetSessionById(id uint) (models.Session, error) {
 	return s.repo.GetSessionById(id)
 }
 
-func (s *AuthService) AddSession(session models.Session, historyItem models.SessionHistoryItem) (uint, error) {
-	return s.repo.AddSession(session, historyItem)
+func (s *AuthService) GetSessionAppId(sessionId uint) (uint, error) {
+	return s.repo.GetSessionAppId(sessionId)
+}
+
+// StartSession creates the session and issues its tokens. The session id is allocated before the tokens are
+// signed, so that they carry the id of the stored session, and concurrent sign-ins always get different ids.
+// The history item is completed with the location of its IP address
+func (s *AuthService) StartSession(user models.User, session models.Session,
+	historyItem models.SessionHistoryItem) ([]string, error) {
+	location := s.locator.Locate(historyItem.IpAddress)
+	if location.City != "" {
+		historyItem.City = location.City
+	}
+	historyItem.Country = location.Country
+	historyItem.ASN = location.ASN
+	historyItem.ASOrganization = location.ASOrganization
+
+	sessionId, err := s.repo.NextSessionId()
+	if err != nil {
+		return nil, err
+	}
+	session.SessionId = sessionId
+
+	tokens, err := s.GenerateTokens(user, session)
+	if err != nil {
+		return nil, err
+	}
+	session.RefreshToken = tokens[1]
+
+	if err := s.repo.AddSession(session, historyItem); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
 }
 
-func (s *AuthService) UpdateSession(session models.Session) error {
-	return s.repo.UpdateSession(session)
+// UpdateSession stores the rotated refresh token of the session. ErrRefreshTokenReused is returned
+// if the previous refresh token has already been exchanged by a concurrent request
+func (s *AuthService) UpdateSession(session models.Session, previousRefreshUUID string) error {
+	err := s.repo.UpdateSession(session, previousRefreshUUID)
+	if errors.Is(err, repository.ErrStaleRefreshToken) {
+		return ErrRefreshTokenReused
+	}
+
+	return err
+}
+
+// IsRefreshTokenReused reports whether the refresh token id belongs to a token of the session
+// that has already been exchanged for a new one
+func (s *AuthService) IsRefreshTokenReused(sessionId uint, refreshUUID string) (bool, error) {
+	return s.repo.IsRefreshTokenRotated(sessionId, refreshUUID)
+}
+
+// RevokeSessionFamily deletes the session, which invalidates every access and refresh token
+// descended from it, records a security event and notifies the owner of the session
+func (s *AuthService) RevokeSessionFamily(session models.Session, ipAddress string) error {
+	if err := s.repo.Logout(session.SessionId); err != nil {
+		return err
+	}
+
+	if err := s.events.AddSecurityEvent(models.SecurityEvent{
+		UserId:    session.UserId,
+		SessionId: session.SessionId,
+		Type:      models.SecurityEventRefreshTokenReuse,
+		IpAddress: ipAddress,
+		Details:   "an already used refresh token was presented, the session has been revoked",
+	}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "auth.go",
+			"function": "RevokeSessionFamily",
+			"message":  err,
+		}).Errorf("failed to record security event")
+	}
+
+	user, err := s.repo.GetUserById(session.UserId)
+	if err != nil {
+		return err
+	}
+
+	notifyAsync(s.notifier, user, "Suspicious activity on your account",
+		fmt.Sprintf("An already used refresh token was presented from %s, so one of your sessions has been "+
+			"signed out to protect your account. If it was not you, please change your password.", ipAddress))
+
+	return nil
 }
 
+// GenerateTokens issues the tokens of the session, unless the account has been disabled. The scope of access
+// tokens carries the permissions of the user's role, so that resource servers can check them without a database
+// lookup. Sessions of OAuth clients only get the permissions the user has consented to, so that a third-party
+// application can not act with all of the user's permissions
 func (s *AuthService) GenerateTokens(user models.User, session models.Session) ([]string, error) {
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
-		jwt.StandardClaims{
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	scope, err := s.tokenScope(user.Id, session)
+	if err != nil {
+		return nil, err
+	}
+
+	key := s.keys.signingKey()
+
+	accessToken := jwt.NewWithClaims(key.method, &AccessTokenClaims{
+		StandardClaims: jwt.StandardClaims{
 			Issuer:    issuer,
 			Audience:  audience,
+			Subject:   strconv.Itoa(int(user.Id)),
 			ExpiresAt: time.Now().Add(accessTokenTTL).Unix(),
 			IssuedAt:  time.Now().Unix(), // Token generation time
+			NotBefore: time.Now().Unix(),
 			Id:        uuid.New().String(),
 		},
-		user.Id, user.Username, user.RoleId, session.SessionId,
+		UserId:    user.Id,
+		Username:  user.Username,
+		RoleId:    user.RoleId,
+		SessionId: session.SessionId,
+		Type:      TokenTypeAccess,
+		ClientId:  session.ClientId,
+		Scope:     scope,
 	})
+	accessToken.Header["kid"] = key.id
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, &RefreshTokenClaims{
+	refreshToken := jwt.NewWithClaims(key.method, &RefreshTokenClaims{
 		jwt.StandardClaims{
 			Issuer:    issuer,
 			Audience:  audience,
+			Subject:   strconv.Itoa(int(user.Id)),
 			ExpiresAt: time.Now().Add(refreshTokenTTL).Unix(),
 			IssuedAt:  time.Now().Unix(),
+			NotBefore: time.Now().Unix(),
 		},
 		user.Id, user.Username, user.RoleId,
-		session.SessionId, session.RefreshUUID,
+		session.SessionId, session.RefreshUUID, TokenTypeRefresh,
 	})
+	refreshToken.Header["kid"] = key.id
 
-	sAccessToken, err := accessToken.SignedString([]byte(signingKey))
+	sAccessToken, err := accessToken.SignedString(key.privateKey)
 	if err != nil {
 		return nil, err
 	}
-	sRefreshToken, err := refreshToken.SignedString([]byte(signingKey))
+	sRefreshToken, err := refreshToken.SignedString(key.privateKey)
 
 	return []string{sAccessToken, sRefreshToken}, err
 }
 
-func (s *AuthService) ParseAccessToken(inputToken string) (*AccessTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(inputToken, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid signing method")
-		}
+// GenerateClientToken issues an access token to the application itself. Such tokens are not bound
+// to a user or session, the subject is the client id, and no refresh token is issued
+func (s *AuthService) GenerateClientToken(application models.Application, scope string) (string, error) {
+	key := s.keys.signingKey()
 
-		return []byte(signingKey), nil
+	token := jwt.NewWithClaims(key.method, &AccessTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			Audience:  audience,
+			Subject:   application.ClientId,
+			ExpiresAt: time.Now().Add(accessTokenTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			NotBefore: time.Now().Unix(),
+			Id:        uuid.New().String(),
+		},
+		Type:     TokenTypeAccess,
+		ClientId: application.ClientId,
+		Scope:    scope,
 	})
-	if err != nil {
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.privateKey)
+}
+
+func (s *AuthService) ParseAccessToken(inputToken string) (*AccessTokenClaims, error) {
+	claims := &AccessTokenClaims{}
+	if err := s.parseToken(inputToken, claims, &claims.StandardClaims); err != nil {
 		return nil, err
 	}
 
-	claims, ok := token.Claims.(*AccessTokenClaims)
-	if !ok {
-		return nil, errors.New("token claims are not of type *tokenClaims")
+	// tokens issued before the typ claim was introduced are recognized by their shape
+	if claims.Type != TokenTypeAccess && (claims.Type != "" || claims.Id == "") {
+		return nil, ErrWrongTokenType
+	}
+
+	revoked, err := s.denylist.IsTokenRevoked(claims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
 	}
 
 	return claims, nil
 }
 
-func (s *AuthService) ParseRefreshToken(inputToken string) (*RefreshTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(inputToken, &RefreshTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid signing method")
-		}
+// RevokeAccessToken makes the access token unusable before it expires
+func (s *AuthService) RevokeAccessToken(claims *AccessTokenClaims) error {
+	return s.denylist.RevokeAccessToken(claims.Id, time.Unix(claims.ExpiresAt, 0))
+}
 
-		return []byte(signingKey), nil
-	})
-	if err != nil {
+func (s *AuthService) ParseRefreshToken(inputToken string) (*RefreshTokenClaims, error) {
+	claims := &RefreshTokenClaims{}
+	if err := s.parseToken(inputToken, claims, &claims.StandardClaims); err != nil {
 		return nil, err
 	}
 
-	claims, ok := token.Claims.(*RefreshTokenClaims)
-	if !ok {
-		return nil, errors.New("token claims are not of type *tokenClaims")
+	if claims.Type != TokenTypeRefresh && (claims.Type != "" || claims.RefreshUUID == "") {
+		return nil, ErrWrongTokenType
 	}
 
 	return claims, nil
@@ -156,3 +366,40 @@ func (s *AuthService) ParseRefreshToken(inputToken string) (*RefreshTokenClaims,
 func (s *AuthService) Logout(sessionId uint) error {
 	return s.repo.Logout(sessionId)
 }
+
+// RevokeSession signs the user out of one of their sessions. Sessions of other users are reported
+// as ErrSessionNotFound, so that their ids can not be probed
+func (s *AuthService) RevokeSession(userId, sessionId uint) error {
+	session, err := s.repo.GetSessionById(sessionId)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && session.UserId != userId {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.repo.Logout(sessionId)
+}
+
+// RevokeOtherSessions signs the user out of every session except the current one
+// and returns the number of revoked sessions
+func (s *AuthService) RevokeOtherSessions(userId, currentSessionId uint) (int, error) {
+	sessions, err := s.repo.GetSessions(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		if session.SessionId == currentSessionId {
+			continue
+		}
+
+		if err := s.repo.Logout(session.SessionId); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+
+	defaultClockSkewLeeway = 30 * time.Second
+)
+
+var (
+	clockSkewLeeway    = viper.GetDuration("auth.clock_skew_leeway") * time.Second
+	clockSkewLeewaySet = viper.IsSet("auth.clock_skew_leeway")
+)
+
+// TokenError is returned when a token can not be accepted. Code is a stable,
+// machine-readable identifier of the reason that clients can rely on
+type TokenError struct {
+	Code    string
+	Message string
+}
+
+func (e *TokenError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrInvalidToken          = &TokenError{"invalid_token", "token is malformed or its signature is invalid"}
+	ErrTokenExpired          = &TokenError{"token_expired", "token has expired"}
+	ErrTokenNotYetValid      = &TokenError{"token_not_yet_valid", "token is not valid yet"}
+	ErrTokenIssuedInFuture   = &TokenError{"token_issued_in_future", "token was issued in the future"}
+	ErrInvalidIssuer         = &TokenError{"invalid_issuer", "token was issued by another issuer"}
+	ErrInvalidAudience       = &TokenError{"invalid_audience", "token is intended for another audience"}
+	ErrWrongTokenType        = &TokenError{"wrong_token_type", "token can not be used for this purpose"}
+	ErrTokenRevoked          = &TokenError{"token_revoked", "token has been revoked"}
+	ErrMissingExpirationTime = &TokenError{"invalid_token", "token has no expiration time"}
+)
+
+var tokenParser = &jwt.Parser{SkipClaimsValidation: true}
+
+// leeway returns the configured leeway. 0 disables it, the default is only used when none is configured
+func leeway() time.Duration {
+	if !clockSkewLeewaySet || clockSkewLeeway < 0 {
+		return defaultClockSkewLeeway
+	}
+
+	return clockSkewLeeway
+}
+
+// validateClaims checks the registered claims of a token whose signature has already been verified.
+// Time based claims are checked with a leeway that compensates for clock skew between servers
+func validateClaims(claims *jwt.StandardClaims) error {
+	now := time.Now()
+	skew := leeway()
+
+	if claims.ExpiresAt == 0 {
+		return ErrMissingExpirationTime
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(skew)) {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(skew).Before(time.Unix(claims.NotBefore, 0)) {
+		return ErrTokenNotYetValid
+	}
+	if claims.IssuedAt != 0 && now.Add(skew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return ErrTokenIssuedInFuture
+	}
+	if claims.Issuer != issuer {
+		return ErrInvalidIssuer
+	}
+	if claims.Audience != audience {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+// parseToken verifies the signature of the token and its registered claims
+func (s *AuthService) parseToken(inputToken string, claims jwt.Claims, standardClaims *jwt.StandardClaims) error {
+	if _, err := tokenParser.ParseWithClaims(inputToken, claims, s.keys.keyFunc); err != nil {
+		return ErrInvalidToken
+	}
+
+	return validateClaims(standardClaims)
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"sync"
+	"time"
+)
+
+var (
+	denylistCleanupInterval = viper.GetDuration("auth.denylist_cleanup_interval") * time.Minute
+	denylistSyncInterval    = viper.GetDuration("auth.denylist_sync_interval") * time.Second
+)
+
+const (
+	defaultDenylistCleanupInterval = 10 * time.Minute
+	defaultDenylistSyncInterval    = 5 * time.Second
+
+	// denylistSyncOverlap is read again on every sync, since a revocation can be committed
+	// after a later one has already been loaded
+	denylistSyncOverlap = time.Minute
+)
+
+// DenylistService records the ids (jti) of revoked access tokens until the tokens expire.
+// Revocations are stored in Postgres and every instance keeps the whole revoked set in memory, loading
+// the revocations of other instances every few seconds, so that checking a token needs no database lookup.
+// While the set can not be synced, unknown tokens are looked up in the database
+type DenylistService struct {
+	repo repository.Denylist
+
+	mu       sync.RWMutex
+	revoked  map[string]time.Time
+	syncedAt time.Time
+	since    time.Time
+}
+
+func NewDenylistService(repo repository.Denylist) *DenylistService {
+	return &DenylistService{repo: repo, revoked: make(map[string]time.Time)}
+}
+
+// RevokeAccessToken denies the token with the given id until expiresAt
+func (s *DenylistService) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	if jti == "" || !expiresAt.After(time.Now()) {
+		return nil
+	}
+
+	if err := s.repo.AddRevokedToken(jti, expiresAt); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.revoked[jti] = expiresAt
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *DenylistService) IsTokenRevoked(jti string) (bool, error) {
+	s.mu.RLock()
+	_, ok := s.revoked[jti]
+	synced := time.Since(s.syncedAt) < 2*getDenylistSyncInterval()
+	s.mu.RUnlock()
+	if ok || synced {
+		return ok, nil
+	}
+
+	expiresAt, err := s.repo.GetRevokedTokenExpiration(jti)
+	if err != nil || expiresAt == nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.revoked[jti] = *expiresAt
+	s.mu.Unlock()
+
+	return true, nil
+}
+
+// RunDenylistSync loads the revoked set and then periodically the tokens revoked since the last sync
+func (s *DenylistService) RunDenylistSync(ctx context.Context) {
+	ticker := time.NewTicker(getDenylistSyncInterval())
+	defer ticker.Stop()
+
+	for {
+		if err := s.sync(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "denylist.go",
+				"function": "RunDenylistSync",
+				"message":  err,
+			}).Errorf("failed to sync revoked access tokens")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *DenylistService) sync() error {
+	startedAt := time.Now()
+
+	s.mu.RLock()
+	since := s.since
+	s.mu.RUnlock()
+	if !since.IsZero() {
+		since = since.Add(-denylistSyncOverlap)
+	}
+
+	tokens, err := s.repo.GetRevokedTokens(since)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range tokens {
+		s.revoked[token.Jti] = token.ExpiresAt
+		if token.RevokedAt.After(s.since) {
+			s.since = token.RevokedAt
+		}
+	}
+	s.syncedAt = startedAt
+
+	return nil
+}
+
+func getDenylistSyncInterval() time.Duration {
+	if denylistSyncInterval <= 0 {
+		return defaultDenylistSyncInterval
+	}
+
+	return denylistSyncInterval
+}
+
+// RunDenylistCleanup periodically forgets cached revocations of tokens that have expired anyway.
+// The expired records in the database are purged by the reaper
+func (s *DenylistService) RunDenylistCleanup(ctx context.Context) {
+	interval := denylistCleanupInterval
+	if interval <= 0 {
+		interval = defaultDenylistCleanupInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		s.mu.Lock()
+		for jti, expiresAt := range s.revoked {
+			if !expiresAt.After(now) {
+				delete(s.revoked, jti)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
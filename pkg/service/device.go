@@ -0,0 +1,224 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/utils"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	defaultDeviceCodeTTL      = 10 * time.Minute
+	defaultDevicePollInterval = 5 * time.Second
+	// slowDownIncrement is added to the polling interval of a device that polls too fast (RFC 8628, section 3.5)
+	slowDownIncrement = 5
+	deviceCodeLength  = 32
+	userCodeLength    = 8
+	// userCodeAlphabet has no vowels, so that user codes never spell words, and no easily confused characters
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+var (
+	deviceCodeTTL      = viper.GetDuration("auth.device_code_ttl") * time.Second
+	devicePollInterval = viper.GetDuration("auth.device_poll_interval") * time.Second
+
+	ErrInvalidUserCode = errors.New("the code is invalid or has expired")
+)
+
+// CreateDeviceAuthorization starts the device authorization grant (RFC 8628) for the application.
+// Only the hash of the device code is stored, the user code is short and typed in by the user
+func (s *OAuthService) CreateDeviceAuthorization(application models.Application,
+	scope string) (models.DeviceAuthorizationResponse, error) {
+	if !application.HasGrantType(GrantTypeDeviceCode) {
+		return models.DeviceAuthorizationResponse{}, &OAuthError{"unauthorized_client",
+			"the client is not allowed to use the device_code grant"}
+	}
+	if err := validateScope(application, scope); err != nil {
+		return models.DeviceAuthorizationResponse{}, err
+	}
+
+	deviceCode, err := utils.GenerateRandomBytes(deviceCodeLength)
+	if err != nil {
+		return models.DeviceAuthorizationResponse{}, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return models.DeviceAuthorizationResponse{}, err
+	}
+
+	ttl := deviceCodeTTL
+	if ttl <= 0 {
+		ttl = defaultDeviceCodeTTL
+	}
+	interval := devicePollInterval
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+
+	encodedDeviceCode := base64.RawURLEncoding.EncodeToString(deviceCode)
+	err = s.codes.AddDeviceCode(models.DeviceCode{
+		DeviceCodeHash: hashClientSecret(encodedDeviceCode),
+		UserCode:       userCode,
+		AppId:          application.Id,
+		Scope:          scope,
+		PollInterval:   int(interval / time.Second),
+		ExpiresAt:      time.Now().Add(ttl),
+	})
+	if err != nil {
+		return models.DeviceAuthorizationResponse{}, err
+	}
+
+	verificationURI := strings.TrimSuffix(issuer, "/") + "/oauth/device"
+	return models.DeviceAuthorizationResponse{
+		DeviceCode:              encodedDeviceCode,
+		UserCode:                FormatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {FormatUserCode(userCode)}}.Encode(),
+		ExpiresIn:               int64(ttl / time.Second),
+		Interval:                int(interval / time.Second),
+	}, nil
+}
+
+// GetDeviceAuthorization returns the pending device authorization with the user code
+func (s *OAuthService) GetDeviceAuthorization(userCode string) (models.DeviceCode, error) {
+	code, err := s.codes.GetDeviceCodeByUserCode(normalizeUserCode(userCode))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.DeviceCode{}, ErrInvalidUserCode
+		}
+		return models.DeviceCode{}, err
+	}
+
+	if code.Status != models.DeviceCodeStatusPending || !time.Now().Before(code.ExpiresAt) {
+		return models.DeviceCode{}, ErrInvalidUserCode
+	}
+
+	return code, nil
+}
+
+// CompleteDeviceAuthorization records the decision of the user about the device authorization
+func (s *OAuthService) CompleteDeviceAuthorization(userCode string, userId uint, approve bool) error {
+	status := models.DeviceCodeStatusDenied
+	if approve {
+		status = models.DeviceCodeStatusApproved
+	}
+
+	ok, err := s.codes.SetDeviceCodeStatus(normalizeUserCode(userCode), userId, status)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidUserCode
+	}
+
+	return nil
+}
+
+// PollDeviceCode answers a token request of the device. Until the user has made a decision the
+// device is told to keep polling, and devices that poll faster than the interval are slowed down.
+// An approved device code is consumed, so it can be exchanged for tokens only once
+func (s *OAuthService) PollDeviceCode(application models.Application, deviceCode string) (models.DeviceCode, error) {
+	if !application.HasGrantType(GrantTypeDeviceCode) {
+		return models.DeviceCode{}, &OAuthError{"unauthorized_client",
+			"the client is not allowed to use the device_code grant"}
+	}
+	if deviceCode == "" {
+		return models.DeviceCode{}, &OAuthError{"invalid_request", "device_code is required"}
+	}
+
+	codeHash := hashClientSecret(deviceCode)
+	code, err := s.codes.GetDeviceCode(codeHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.DeviceCode{}, &OAuthError{"invalid_grant", "invalid device code"}
+		}
+		return models.DeviceCode{}, err
+	}
+	if code.AppId != application.Id {
+		return models.DeviceCode{}, &OAuthError{"invalid_grant", "invalid device code"}
+	}
+
+	now := time.Now()
+	if !now.Before(code.ExpiresAt) {
+		return models.DeviceCode{}, &OAuthError{"expired_token", "the device code has expired"}
+	}
+
+	interval := code.PollInterval
+	tooFast := code.LastPolledAt != nil && now.Sub(*code.LastPolledAt) < time.Duration(interval)*time.Second
+	if tooFast {
+		interval += slowDownIncrement
+	}
+
+	ok, err := s.codes.UpdateDeviceCodePoll(codeHash, code.LastPolledAt, now, interval)
+	if err != nil {
+		return models.DeviceCode{}, err
+	}
+	if !ok || tooFast {
+		return models.DeviceCode{}, &OAuthError{"slow_down", "the device is polling too frequently"}
+	}
+
+	if code.Status == models.DeviceCodeStatusPending {
+		return models.DeviceCode{}, &OAuthError{"authorization_pending", "the user has not yet completed the authorization"}
+	}
+
+	consumed, err := s.codes.ConsumeDeviceCode(codeHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.DeviceCode{}, &OAuthError{"invalid_grant", "invalid device code"}
+		}
+		return models.DeviceCode{}, err
+	}
+	if consumed.Status != models.DeviceCodeStatusApproved || consumed.UserId == nil {
+		return models.DeviceCode{}, &OAuthError{"access_denied", "the user has denied the authorization"}
+	}
+
+	return consumed, nil
+}
+
+// FormatUserCode splits the user code into two groups, e.g. BDFG-HJKL, to make it easier to type
+func FormatUserCode(userCode string) string {
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// normalizeUserCode accepts user codes typed in lower case, with or without the separator
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(userCode))
+}
+
+// generateUserCode picks random characters from userCodeAlphabet. Bytes that would
+// make the distribution uneven are discarded
+func generateUserCode() (string, error) {
+	limit := byte(256 - 256%len(userCodeAlphabet))
+	code := make([]byte, 0, userCodeLength)
+
+	for len(code) < userCodeLength {
+		random, err := utils.GenerateRandomBytes(userCodeLength)
+		if err != nil {
+			return "", err
+		}
+
+		for _, b := range random {
+			if b < limit && len(code) < userCodeLength {
+				code = append(code, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			}
+		}
+	}
+
+	return string(code), nil
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	geoIPCityDatabase = viper.GetString("geoip.city_database")
+	geoIPASNDatabase  = viper.GetString("geoip.asn_database")
+)
+
+// geoIPReloadDelay waits for the writes replacing a database file to settle before it is opened
+const geoIPReloadDelay = 2 * time.Second
+
+// GeoLocator resolves where IP addresses are located. Addresses it can not resolve give an empty location
+type GeoLocator interface {
+	Locate(ip string) models.GeoLocation
+}
+
+// GeoIPService resolves locations from local MaxMind-format (mmdb) databases, e.g. GeoLite2-City
+// and GeoLite2-ASN. Without a configured or readable database it resolves nothing
+type GeoIPService struct {
+	databases []*geoIPDatabase
+}
+
+type geoIPDatabase struct {
+	path string
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+// geoIPRecord holds the fields of the City, Country and ASN databases that are used
+type geoIPRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewGeoIPService opens the databases configured with geoip.city_database and geoip.asn_database.
+// A database that can not be opened is logged and picked up once its file is replaced
+func NewGeoIPService() *GeoIPService {
+	s := &GeoIPService{}
+
+	for _, path := range []string{geoIPCityDatabase, geoIPASNDatabase} {
+		if path == "" {
+			continue
+		}
+
+		database := &geoIPDatabase{path: path}
+		if err := database.load(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "geoip.go",
+				"function": "NewGeoIPService",
+				"message":  err,
+			}).Warnf("geolocation database %s is unavailable", path)
+		}
+		s.databases = append(s.databases, database)
+	}
+
+	return s
+}
+
+// Locate combines what the databases know about the address. The city is given in English
+// and the country as ISO 3166-1 code
+func (s *GeoIPService) Locate(ip string) models.GeoLocation {
+	var location models.GeoLocation
+
+	address := net.ParseIP(ip)
+	if address == nil {
+		return location
+	}
+
+	for _, database := range s.databases {
+		var record geoIPRecord
+		if !database.lookup(address, &record) {
+			continue
+		}
+
+		if location.City == "" {
+			location.City = record.City.Names["en"]
+		}
+		if location.Country == "" {
+			location.Country = record.Country.ISOCode
+		}
+		if location.ASN == 0 {
+			location.ASN = record.AutonomousSystemNumber
+			location.ASOrganization = record.AutonomousSystemOrganization
+		}
+	}
+
+	return location
+}
+
+// RunGeoIPReload reopens a database whenever its file is replaced, e.g. by geoipupdate, until the context
+// is cancelled. The directories of the files are watched, since updates rename a new file over the old one.
+// A file that can not be opened leaves the previous database in use
+func (s *GeoIPService) RunGeoIPReload(ctx context.Context) {
+	if len(s.databases) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "geoip.go",
+			"function": "RunGeoIPReload",
+			"message":  err,
+		}).Errorf("failed to watch geolocation databases, they will not be reloaded")
+		return
+	}
+	defer watcher.Close()
+
+	for _, database := range s.databases {
+		if err := watcher.Add(filepath.Dir(database.path)); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "geoip.go",
+				"function": "RunGeoIPReload",
+				"message":  err,
+			}).Errorf("failed to watch geolocation database %s", database.path)
+		}
+	}
+
+	pending := make(map[*geoIPDatabase]bool)
+	timer := time.NewTimer(geoIPReloadDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+
+			for _, database := range s.databases {
+				if filepath.Clean(event.Name) == filepath.Clean(database.path) {
+					pending[database] = true
+					timer.Reset(geoIPReloadDelay)
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "geoip.go",
+				"function": "RunGeoIPReload",
+				"message":  err,
+			}).Errorf("error while watching geolocation databases")
+		case <-timer.C:
+			for database := range pending {
+				if err := database.load(); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"package":  "service",
+						"file":     "geoip.go",
+						"function": "RunGeoIPReload",
+						"message":  err,
+					}).Errorf("failed to reload geolocation database %s, keeping the previous one", database.path)
+					continue
+				}
+
+				logrus.WithFields(logrus.Fields{
+					"package":  "service",
+					"file":     "geoip.go",
+					"function": "RunGeoIPReload",
+				}).Infof("geolocation database %s has been reloaded", database.path)
+			}
+			pending = make(map[*geoIPDatabase]bool)
+		}
+	}
+}
+
+// load opens the file and replaces the current reader with it
+func (d *geoIPDatabase) load() error {
+	reader, err := maxminddb.Open(d.path)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	previous := d.reader
+	d.reader = reader
+	d.mu.Unlock()
+
+	if previous != nil {
+		return previous.Close()
+	}
+
+	return nil
+}
+
+func (d *geoIPDatabase) lookup(address net.IP, record *geoIPRecord) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.reader == nil {
+		return false
+	}
+
+	return d.reader.Lookup(address, record) == nil
+}
@@ -0,0 +1,579 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"github.com/th2empty/auth_service/pkg/utils"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	signingMethod       = viper.GetString("auth.signing_method")
+	signingKey          = viper.GetString("auth.signing_key")
+	privateKeyFile      = viper.GetString("auth.private_key_file")
+	keyId               = viper.GetString("auth.key_id")
+	keyRotationInterval = viper.GetDuration("auth.keys.rotation_interval") * time.Hour
+	keyRefreshInterval  = viper.GetDuration("auth.keys.refresh_interval") * time.Minute
+)
+
+const (
+	defaultSigningMethod      = "HS256"
+	defaultKeyRefreshInterval = 5 * time.Minute
+	// minKeyReloadInterval limits how often an unknown key id triggers a reload of the key ring
+	minKeyReloadInterval = 10 * time.Second
+	keyEncryptionKeyEnv  = "KEY_ENCRYPTION_KEY"
+)
+
+// jwtKey is a key used to sign and verify tokens.
+// privateKey holds the shared secret for HMAC methods, in which case publicKey is nil
+type jwtKey struct {
+	id         string
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+	createdAt  time.Time
+}
+
+func (k *jwtKey) verificationKey() interface{} {
+	if k.publicKey == nil {
+		return k.privateKey
+	}
+
+	return k.publicKey
+}
+
+// KeyService keeps the ring of signing keys shared by all instances through Postgres.
+// The newest key that has not been retired signs new tokens, retired keys are still
+// accepted for verification until the tokens signed with them have expired
+type KeyService struct {
+	repo          repository.SigningKeys
+	encryptionKey []byte
+
+	mu         sync.RWMutex
+	keys       map[string]*jwtKey
+	current    *jwtKey
+	lastReload time.Time
+}
+
+func NewKeyService(repo repository.SigningKeys) (*KeyService, error) {
+	encryptionKey, err := base64.StdEncoding.DecodeString(os.Getenv(keyEncryptionKeyEnv))
+	if err != nil || len(encryptionKey) != 32 {
+		return nil, fmt.Errorf("%s must contain 32 base64 encoded bytes", keyEncryptionKeyEnv)
+	}
+
+	s := &KeyService{repo: repo, encryptionKey: encryptionKey}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	if s.signingKey() == nil {
+		key, err := loadConfiguredKey()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			if key, err = generateKey(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := s.rotate(key, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.signingKey() == nil {
+		return nil, fmt.Errorf("no usable signing key, make sure %s has not changed", keyEncryptionKeyEnv)
+	}
+
+	return s, nil
+}
+
+// GetJWKS returns the public keys that can be used to verify issued tokens.
+// Keys of HMAC methods are secret and therefore never published
+func (s *KeyService) GetJWKS() models.JSONWebKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jwks := models.JSONWebKeySet{Keys: []models.JSONWebKey{}}
+	for _, key := range s.keys {
+		if key.publicKey == nil {
+			continue
+		}
+
+		jwk, err := publicJWK(key.method.Alg(), key.publicKey)
+		if err != nil {
+			continue
+		}
+		jwk.KeyId = key.id
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
+
+// publishesSigningKey reports whether tokens are signed with a key whose public key is in the JWKS, so that
+// OpenID Connect clients can verify ID tokens. The shared secrets of HMAC methods can not be published
+func (s *KeyService) publishesSigningKey() bool {
+	key := s.signingKey()
+	return key != nil && key.publicKey != nil
+}
+
+// RotateKeys immediately replaces the current signing key with a newly generated one
+func (s *KeyService) RotateKeys() error {
+	key, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	return s.rotate(key, time.Now())
+}
+
+// RunKeyRotation periodically picks up keys added by other instances and rotates
+// the current key once it is older than auth.keys.rotation_interval
+func (s *KeyService) RunKeyRotation(ctx context.Context) {
+	interval := keyRefreshInterval
+	if interval <= 0 {
+		interval = defaultKeyRefreshInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.reload(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "keys.go",
+				"function": "RunKeyRotation",
+				"message":  err,
+			}).Errorf("failed to reload signing keys")
+			continue
+		}
+
+		current := s.signingKey()
+		if keyRotationInterval > 0 && time.Since(current.createdAt) >= keyRotationInterval {
+			key, err := generateKey()
+			if err == nil {
+				err = s.rotate(key, time.Now().Add(-keyRotationInterval))
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"package":  "service",
+					"file":     "keys.go",
+					"function": "RunKeyRotation",
+					"message":  err,
+				}).Errorf("failed to rotate signing key")
+			}
+		}
+
+		if err := s.repo.DeleteExpiredSigningKeys(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "keys.go",
+				"function": "RunKeyRotation",
+				"message":  err,
+			}).Errorf("failed to delete expired signing keys")
+		}
+	}
+}
+
+func (s *KeyService) signingKey() *jwtKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current
+}
+
+// keyFunc looks up the verification key of a token by its key id and makes sure that the token
+// is signed with the algorithm of that key, so that a public key is never used as an HMAC secret.
+// Tokens without a key id were issued before key rotation and are checked against the current key
+func (s *KeyService) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, hasKid := token.Header["kid"].(string)
+
+	key := s.lookupKey(kid, hasKid)
+	if key == nil && hasKid && s.canReload() {
+		if err := s.reload(); err != nil {
+			return nil, err
+		}
+		key = s.lookupKey(kid, hasKid)
+	}
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("invalid signing method")
+	}
+
+	return key.verificationKey(), nil
+}
+
+func (s *KeyService) lookupKey(kid string, hasKid bool) *jwtKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !hasKid {
+		return s.current
+	}
+
+	return s.keys[kid]
+}
+
+func (s *KeyService) canReload() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return time.Since(s.lastReload) >= minKeyReloadInterval
+}
+
+func (s *KeyService) reload() error {
+	storedKeys, err := s.repo.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*jwtKey, len(storedKeys))
+	var current *jwtKey
+	for _, storedKey := range storedKeys {
+		key, err := s.decodeKey(storedKey)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "keys.go",
+				"function": "reload",
+				"message":  err,
+			}).Errorf("failed to decode signing key %s", storedKey.Id)
+			continue
+		}
+
+		keys[key.id] = key
+		if storedKey.RetiredAt == nil && (current == nil || !key.createdAt.Before(current.createdAt)) {
+			current = key
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = keys
+	s.lastReload = time.Now()
+	if current != nil {
+		s.current = current
+	}
+
+	return nil
+}
+
+// rotate stores the key as the new current key, unless another instance has added one after notBefore
+func (s *KeyService) rotate(key *jwtKey, notBefore time.Time) error {
+	storedKey, err := s.encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	maxTokenTTL := refreshTokenTTL
+	if accessTokenTTL > maxTokenTTL {
+		maxTokenTTL = accessTokenTTL
+	}
+
+	if _, err := s.repo.RotateSigningKey(storedKey, notBefore, time.Now().Add(maxTokenTTL)); err != nil {
+		return err
+	}
+
+	return s.reload()
+}
+
+func (s *KeyService) encodeKey(key *jwtKey) (models.SigningKey, error) {
+	storedKey := models.SigningKey{Id: key.id, Algorithm: key.method.Alg()}
+
+	var privateKey []byte
+	if secret, ok := key.privateKey.([]byte); ok {
+		privateKey = secret
+	} else {
+		var err error
+		if privateKey, err = x509.MarshalPKCS8PrivateKey(key.privateKey); err != nil {
+			return storedKey, err
+		}
+		if storedKey.PublicKey, err = x509.MarshalPKIXPublicKey(key.publicKey); err != nil {
+			return storedKey, err
+		}
+	}
+
+	var err error
+	storedKey.PrivateKey, err = utils.Encrypt(s.encryptionKey, privateKey, []byte(key.id))
+
+	return storedKey, err
+}
+
+func (s *KeyService) decodeKey(storedKey models.SigningKey) (*jwtKey, error) {
+	method := jwt.GetSigningMethod(storedKey.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported signing method %q", storedKey.Algorithm)
+	}
+
+	privateKey, err := utils.Decrypt(s.encryptionKey, storedKey.PrivateKey, []byte(storedKey.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{id: storedKey.Id, method: method, createdAt: storedKey.CreatedAt}
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		key.privateKey = privateKey
+		return key, nil
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	key.privateKey = signer
+	key.publicKey = signer.Public()
+
+	return key, checkKeyType(method, key.publicKey)
+}
+
+func configuredSigningMethod() (jwt.SigningMethod, error) {
+	alg := signingMethod
+	if alg == "" {
+		alg = defaultSigningMethod
+	}
+
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported signing method %q", alg)
+	}
+
+	return method, nil
+}
+
+// loadConfiguredKey loads the key from auth.signing_key or auth.private_key_file.
+// It is only used to seed an empty key ring and returns nil if no key is configured
+func loadConfiguredKey() (*jwtKey, error) {
+	method, err := configuredSigningMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		if signingKey == "" {
+			return nil, nil
+		}
+
+		id := keyId
+		if id == "" {
+			id = "default"
+		}
+
+		return &jwtKey{id: id, method: method, privateKey: []byte(signingKey)}, nil
+	}
+
+	if privateKeyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := utils.ParsePrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkKeyType(method, privateKey.Public()); err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{id: keyId, method: method, privateKey: privateKey, publicKey: privateKey.Public()}
+	if key.id == "" {
+		if key.id, err = jwkThumbprint(method.Alg(), key.publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// generateKey creates a new random key for the configured signing method
+func generateKey() (*jwtKey, error) {
+	method, err := configuredSigningMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	var privateKey crypto.Signer
+	switch m := method.(type) {
+	case *jwt.SigningMethodHMAC:
+		secret, err := utils.GenerateRandomBytes(m.Hash.Size())
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := utils.GenerateRandomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+
+		return &jwtKey{id: base64.RawURLEncoding.EncodeToString(id), method: method, privateKey: secret}, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	case *jwt.SigningMethodECDSA:
+		var curve elliptic.Curve
+		switch m.CurveBits {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		default:
+			curve = elliptic.P521()
+		}
+		privateKey, err = ecdsa.GenerateKey(curve, rand.Reader)
+	default:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkKeyType(method, privateKey.Public()); err != nil {
+		return nil, err
+	}
+
+	id, err := jwkThumbprint(method.Alg(), privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwtKey{id: id, method: method, privateKey: privateKey, publicKey: privateKey.Public()}, nil
+}
+
+// checkKeyType makes sure that the public key can be used with the signing method
+func checkKeyType(method jwt.SigningMethod, publicKey interface{}) error {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the %s signing method requires an RSA key", method.Alg())
+		}
+		if key.N.BitLen() < 2048 {
+			return errors.New("RSA keys must be at least 2048 bits long")
+		}
+	case *jwt.SigningMethodECDSA:
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok || key.Curve.Params().BitSize != m.CurveBits {
+			return fmt.Errorf("the %s signing method requires an ECDSA key on the %d-bit curve",
+				method.Alg(), m.CurveBits)
+		}
+	default:
+		if method != utils.SigningMethodEdDSA {
+			return fmt.Errorf("unsupported signing method %q", method.Alg())
+		}
+		if _, ok := publicKey.(ed25519.PublicKey); !ok {
+			return errors.New("the EdDSA signing method requires an Ed25519 key")
+		}
+	}
+
+	return nil
+}
+
+func publicJWK(alg string, publicKey interface{}) (models.JSONWebKey, error) {
+	jwk := models.JSONWebKey{Use: "sig", Algorithm: alg}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = curveName(key.Curve)
+		jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(key.X.Bytes(), size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(key.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return jwk, errors.New("unsupported public key type")
+	}
+
+	return jwk, nil
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint of the public key, which is used as the default key id
+func jwkThumbprint(alg string, publicKey interface{}) (string, error) {
+	jwk, err := publicJWK(alg, publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	var canonical string
+	switch jwk.KeyType {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Curve, jwk.X, jwk.Y)
+	default:
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s"}`, jwk.Curve, jwk.KeyType, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func curveName(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P256():
+		return "P-256"
+	case elliptic.P384():
+		return "P-384"
+	case elliptic.P521():
+		return "P-521"
+	default:
+		return curve.Params().Name
+	}
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+
+	return padded
+}
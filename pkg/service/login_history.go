@@ -0,0 +1,81 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+)
+
+// LoginHistoryService keeps the sign-in attempts of users, so that they can check who accessed their accounts.
+// Attempts are only recorded when they can be attributed to an existing account
+type LoginHistoryService struct {
+	repo  repository.LoginEvents
+	users repository.Authorization
+	mfa   repository.MFA
+
+	locator GeoLocator
+}
+
+func NewLoginHistoryService(repo repository.LoginEvents, users repository.Authorization, mfa repository.MFA,
+	locator GeoLocator) *LoginHistoryService {
+	return &LoginHistoryService{repo: repo, users: users, mfa: mfa, locator: locator}
+}
+
+// RecordLoginEvent stores an attempt of the user given by the event
+func (s *LoginHistoryService) RecordLoginEvent(event models.LoginEvent) error {
+	return s.addLoginEvent(event)
+}
+
+// RecordPasswordFailure stores a failed password sign-in of the account with the username.
+// Attempts on usernames that are not registered are not recorded
+func (s *LoginHistoryService) RecordPasswordFailure(username string, event models.LoginEvent) error {
+	user, err := s.users.GetUser(username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	event.UserId = user.Id
+	return s.addLoginEvent(event)
+}
+
+// RecordMFAFailure stores a failed second step of the sign-in started with the challenge token.
+// Nothing is recorded once the challenge has been deleted
+func (s *LoginHistoryService) RecordMFAFailure(challengeToken string, event models.LoginEvent) error {
+	userId, err := s.mfa.GetMFAChallengeUserId(hashClientSecret(challengeToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	event.UserId = userId
+	return s.addLoginEvent(event)
+}
+
+// GetLoginHistory returns a page of the sign-in attempts of the user, newest first
+func (s *LoginHistoryService) GetLoginHistory(userId uint, page, perPage int) (models.LoginHistory, error) {
+	page, perPage = normalizePage(page, perPage)
+
+	events, total, err := s.repo.GetLoginEvents(userId, perPage, (page-1)*perPage)
+	if err != nil {
+		return models.LoginHistory{}, err
+	}
+
+	return models.LoginHistory{Events: events, Total: total, Page: page, PerPage: perPage}, nil
+}
+
+// addLoginEvent stores the event with the location of its IP address
+func (s *LoginHistoryService) addLoginEvent(event models.LoginEvent) error {
+	location := s.locator.Locate(event.IpAddress)
+	event.City = location.City
+	event.Country = location.Country
+	event.ASN = location.ASN
+	event.ASOrganization = location.ASOrganization
+
+	return s.repo.AddLoginEvent(event)
+}
@@ -0,0 +1,512 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"github.com/th2empty/auth_service/pkg/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthMethodOTP is the amr value of a sign-in confirmed with a one-time password (RFC 8176)
+	AuthMethodOTP = "otp"
+
+	MFAMethodTOTP         = "totp"
+	MFAMethodWebAuthn     = "webauthn"
+	MFAMethodRecoveryCode = "recovery_code"
+
+	defaultMFAIssuerName     = "Auth Server"
+	defaultMFAChallengeTTL   = 5 * time.Minute
+	maxMFAChallengeAttempts  = 5
+	mfaChallengeTokenLength  = 32
+	totpSkew                 = 1
+	recoveryCodeCount        = 10
+	recoveryCodeLength       = 10
+	recoveryCodeGroupLength  = 4
+	totpAdditionalDataPrefix = "totp:"
+)
+
+// mfaLockoutPolicy limits guessing codes across challenges and endpoints: after five consecutive attempts
+// the user has to wait a minute, then two, four and so on up to an hour between attempts
+var mfaLockoutPolicy = models.MFALockoutPolicy{
+	Threshold: 5,
+	BaseDelay: time.Minute,
+	MaxDelay:  time.Hour,
+	Window:    24 * time.Hour,
+}
+
+var (
+	mfaIssuerName   = viper.GetString("auth.mfa.issuer_name")
+	mfaChallengeTTL = viper.GetDuration("auth.mfa.challenge_ttl") * time.Second
+
+	ErrInvalidMFACode      = errors.New("invalid verification code")
+	ErrInvalidMFAChallenge = errors.New("the sign-in has expired, please sign in again")
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrMFALocked           = errors.New("too many verification attempts, please try again later")
+)
+
+// MFAService manages the second factors of users and the second step of the sign-in.
+// TOTP secrets are encrypted with the key encryption key, like the signing keys
+type MFAService struct {
+	repo          repository.MFA
+	credentials   repository.WebAuthn
+	events        repository.SecurityEvents
+	auth          Authorization
+	notifier      Notifier
+	encryptionKey []byte
+}
+
+func NewMFAService(repo repository.MFA, credentials repository.WebAuthn, events repository.SecurityEvents,
+	auth Authorization, keys *KeyService, notifier Notifier) *MFAService {
+	return &MFAService{repo: repo, credentials: credentials, events: events, auth: auth, notifier: notifier,
+		encryptionKey: keys.encryptionKey}
+}
+
+// BeginTOTPEnrollment generates a new TOTP secret for the user. The secret is not used for sign-in
+// until it is confirmed with ConfirmTOTPEnrollment, and starting over replaces an unconfirmed secret
+func (s *MFAService) BeginTOTPEnrollment(user models.User) (models.TOTPEnrollment, error) {
+	secret, err := utils.GenerateRandomBytes(utils.TOTPSecretLength)
+	if err != nil {
+		return models.TOTPEnrollment{}, err
+	}
+
+	encryptedSecret, err := utils.Encrypt(s.encryptionKey, secret, totpAdditionalData(user.Id))
+	if err != nil {
+		return models.TOTPEnrollment{}, err
+	}
+
+	ok, err := s.repo.SaveTOTPCredential(user.Id, encryptedSecret)
+	if err != nil {
+		return models.TOTPEnrollment{}, err
+	}
+	if !ok {
+		return models.TOTPEnrollment{}, ErrMFAAlreadyEnabled
+	}
+
+	issuerName := mfaIssuerName
+	if issuerName == "" {
+		issuerName = defaultMFAIssuerName
+	}
+
+	return models.TOTPEnrollment{
+		Secret: utils.TOTPSecretEncoding.EncodeToString(secret),
+		URI:    utils.TOTPURI(secret, issuerName, user.Username),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment enables TOTP for the user once a code of the authenticator app proves
+// that the secret has been set up correctly. It returns the first set of recovery codes
+func (s *MFAService) ConfirmTOTPEnrollment(userId uint, code string) ([]string, error) {
+	credential, err := s.getTOTPCredential(userId)
+	if err != nil {
+		return nil, err
+	}
+	if credential.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, err := s.validateTOTP(credential, code)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.repo.ConfirmTOTPCredential(userId, step)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	return s.generateRecoveryCodes(userId)
+}
+
+// DisableTOTP removes the TOTP credential of the user, which requires a valid code of the authenticator app
+// or a recovery code. The recovery codes are removed as well unless the user has another second factor
+func (s *MFAService) DisableTOTP(userId uint, code, ipAddress string) error {
+	credential, err := s.getTOTPCredential(userId)
+	if err != nil {
+		return err
+	}
+	if credential.ConfirmedAt == nil {
+		return ErrMFANotEnabled
+	}
+
+	if err := s.verifySecondFactor(userId, code, ipAddress); err != nil {
+		return err
+	}
+
+	if err := s.repo.DeleteTOTPCredential(userId); err != nil {
+		return err
+	}
+
+	return s.deleteRecoveryCodesIfUnused(userId)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user with a new set. The user has to
+// pass the second factor, so that a stolen access token can not be turned into working recovery codes,
+// and the check is subject to the same lockout as the sign-in
+func (s *MFAService) RegenerateRecoveryCodes(userId uint, code, ipAddress string) ([]string, error) {
+	enabled, err := s.IsMFAEnabled(userId)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrMFANotEnabled
+	}
+
+	if err := s.verifySecondFactor(userId, code, ipAddress); err != nil {
+		return nil, err
+	}
+
+	return s.generateRecoveryCodes(userId)
+}
+
+// GetMFAMethods returns the second factors the user can sign in with. Recovery codes are only
+// listed together with another factor
+func (s *MFAService) GetMFAMethods(userId uint) ([]string, error) {
+	var methods []string
+
+	credential, err := s.repo.GetTOTPCredential(userId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err == nil && credential.ConfirmedAt != nil {
+		methods = append(methods, MFAMethodTOTP)
+	}
+
+	webAuthnCredentials, err := s.credentials.GetWebAuthnCredentials(userId)
+	if err != nil {
+		return nil, err
+	}
+	if len(webAuthnCredentials) != 0 {
+		methods = append(methods, MFAMethodWebAuthn)
+	}
+
+	if len(methods) != 0 {
+		methods = append(methods, MFAMethodRecoveryCode)
+	}
+
+	return methods, nil
+}
+
+// IsMFAEnabled reports whether the user has to pass a second factor to sign in
+func (s *MFAService) IsMFAEnabled(userId uint) (bool, error) {
+	methods, err := s.GetMFAMethods(userId)
+	return len(methods) != 0, err
+}
+
+// CreateMFAChallenge is called after the password of the user has been verified. The returned token
+// has to be exchanged together with a valid code within a few minutes and a few attempts
+func (s *MFAService) CreateMFAChallenge(userId uint) (string, error) {
+	token, err := utils.GenerateRandomBytes(mfaChallengeTokenLength)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := mfaChallengeTTL
+	if ttl <= 0 {
+		ttl = defaultMFAChallengeTTL
+	}
+
+	encodedToken := base64.RawURLEncoding.EncodeToString(token)
+	err = s.repo.AddMFAChallenge(models.MFAChallenge{
+		TokenHash: hashClientSecret(encodedToken),
+		UserId:    userId,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+
+	return encodedToken, err
+}
+
+// VerifyMFAChallenge completes the sign-in started with CreateMFAChallenge with a code of the authenticator
+// app or a recovery code. It returns the user and the authentication methods (amr) used for the whole sign-in
+func (s *MFAService) VerifyMFAChallenge(challengeToken, code, ipAddress string) (models.User, []string, error) {
+	challenge, err := s.attemptMFAChallenge(challengeToken)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	if err := s.verifySecondFactor(challenge.UserId, code, ipAddress); err != nil {
+		return models.User{}, nil, err
+	}
+
+	return s.completeMFAChallenge(challenge, AuthMethodOTP)
+}
+
+// attemptMFAChallenge returns the challenge and counts the attempt to answer it
+func (s *MFAService) attemptMFAChallenge(challengeToken string) (models.MFAChallenge, error) {
+	challenge, err := s.repo.AttemptMFAChallenge(hashClientSecret(challengeToken), maxMFAChallengeAttempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.MFAChallenge{}, ErrInvalidMFAChallenge
+		}
+		return models.MFAChallenge{}, err
+	}
+
+	return challenge, nil
+}
+
+// completeMFAChallenge deletes the answered challenge and returns its user
+// with the authentication methods of the whole sign-in
+func (s *MFAService) completeMFAChallenge(challenge models.MFAChallenge, method string) (models.User, []string, error) {
+	if err := s.repo.DeleteMFAChallenge(challenge.TokenHash); err != nil {
+		return models.User{}, nil, err
+	}
+
+	user, err := s.auth.GetUserById(challenge.UserId)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	return user, []string{AuthMethodPassword, method}, nil
+}
+
+// verifySecondFactor accepts a code of the authenticator app or, in case the user has lost the device,
+// one of the recovery codes. Both kinds of codes are accepted only once. Every check counts against
+// the attempts of the user allowed by mfaLockoutPolicy, whether it is made to sign in or to change
+// the second factors, and ErrMFALocked is returned without checking the code while the user is locked out.
+// Rejected codes are recorded as security events
+func (s *MFAService) verifySecondFactor(userId uint, code, ipAddress string) error {
+	attempts, err := s.repo.AttemptSecondFactor(userId, mfaLockoutPolicy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFALocked
+		}
+		return err
+	}
+
+	if err := s.checkSecondFactor(userId, code, ipAddress); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			s.recordRejectedCode(userId, attempts, ipAddress)
+		}
+		return err
+	}
+
+	return s.repo.ResetSecondFactorAttempts(userId)
+}
+
+// reauthenticate checks that a change of the sign-in methods is made by the owner of the account and not only
+// by someone holding an access token: users with a second factor have to pass it, other users have to enter
+// their password. Passwords count against the same lockout as the codes
+func (s *MFAService) reauthenticate(user models.User, password, code, ipAddress string) error {
+	enabled, err := s.IsMFAEnabled(user.Id)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return s.verifySecondFactor(user.Id, code, ipAddress)
+	}
+
+	if _, err := s.repo.AttemptSecondFactor(user.Id, mfaLockoutPolicy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFALocked
+		}
+		return err
+	}
+
+	if _, err := s.auth.GetUser(user.Username, password); err != nil {
+		return err
+	}
+
+	return s.repo.ResetSecondFactorAttempts(user.Id)
+}
+
+func (s *MFAService) checkSecondFactor(userId uint, code, ipAddress string) error {
+	if len(code) != utils.TOTPDigits {
+		return s.useRecoveryCode(userId, code, ipAddress)
+	}
+
+	credential, err := s.getTOTPCredential(userId)
+	if errors.Is(err, ErrMFANotEnabled) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.useTOTP(credential, code)
+}
+
+func (s *MFAService) recordRejectedCode(userId uint, attempts int, ipAddress string) {
+	details := fmt.Sprintf("a verification code was rejected, %d failed attempts in a row", attempts)
+	if attempts >= mfaLockoutPolicy.Threshold {
+		details += ", further attempts are delayed"
+	}
+
+	if err := s.events.AddSecurityEvent(models.SecurityEvent{
+		UserId:    userId,
+		Type:      models.SecurityEventMFACodeRejected,
+		IpAddress: ipAddress,
+		Details:   details,
+	}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "mfa.go",
+			"function": "recordRejectedCode",
+			"message":  err,
+		}).Errorf("failed to record security event")
+	}
+}
+
+// deleteRecoveryCodesIfUnused deletes the recovery codes once the user has no other second factor left
+func (s *MFAService) deleteRecoveryCodesIfUnused(userId uint) error {
+	enabled, err := s.IsMFAEnabled(userId)
+	if err != nil || enabled {
+		return err
+	}
+
+	return s.repo.DeleteRecoveryCodes(userId)
+}
+
+// useRecoveryCode consumes the recovery code, records a security event and notifies the user,
+// since a recovery code is used either after losing the device or by someone who stole the codes
+func (s *MFAService) useRecoveryCode(userId uint, code, ipAddress string) error {
+	ok, err := s.repo.UseRecoveryCode(userId, hashClientSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	remaining, err := s.repo.CountRecoveryCodes(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.events.AddSecurityEvent(models.SecurityEvent{
+		UserId:    userId,
+		Type:      models.SecurityEventRecoveryCodeUsed,
+		IpAddress: ipAddress,
+		Details:   fmt.Sprintf("a recovery code was used, %d codes remain", remaining),
+	}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "mfa.go",
+			"function": "useRecoveryCode",
+			"message":  err,
+		}).Errorf("failed to record security event")
+	}
+
+	user, err := s.auth.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	notifyAsync(s.notifier, user, "A recovery code was used",
+		fmt.Sprintf("A recovery code was used from %s to verify your identity, %d unused codes remain. "+
+			"If it was not you, please change your password and generate new recovery codes.", ipAddress, remaining))
+
+	return nil
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user. Only the hashes are stored,
+// so the codes are returned to be shown to the user once
+func (s *MFAService) generateRecoveryCodes(userId uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		random, err := utils.GenerateRandomBytes(recoveryCodeLength)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(utils.TOTPSecretEncoding.EncodeToString(random))
+		codes = append(codes, formatRecoveryCode(code))
+		hashes = append(hashes, hashClientSecret(code))
+	}
+
+	if err := s.repo.ReplaceRecoveryCodes(userId, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// formatRecoveryCode splits the code into groups, e.g. abcd-efgh-ijkl-mnop
+func formatRecoveryCode(code string) string {
+	var groups []string
+	for len(code) > recoveryCodeGroupLength {
+		groups = append(groups, code[:recoveryCodeGroupLength])
+		code = code[recoveryCodeGroupLength:]
+	}
+
+	return strings.Join(append(groups, code), "-")
+}
+
+// normalizeRecoveryCode accepts recovery codes typed in upper case, with or without the separators
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+func (s *MFAService) getTOTPCredential(userId uint) (models.TOTPCredential, error) {
+	credential, err := s.repo.GetTOTPCredential(userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.TOTPCredential{}, ErrMFANotEnabled
+		}
+		return models.TOTPCredential{}, err
+	}
+
+	return credential, nil
+}
+
+// useTOTP accepts a valid code of a confirmed credential only once
+func (s *MFAService) useTOTP(credential models.TOTPCredential, code string) error {
+	if credential.ConfirmedAt == nil {
+		return ErrMFANotEnabled
+	}
+
+	step, err := s.validateTOTP(credential, code)
+	if err != nil {
+		return err
+	}
+	if step <= credential.LastUsedStep {
+		return ErrInvalidMFACode
+	}
+
+	ok, err := s.repo.UseTOTPStep(credential.UserId, step)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+func (s *MFAService) validateTOTP(credential models.TOTPCredential, code string) (int64, error) {
+	secret, err := utils.Decrypt(s.encryptionKey, credential.Secret, totpAdditionalData(credential.UserId))
+	if err != nil {
+		return 0, err
+	}
+
+	step, ok := utils.ValidateTOTP(secret, code, time.Now(), totpSkew)
+	if !ok {
+		return 0, ErrInvalidMFACode
+	}
+
+	return step, nil
+}
+
+// totpAdditionalData binds an encrypted secret to its user, so that it can not be copied to another account
+func totpAdditionalData(userId uint) []byte {
+	return []byte(totpAdditionalDataPrefix + strconv.Itoa(int(userId)))
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"github.com/th2empty/auth_service/pkg/utils"
+)
+
+// TestUseTOTP checks that every code is accepted only once: neither the same code nor a code of an earlier
+// step can be used again, also when the credential was loaded before another request used the code
+func TestUseTOTP(t *testing.T) {
+	key, err := utils.GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := utils.GenerateRandomBytes(utils.TOTPSecretLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := utils.Encrypt(key, secret, totpAdditionalData(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := utils.TOTPStep(time.Now())
+	confirmedAt := time.Now()
+
+	wrongCode := "000000"
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if utils.GenerateTOTP(secret, step) == wrongCode {
+			wrongCode = "111111"
+		}
+	}
+
+	tests := []struct {
+		name        string
+		usedStep    int64
+		loadedStep  int64
+		code        string
+		unconfirmed bool
+		want        error
+	}{
+		{name: "current step", code: utils.GenerateTOTP(secret, current)},
+		{name: "previous step", code: utils.GenerateTOTP(secret, current-1)},
+		{name: "reused code", usedStep: current, loadedStep: current, code: utils.GenerateTOTP(secret, current),
+			want: ErrInvalidMFACode},
+		{name: "code of an earlier step", usedStep: current, loadedStep: current,
+			code: utils.GenerateTOTP(secret, current-1), want: ErrInvalidMFACode},
+		{name: "code used after loading the credential", usedStep: current,
+			code: utils.GenerateTOTP(secret, current), want: ErrInvalidMFACode},
+		{name: "wrong code", code: wrongCode, want: ErrInvalidMFACode},
+		{name: "unconfirmed credential", code: utils.GenerateTOTP(secret, current), unconfirmed: true,
+			want: ErrMFANotEnabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeTOTPRepository{lastUsedStep: tt.usedStep}
+			s := &MFAService{repo: repo, encryptionKey: key}
+			credential := models.TOTPCredential{UserId: 1, Secret: encrypted, ConfirmedAt: &confirmedAt,
+				LastUsedStep: tt.loadedStep}
+			if tt.unconfirmed {
+				credential.ConfirmedAt = nil
+			}
+
+			if err := s.useTOTP(credential, tt.code); !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				if repo.lastUsedStep != tt.usedStep {
+					t.Errorf("last used step changed to %d", repo.lastUsedStep)
+				}
+				return
+			}
+
+			if err := s.useTOTP(credential, tt.code); !errors.Is(err, ErrInvalidMFACode) {
+				t.Errorf("got error %v for the second use, want %v", err, ErrInvalidMFACode)
+			}
+		})
+	}
+}
+
+// fakeTOTPRepository records the last used step like the database, other methods of the interface are not used
+type fakeTOTPRepository struct {
+	repository.MFA
+	lastUsedStep int64
+}
+
+func (r *fakeTOTPRepository) UseTOTPStep(userId uint, step int64) (bool, error) {
+	if step <= r.lastUsedStep {
+		return false, nil
+	}
+	r.lastUsedStep = step
+
+	return true, nil
+}
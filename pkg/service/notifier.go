@@ -0,0 +1,98 @@
+package service
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+var (
+	smtpHost = viper.GetString("notifications.smtp.host")
+	smtpPort = viper.GetString("notifications.smtp.port")
+	smtpUser = viper.GetString("notifications.smtp.username")
+	smtpFrom = viper.GetString("notifications.smtp.from")
+)
+
+// Notifier delivers security notifications to users
+type Notifier interface {
+	Notify(user models.User, subject, message string) error
+}
+
+// NewNotifier returns an SMTP notifier if notifications.smtp.host is configured,
+// otherwise notifications are only written to the log
+func NewNotifier() Notifier {
+	if smtpHost == "" {
+		return &logNotifier{}
+	}
+
+	port := smtpPort
+	if port == "" {
+		port = "587"
+	}
+
+	return &smtpNotifier{
+		addr:     net.JoinHostPort(smtpHost, port),
+		from:     smtpFrom,
+		auth:     smtp.PlainAuth("", smtpUser, os.Getenv("SMTP_PASSWORD"), smtpHost),
+		withAuth: smtpUser != "",
+	}
+}
+
+type logNotifier struct{}
+
+func (n *logNotifier) Notify(user models.User, subject, message string) error {
+	logrus.WithFields(logrus.Fields{
+		"package":  "service",
+		"file":     "notifier.go",
+		"function": "Notify",
+		"user_id":  user.Id,
+	}).Warnf("%s: %s", subject, message)
+
+	return nil
+}
+
+type smtpNotifier struct {
+	addr     string
+	from     string
+	auth     smtp.Auth
+	withAuth bool
+}
+
+func (n *smtpNotifier) Notify(user models.User, subject, message string) error {
+	if user.Email == "" {
+		return nil
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.from, user.Email, sanitizeHeader(subject), message)
+
+	var auth smtp.Auth
+	if n.withAuth {
+		auth = n.auth
+	}
+
+	return smtp.SendMail(n.addr, auth, n.from, []string{user.Email}, []byte(body))
+}
+
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// notifyAsync sends the notification in the background, so that slow mail servers do not delay responses
+func notifyAsync(notifier Notifier, user models.User, subject, message string) {
+	go func() {
+		if err := notifier.Notify(user, subject, message); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"package":  "service",
+				"file":     "notifier.go",
+				"function": "notifyAsync",
+				"message":  err,
+			}).Errorf("failed to notify user")
+		}
+	}()
+}
@@ -0,0 +1,541 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"github.com/th2empty/auth_service/pkg/utils"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+
+	ResponseTypeCode            = "code"
+	CodeChallengeMethodS256     = "S256"
+	GrantTypeAuthorizationCode  = "authorization_code"
+	GrantTypeClientCredentials  = "client_credentials"
+	GrantTypeRefreshToken       = "refresh_token"
+	defaultAuthorizationCodeTTL = time.Minute
+	authorizationCodeLength     = 32
+	clientSecretLength          = 32
+)
+
+var (
+	authorizationCodeTTL = viper.GetDuration("auth.authorization_code_ttl") * time.Second
+
+	ErrInvalidClient      = errors.New("client authentication failed")
+	ErrUnauthorizedClient = errors.New("the client is not authorized to use this grant or token")
+	ErrInvalidRedirectURI = errors.New("the redirect uri is not registered for this client")
+
+	// codeVerifierPattern is the format of PKCE code verifiers (RFC 7636, section 4.1)
+	codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+)
+
+// OAuthError is an error defined by the OAuth 2.0 specifications.
+// Code is one of the registered error codes, e.g. invalid_grant
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Description
+}
+
+type OAuthService struct {
+	repo  repository.Applications
+	codes repository.OAuth
+	auth  Authorization
+	keys  *KeyService
+}
+
+func NewOAuthService(repo repository.Applications, codes repository.OAuth, auth Authorization,
+	keys *KeyService) *OAuthService {
+	return &OAuthService{repo: repo, codes: codes, auth: auth, keys: keys}
+}
+
+// AuthenticateClient returns the application registered with the given client credentials.
+// Public clients have no client secret and are identified by the client id alone
+func (s *OAuthService) AuthenticateClient(clientId, clientSecret string) (models.Application, error) {
+	application, err := s.repo.GetApplicationByClientId(clientId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Application{}, ErrInvalidClient
+		}
+		return models.Application{}, err
+	}
+
+	if !application.IsConfidential() {
+		if clientSecret != "" {
+			return models.Application{}, ErrInvalidClient
+		}
+		return application, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashClientSecret(clientSecret)), []byte(*application.ClientSecretHash)) != 1 {
+		return models.Application{}, ErrInvalidClient
+	}
+
+	return application, nil
+}
+
+// GenerateClientSecret replaces the secret of the application and returns the new one.
+// Only the hash of the secret is stored, so it can not be shown again
+func (s *OAuthService) GenerateClientSecret(clientId string) (string, error) {
+	secret, err := utils.GenerateRandomBytes(clientSecretLength)
+	if err != nil {
+		return "", err
+	}
+
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	if err := s.repo.SetClientSecret(clientId, hashClientSecret(encodedSecret)); err != nil {
+		return "", err
+	}
+
+	return encodedSecret, nil
+}
+
+// IntrospectToken describes the token as defined by RFC 7662. A token is only active
+// if its signature is valid, it has not expired and its session still exists
+func (s *OAuthService) IntrospectToken(token, tokenTypeHint string) models.TokenIntrospection {
+	if tokenTypeHint == TokenTypeHintRefreshToken {
+		if introspection, ok := s.introspectRefreshToken(token); ok {
+			return introspection
+		}
+		if introspection, ok := s.introspectAccessToken(token); ok {
+			return introspection
+		}
+	} else {
+		if introspection, ok := s.introspectAccessToken(token); ok {
+			return introspection
+		}
+		if introspection, ok := s.introspectRefreshToken(token); ok {
+			return introspection
+		}
+	}
+
+	return models.TokenIntrospection{Active: false}
+}
+
+func (s *OAuthService) introspectAccessToken(token string) (models.TokenIntrospection, bool) {
+	claims, err := s.auth.ParseAccessToken(token)
+	if err != nil {
+		return models.TokenIntrospection{}, false
+	}
+
+	if !claims.IsMachineToken() {
+		session, err := s.auth.GetSessionById(claims.SessionId)
+		if err != nil || session.UserId != claims.UserId || sessionExpired(session, time.Now()) {
+			return models.TokenIntrospection{}, false
+		}
+	}
+
+	return models.TokenIntrospection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientId:  claims.ClientId,
+		Username:  claims.Username,
+		TokenType: "Bearer",
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Nbf:       claims.NotBefore,
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.Id,
+		UserId:    claims.UserId,
+		SessionId: claims.SessionId,
+		RoleId:    claims.RoleId,
+	}, true
+}
+
+func (s *OAuthService) introspectRefreshToken(token string) (models.TokenIntrospection, bool) {
+	claims, err := s.auth.ParseRefreshToken(token)
+	if err != nil {
+		return models.TokenIntrospection{}, false
+	}
+
+	session, err := s.auth.GetSessionById(claims.SessionID)
+	if err != nil || session.UserId != claims.UserId || session.RefreshUUID != claims.RefreshUUID ||
+		sessionExpired(session, time.Now()) {
+		return models.TokenIntrospection{}, false
+	}
+
+	return models.TokenIntrospection{
+		Active:    true,
+		Username:  claims.Username,
+		TokenType: TokenTypeHintRefreshToken,
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Nbf:       claims.NotBefore,
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		UserId:    claims.UserId,
+		SessionId: claims.SessionID,
+		RoleId:    claims.RoleId,
+	}, true
+}
+
+// RevokeToken revokes the session of an access or refresh token as defined by RFC 7009.
+// A revoked access token is also denied right away. Invalid, expired and already revoked tokens
+// are ignored, since the client's goal is achieved anyway
+func (s *OAuthService) RevokeToken(application models.Application, token, tokenTypeHint string) error {
+	var accessClaims *AccessTokenClaims
+	var sessionId uint
+	if tokenTypeHint == TokenTypeHintRefreshToken {
+		if sessionId = s.refreshTokenSession(token); sessionId == 0 {
+			accessClaims = s.accessTokenClaims(token)
+		}
+	} else {
+		if accessClaims = s.accessTokenClaims(token); accessClaims == nil {
+			sessionId = s.refreshTokenSession(token)
+		}
+	}
+	if accessClaims != nil && accessClaims.IsMachineToken() {
+		if accessClaims.ClientId != application.ClientId {
+			return ErrUnauthorizedClient
+		}
+		return s.auth.RevokeAccessToken(accessClaims)
+	}
+	if accessClaims != nil {
+		sessionId = accessClaims.SessionId
+	}
+	if sessionId == 0 {
+		return nil
+	}
+
+	appId, err := s.auth.GetSessionAppId(sessionId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if appId != application.Id {
+		return ErrUnauthorizedClient
+	}
+
+	if accessClaims != nil {
+		if err := s.auth.RevokeAccessToken(accessClaims); err != nil {
+			return err
+		}
+	}
+
+	return s.auth.Logout(sessionId)
+}
+
+func (s *OAuthService) accessTokenClaims(token string) *AccessTokenClaims {
+	claims, err := s.auth.ParseAccessToken(token)
+	if err != nil {
+		return nil
+	}
+	if claims.IsMachineToken() {
+		return claims
+	}
+
+	session, err := s.auth.GetSessionById(claims.SessionId)
+	if err != nil || session.UserId != claims.UserId {
+		return nil
+	}
+
+	return claims
+}
+
+func (s *OAuthService) refreshTokenSession(token string) uint {
+	claims, err := s.auth.ParseRefreshToken(token)
+	if err != nil {
+		return 0
+	}
+
+	session, err := s.auth.GetSessionById(claims.SessionID)
+	if err != nil || session.UserId != claims.UserId || session.RefreshUUID != claims.RefreshUUID {
+		return 0
+	}
+
+	return claims.SessionID
+}
+
+// GetAuthorizationClient returns the application of an authorization request. Errors returned by it
+// must be shown to the user instead of being sent to the redirect URI, which can not be trusted yet
+func (s *OAuthService) GetAuthorizationClient(clientId, redirectURI string) (models.Application, error) {
+	application, err := s.repo.GetApplicationByClientId(clientId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Application{}, ErrInvalidClient
+		}
+		return models.Application{}, err
+	}
+
+	if !application.HasRedirectURI(redirectURI) {
+		return models.Application{}, ErrInvalidRedirectURI
+	}
+	if !application.HasGrantType(GrantTypeAuthorizationCode) {
+		return models.Application{}, ErrUnauthorizedClient
+	}
+
+	return application, nil
+}
+
+// ValidateAuthorizationRequest checks the parameters of an authorization request. PKCE with
+// the S256 method is mandatory for all clients, and the scope is limited to the scopes allowed for the application.
+// The openid scope is refused while ID tokens can not be verified with the JWKS
+func (s *OAuthService) ValidateAuthorizationRequest(application models.Application,
+	request models.AuthorizationRequest) error {
+	if request.ResponseType != ResponseTypeCode {
+		return &OAuthError{"unsupported_response_type", "only the code response type is supported"}
+	}
+	if request.CodeChallenge == "" {
+		return &OAuthError{"invalid_request", "code_challenge is required"}
+	}
+	if request.CodeChallengeMethod != CodeChallengeMethodS256 {
+		return &OAuthError{"invalid_request", "code_challenge_method must be S256"}
+	}
+	if len(request.CodeChallenge) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+		return &OAuthError{"invalid_request", "code_challenge is malformed"}
+	}
+	if HasScope(request.Scope, ScopeOpenID) && !s.keys.publishesSigningKey() {
+		return &OAuthError{"invalid_scope", ErrOpenIDDisabled.Error()}
+	}
+
+	return validateScope(application, request.Scope)
+}
+
+// CreateAuthorizationCode issues a short-lived, single-use code for the user who has just signed in
+// with the given authentication methods (amr). Only the hash of the code is stored
+func (s *OAuthService) CreateAuthorizationCode(application models.Application, userId uint, amr []string,
+	request models.AuthorizationRequest) (string, error) {
+	code, err := utils.GenerateRandomBytes(authorizationCodeLength)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := authorizationCodeTTL
+	if ttl <= 0 {
+		ttl = defaultAuthorizationCodeTTL
+	}
+
+	encodedCode := base64.RawURLEncoding.EncodeToString(code)
+	err = s.codes.AddAuthorizationCode(models.AuthorizationCode{
+		CodeHash:      hashClientSecret(encodedCode),
+		AppId:         application.Id,
+		UserId:        userId,
+		RedirectURI:   request.RedirectURI,
+		CodeChallenge: request.CodeChallenge,
+		Scope:         request.Scope,
+		Nonce:         request.Nonce,
+		AuthTime:      time.Now(),
+		AMR:           amr,
+		ExpiresAt:     time.Now().Add(ttl),
+	})
+
+	return encodedCode, err
+}
+
+// ExchangeAuthorizationCode redeems the code issued to the application. The code is consumed
+// even if the exchange fails, so an intercepted code can not be tried repeatedly
+func (s *OAuthService) ExchangeAuthorizationCode(application models.Application, code, redirectURI,
+	codeVerifier string) (models.AuthorizationCode, error) {
+	if !application.HasGrantType(GrantTypeAuthorizationCode) {
+		return models.AuthorizationCode{}, &OAuthError{"unauthorized_client",
+			"the client is not allowed to use the authorization_code grant"}
+	}
+	if code == "" || redirectURI == "" || codeVerifier == "" {
+		return models.AuthorizationCode{}, &OAuthError{"invalid_request",
+			"code, redirect_uri and code_verifier are required"}
+	}
+
+	authorizationCode, err := s.codes.ConsumeAuthorizationCode(hashClientSecret(code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.AuthorizationCode{}, &OAuthError{"invalid_grant", "invalid authorization code"}
+		}
+		return models.AuthorizationCode{}, err
+	}
+
+	if authorizationCode.AppId != application.Id || !time.Now().Before(authorizationCode.ExpiresAt) {
+		return models.AuthorizationCode{}, &OAuthError{"invalid_grant", "invalid authorization code"}
+	}
+	if authorizationCode.RedirectURI != redirectURI {
+		return models.AuthorizationCode{}, &OAuthError{"invalid_grant", "redirect_uri does not match"}
+	}
+
+	if !codeVerifierPattern.MatchString(codeVerifier) {
+		return models.AuthorizationCode{}, &OAuthError{"invalid_grant", "code_verifier is malformed"}
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(authorizationCode.CodeChallenge)) != 1 {
+		return models.AuthorizationCode{}, &OAuthError{"invalid_grant", "code_verifier does not match"}
+	}
+
+	return authorizationCode, nil
+}
+
+// IssueClientCredentialsToken issues an access token to a confidential client for itself (RFC 6749, section 4.4).
+// The scope is limited to the scopes allowed for the application and defaults to all of them
+func (s *OAuthService) IssueClientCredentialsToken(application models.Application,
+	scope string) (models.TokenResponse, error) {
+	if !application.IsConfidential() {
+		return models.TokenResponse{}, &OAuthError{"unauthorized_client",
+			"the client_credentials grant is only available to confidential clients"}
+	}
+	if !application.HasGrantType(GrantTypeClientCredentials) {
+		return models.TokenResponse{}, &OAuthError{"unauthorized_client",
+			"the client is not allowed to use the client_credentials grant"}
+	}
+
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		scopes = application.AllowedScopes
+	}
+	for _, requested := range scopes {
+		if !application.HasScope(requested) {
+			return models.TokenResponse{}, &OAuthError{"invalid_scope",
+				"the scope " + requested + " is not allowed for this client"}
+		}
+	}
+	grantedScope := strings.Join(scopes, " ")
+
+	token, err := s.auth.GenerateClientToken(application, grantedScope)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	return s.NewTokenResponse([]string{token}, grantedScope), nil
+}
+
+// RefreshClientSession rotates the refresh token of a session of the application (RFC 6749, section 6). Sessions are
+// bound to the client they were started by, so refresh tokens of other clients and of first-party sign-ins are
+// rejected like invalid ones. As on the first-party refresh endpoint, reusing an already rotated refresh token
+// revokes the session. The tokens keep the scope of the session, a scope parameter can only repeat parts of it
+func (s *OAuthService) RefreshClientSession(application models.Application, refreshToken, scope,
+	ipAddress string) (models.TokenResponse, error) {
+	if refreshToken == "" {
+		return models.TokenResponse{}, &OAuthError{"invalid_request", "refresh_token is required"}
+	}
+
+	claims, err := s.auth.ParseRefreshToken(refreshToken)
+	if err != nil {
+		return models.TokenResponse{}, &OAuthError{"invalid_grant", "invalid refresh token"}
+	}
+
+	session, err := s.auth.GetSessionById(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.TokenResponse{}, &OAuthError{"invalid_grant", "invalid refresh token"}
+		}
+		return models.TokenResponse{}, err
+	}
+	if session.UserId != claims.UserId || session.ClientId == "" || session.ClientId != application.ClientId {
+		return models.TokenResponse{}, &OAuthError{"invalid_grant", "invalid refresh token"}
+	}
+	for _, requested := range strings.Fields(scope) {
+		if !HasScope(session.Scope, requested) {
+			return models.TokenResponse{}, &OAuthError{"invalid_scope",
+				"the scope " + requested + " was not granted to the session"}
+		}
+	}
+
+	session, err = s.auth.UseSession(session.SessionId)
+	if err != nil {
+		if errors.Is(err, ErrSessionExpired) || errors.Is(err, sql.ErrNoRows) {
+			return models.TokenResponse{}, &OAuthError{"invalid_grant", ErrSessionExpired.Error()}
+		}
+		return models.TokenResponse{}, err
+	}
+
+	if session.RefreshUUID != claims.RefreshUUID {
+		reused, err := s.auth.IsRefreshTokenReused(session.SessionId, claims.RefreshUUID)
+		if err != nil {
+			return models.TokenResponse{}, err
+		}
+		if reused {
+			return models.TokenResponse{}, s.revokeSessionFamily(session, ipAddress)
+		}
+		return models.TokenResponse{}, &OAuthError{"invalid_grant", "invalid refresh token"}
+	}
+
+	user, err := s.auth.GetUserById(session.UserId)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	grantedScope, err := s.auth.GrantedScope(user.Id, session.AllowedScopes, session.Scope)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	previousRefreshUUID := session.RefreshUUID
+	session.RefreshUUID = uuid.New().String()
+
+	tokens, err := s.auth.GenerateTokens(user, session)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	session.RefreshToken = tokens[1]
+	if err := s.auth.UpdateSession(session, previousRefreshUUID); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			return models.TokenResponse{}, s.revokeSessionFamily(session, ipAddress)
+		}
+		return models.TokenResponse{}, err
+	}
+
+	return s.NewTokenResponse(tokens, grantedScope), nil
+}
+
+// revokeSessionFamily revokes the session whose refresh token has been reused and returns the invalid_grant error
+// to answer the request with
+func (s *OAuthService) revokeSessionFamily(session models.Session, ipAddress string) error {
+	if err := s.auth.RevokeSessionFamily(session, ipAddress); err != nil {
+		return err
+	}
+
+	return &OAuthError{"invalid_grant", ErrRefreshTokenReused.Error()}
+}
+
+// validateScope checks that the application may request every scope of the scope. The OpenID Connect scopes
+// only select claims about the user and are always allowed
+func validateScope(application models.Application, scope string) error {
+	for _, requested := range strings.Fields(scope) {
+		if !isOpenIDScope(requested) && !application.HasScope(requested) {
+			return &OAuthError{"invalid_scope", "the scope " + requested + " is not allowed for this client"}
+		}
+	}
+
+	return nil
+}
+
+// NewTokenResponse builds the response of the token endpoint from the tokens of a session
+func (s *OAuthService) NewTokenResponse(tokens []string, scope string) models.TokenResponse {
+	response := models.TokenResponse{
+		AccessToken: tokens[0],
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(accessTokenTTL / time.Second),
+		Scope:       scope,
+	}
+	if len(tokens) > 1 {
+		response.RefreshToken = tokens[1]
+	}
+
+	return response
+}
+
+// hashClientSecret hashes client secrets and one-time codes with SHA-256. Unlike passwords they are
+// long random strings, so a slow password hash would only add latency to every request
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
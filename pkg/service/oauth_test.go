@@ -0,0 +1,256 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+)
+
+// PKCE example of RFC 7636, appendix B
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestExchangeAuthorizationCode(t *testing.T) {
+	application := models.Application{Id: 1, ClientId: "app", GrantTypes: []string{GrantTypeAuthorizationCode}}
+	redirectURI := "https://app.example.com/callback"
+
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		want      string
+	}{
+		{name: "S256", challenge: testCodeChallenge, verifier: testCodeVerifier},
+		{name: "missing verifier", challenge: testCodeChallenge, want: "invalid_request"},
+		{name: "wrong verifier", challenge: testCodeChallenge,
+			verifier: "eCkgtKfa5DWQ-nC03L38vicVKV2q2s_xX2hGXGPFkYl", want: "invalid_grant"},
+		{name: "malformed verifier", challenge: testCodeChallenge, verifier: "short", want: "invalid_grant"},
+		// a verifier sent as its own challenge, as with the plain method, does not match
+		{name: "plain", challenge: testCodeVerifier, verifier: testCodeVerifier, want: "invalid_grant"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes := &fakeAuthorizationCodes{codes: map[string]models.AuthorizationCode{
+				hashClientSecret("code"): {
+					AppId:         application.Id,
+					UserId:        1,
+					RedirectURI:   redirectURI,
+					CodeChallenge: tt.challenge,
+					ExpiresAt:     time.Now().Add(time.Minute),
+				},
+			}}
+			s := &OAuthService{codes: codes}
+
+			code, err := s.ExchangeAuthorizationCode(application, "code", redirectURI, tt.verifier)
+			if tt.want != "" {
+				var oauthErr *OAuthError
+				if !errors.As(err, &oauthErr) || oauthErr.Code != tt.want {
+					t.Fatalf("got error %v, want %s", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExchangeAuthorizationCode: %v", err)
+			}
+			if code.UserId != 1 {
+				t.Errorf("got code of user %d, want 1", code.UserId)
+			}
+
+			if _, err := s.ExchangeAuthorizationCode(application, "code", redirectURI, tt.verifier); err == nil {
+				t.Error("the authorization code has been exchanged twice")
+			}
+		})
+	}
+}
+
+// TestAuthorizationRequestRequiresS256 checks that authorization requests can not fall back to the plain method,
+// whose code challenge is the verifier itself
+func TestAuthorizationRequestRequiresS256(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		challenge string
+		want      string
+	}{
+		{"S256", CodeChallengeMethodS256, testCodeChallenge, ""},
+		{"plain", "plain", testCodeVerifier, "invalid_request"},
+		{"missing method", "", testCodeChallenge, "invalid_request"},
+		{"missing challenge", CodeChallengeMethodS256, "", "invalid_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&OAuthService{}).ValidateAuthorizationRequest(models.Application{}, models.AuthorizationRequest{
+				ResponseType:        ResponseTypeCode,
+				CodeChallenge:       tt.challenge,
+				CodeChallengeMethod: tt.method,
+			})
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("ValidateAuthorizationRequest: %v", err)
+				}
+				return
+			}
+
+			var oauthErr *OAuthError
+			if !errors.As(err, &oauthErr) || oauthErr.Code != tt.want {
+				t.Fatalf("got error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshClientSession(t *testing.T) {
+	application := models.Application{Id: 1, ClientId: "app"}
+
+	tests := []struct {
+		name    string
+		session models.Session
+		token   string
+		scope   string
+		want    string
+		revoked bool
+	}{
+		{name: "current refresh token", session: models.Session{ClientId: "app"}, token: "1:current"},
+		{name: "narrower scope", session: models.Session{ClientId: "app"}, token: "1:current", scope: "openid"},
+		{name: "session of another client", session: models.Session{ClientId: "other"}, token: "1:current",
+			want: "invalid_grant"},
+		{name: "first-party session", session: models.Session{}, token: "1:current", want: "invalid_grant"},
+		{name: "malformed refresh token", session: models.Session{ClientId: "app"}, token: "garbage",
+			want: "invalid_grant"},
+		{name: "unknown session", session: models.Session{ClientId: "app"}, token: "2:current",
+			want: "invalid_grant"},
+		{name: "scope beyond the session", session: models.Session{ClientId: "app"}, token: "1:current",
+			scope: "reports.write", want: "invalid_scope"},
+		{name: "rotated refresh token", session: models.Session{ClientId: "app"}, token: "1:rotated",
+			want: "invalid_grant", revoked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := tt.session
+			session.SessionId = 1
+			session.UserId = 1
+			session.RefreshUUID = "current"
+			session.Scope = "openid reports.read"
+			auth := &fakeAuthorization{sessions: map[uint]models.Session{1: session}}
+			s := &OAuthService{auth: auth}
+
+			response, err := s.RefreshClientSession(application, tt.token, tt.scope, "192.0.2.1")
+			if tt.want != "" {
+				var oauthErr *OAuthError
+				if !errors.As(err, &oauthErr) || oauthErr.Code != tt.want {
+					t.Fatalf("got error %v, want %s", err, tt.want)
+				}
+				if auth.revoked != tt.revoked {
+					t.Errorf("session revoked = %v, want %v", auth.revoked, tt.revoked)
+				}
+				if !tt.revoked && auth.sessions[1].RefreshUUID != "current" {
+					t.Errorf("the refresh token of the session has been rotated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RefreshClientSession: %v", err)
+			}
+
+			rotated := auth.sessions[1].RefreshUUID
+			if rotated == "current" {
+				t.Fatalf("the refresh token of the session has not been rotated")
+			}
+			if response.RefreshToken != "1:"+rotated || response.AccessToken == "" {
+				t.Errorf("got tokens %q and %q", response.AccessToken, response.RefreshToken)
+			}
+			if response.Scope != session.Scope {
+				t.Errorf("got scope %q, want %q", response.Scope, session.Scope)
+			}
+		})
+	}
+}
+
+// fakeAuthorization keeps the sessions in memory. Its refresh tokens are the session id
+// and the refresh uuid separated by a colon, other methods of the interface are not used
+type fakeAuthorization struct {
+	Authorization
+	sessions map[uint]models.Session
+	revoked  bool
+}
+
+func (s *fakeAuthorization) ParseRefreshToken(token string) (*RefreshTokenClaims, error) {
+	var sessionId uint
+	var refreshUUID string
+	if _, err := fmt.Sscanf(strings.Replace(token, ":", " ", 1), "%d %s", &sessionId, &refreshUUID); err != nil {
+		return nil, err
+	}
+
+	return &RefreshTokenClaims{UserId: 1, SessionID: sessionId, RefreshUUID: refreshUUID}, nil
+}
+
+func (s *fakeAuthorization) GetSessionById(id uint) (models.Session, error) {
+	session, ok := s.sessions[id]
+	if !ok {
+		return models.Session{}, sql.ErrNoRows
+	}
+
+	return session, nil
+}
+
+func (s *fakeAuthorization) UseSession(sessionId uint) (models.Session, error) {
+	return s.GetSessionById(sessionId)
+}
+
+func (s *fakeAuthorization) IsRefreshTokenReused(sessionId uint, refreshUUID string) (bool, error) {
+	return refreshUUID == "rotated", nil
+}
+
+func (s *fakeAuthorization) RevokeSessionFamily(session models.Session, ipAddress string) error {
+	s.revoked = true
+	delete(s.sessions, session.SessionId)
+	return nil
+}
+
+func (s *fakeAuthorization) GetUserById(id uint) (models.User, error) {
+	return models.User{Id: id, Username: "alice"}, nil
+}
+
+func (s *fakeAuthorization) GrantedScope(userId uint, allowedScopes []string, scope string) (string, error) {
+	return scope, nil
+}
+
+func (s *fakeAuthorization) GenerateTokens(user models.User, session models.Session) ([]string, error) {
+	return []string{"access", fmt.Sprintf("%d:%s", session.SessionId, session.RefreshUUID)}, nil
+}
+
+func (s *fakeAuthorization) UpdateSession(session models.Session, previousRefreshUUID string) error {
+	if s.sessions[session.SessionId].RefreshUUID != previousRefreshUUID {
+		return ErrRefreshTokenReused
+	}
+	s.sessions[session.SessionId] = session
+
+	return nil
+}
+
+// fakeAuthorizationCodes keeps the authorization codes by their hash, other methods of the interface are not used
+type fakeAuthorizationCodes struct {
+	repository.OAuth
+	codes map[string]models.AuthorizationCode
+}
+
+func (r *fakeAuthorizationCodes) ConsumeAuthorizationCode(codeHash string) (models.AuthorizationCode, error) {
+	code, ok := r.codes[codeHash]
+	if !ok {
+		return models.AuthorizationCode{}, sql.ErrNoRows
+	}
+	delete(r.codes, codeHash)
+
+	return code, nil
+}
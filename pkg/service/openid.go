@@ -0,0 +1,170 @@
+package service
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"github.com/th2empty/auth_service/pkg/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+
+	// AuthMethodPassword is the amr value of a sign-in with a password (RFC 8176)
+	AuthMethodPassword = "pwd"
+)
+
+// ErrOpenIDDisabled is returned while tokens are signed with an HMAC method, whose key is not in the JWKS
+var ErrOpenIDDisabled = errors.New("OpenID Connect requires an asymmetric signing method (RS*, PS*, ES* or EdDSA)")
+
+// IdTokenClaims are the claims of an OpenID Connect ID token. ID tokens have no jti and
+// are issued for the client, so they are never accepted as access or refresh tokens
+type IdTokenClaims struct {
+	jwt.StandardClaims
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthTime          int64    `json:"auth_time"`
+	AMR               []string `json:"amr,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Email             string   `json:"email,omitempty"`
+}
+
+// OpenIDService implements the OpenID Connect layer on top of the authorization code grant
+type OpenIDService struct {
+	auth Authorization
+	keys *KeyService
+}
+
+func NewOpenIDService(auth Authorization, keys *KeyService) *OpenIDService {
+	if !keys.publishesSigningKey() {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "openid.go",
+			"function": "NewOpenIDService",
+			"message":  ErrOpenIDDisabled,
+		}).Warnf("OpenID Connect is disabled: ID tokens signed with the shared secret could not be verified " +
+			"by clients, configure an asymmetric auth.signing_method to enable it")
+	}
+
+	return &OpenIDService{auth: auth, keys: keys}
+}
+
+// GetOpenIDConfiguration returns the provider metadata. auth.issuer must be the public base URL
+// of the server, since the endpoints are derived from it. Only the algorithms of the keys in the JWKS
+// are advertised, and ErrOpenIDDisabled is returned while the signing key is not one of them
+func (s *OpenIDService) GetOpenIDConfiguration() (models.OpenIDConfiguration, error) {
+	if !s.keys.publishesSigningKey() {
+		return models.OpenIDConfiguration{}, ErrOpenIDDisabled
+	}
+
+	baseURL := strings.TrimSuffix(issuer, "/")
+
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, key := range s.keys.GetJWKS().Keys {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+	sort.Strings(algorithms)
+
+	return models.OpenIDConfiguration{
+		Issuer:                      issuer,
+		AuthorizationEndpoint:       baseURL + "/oauth/authorize",
+		TokenEndpoint:               baseURL + "/oauth/token",
+		UserInfoEndpoint:            baseURL + "/oauth/userinfo",
+		JWKSURI:                     baseURL + "/.well-known/jwks.json",
+		IntrospectionEndpoint:       baseURL + "/oauth/introspect",
+		RevocationEndpoint:          baseURL + "/oauth/revoke",
+		DeviceAuthorizationEndpoint: baseURL + "/oauth/device_authorization",
+		ScopesSupported:             []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		ResponseTypesSupported:      []string{ResponseTypeCode},
+		GrantTypesSupported: []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials,
+			GrantTypeDeviceCode},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  algorithms,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr",
+			"preferred_username", "email"},
+		CodeChallengeMethodsSupported: []string{CodeChallengeMethodS256},
+	}, nil
+}
+
+// GenerateIdToken issues the ID token of an exchanged authorization code to the application
+func (s *OpenIDService) GenerateIdToken(user models.User, application models.Application,
+	code models.AuthorizationCode) (string, error) {
+	if !s.keys.publishesSigningKey() {
+		return "", ErrOpenIDDisabled
+	}
+
+	key := s.keys.signingKey()
+	info := userInfo(user, code.Scope)
+
+	token := jwt.NewWithClaims(key.method, &IdTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			Audience:  application.ClientId,
+			Subject:   info.Subject,
+			ExpiresAt: time.Now().Add(accessTokenTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+		Nonce:             code.Nonce,
+		AuthTime:          code.AuthTime.Unix(),
+		AMR:               code.AMR,
+		PreferredUsername: info.PreferredUsername,
+		Email:             info.Email,
+	})
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.privateKey)
+}
+
+// GetUserInfo returns the claims about the owner of the access token that its scope grants access to
+func (s *OpenIDService) GetUserInfo(claims *AccessTokenClaims) (models.UserInfo, error) {
+	user, err := s.auth.GetUserById(claims.UserId)
+	if err != nil {
+		return models.UserInfo{}, err
+	}
+
+	// the scope of first-party tokens only carries permissions
+	if claims.ClientId == "" {
+		return userInfo(user, ""), nil
+	}
+
+	return userInfo(user, claims.Scope), nil
+}
+
+// userInfo builds the standard claims of the user. First-party sign-ins pass no scope
+// and see all claims, tokens issued to OAuth clients only see the claims of the granted scopes
+func userInfo(user models.User, scope string) models.UserInfo {
+	info := models.UserInfo{Subject: strconv.Itoa(int(user.Id))}
+	if scope == "" || HasScope(scope, ScopeProfile) {
+		info.PreferredUsername = user.Username
+	}
+	if scope == "" || HasScope(scope, ScopeEmail) {
+		info.Email = user.Email
+	}
+
+	return info
+}
+
+func isOpenIDScope(scope string) bool {
+	return scope == ScopeOpenID || scope == ScopeProfile || scope == ScopeEmail
+}
+
+// HasScope reports whether the space separated scope contains the requested scope
+func HasScope(scope, requested string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == requested {
+			return true
+		}
+	}
+
+	return false
+}
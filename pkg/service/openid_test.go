@@ -0,0 +1,72 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/th2empty/auth_service/pkg/models"
+)
+
+// TestOpenIDRequiresPublishedSigningKey checks that OpenID Connect is only offered while the JWKS
+// contains the key that signs the ID tokens, since clients can not verify tokens signed with the shared secret
+func TestOpenIDRequiresPublishedSigningKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := &jwtKey{id: "hmac", method: jwt.SigningMethodHS256, privateKey: []byte("secret")}
+	esKey := &jwtKey{id: "es", method: jwt.SigningMethodES256, privateKey: ecKey, publicKey: &ecKey.PublicKey}
+
+	tests := []struct {
+		name           string
+		keys           []*jwtKey
+		wantAlgorithms []string
+	}{
+		{"HMAC signing key", []*jwtKey{hmacKey}, nil},
+		{"asymmetric signing key", []*jwtKey{esKey}, []string{"ES256"}},
+		{"asymmetric signing key after HMAC", []*jwtKey{hmacKey, esKey}, []string{"ES256"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := &KeyService{keys: map[string]*jwtKey{}}
+			for _, key := range tt.keys {
+				keys.keys[key.id] = key
+				keys.current = key
+			}
+			enabled := tt.wantAlgorithms != nil
+
+			configuration, err := NewOpenIDService(nil, keys).GetOpenIDConfiguration()
+			if enabled && err != nil {
+				t.Fatalf("GetOpenIDConfiguration: %v", err)
+			}
+			if !enabled && !errors.Is(err, ErrOpenIDDisabled) {
+				t.Fatalf("got error %v, want %v", err, ErrOpenIDDisabled)
+			}
+			if !reflect.DeepEqual(configuration.IdTokenSigningAlgValuesSupported, tt.wantAlgorithms) {
+				t.Errorf("got algorithms %v, want %v", configuration.IdTokenSigningAlgValuesSupported,
+					tt.wantAlgorithms)
+			}
+
+			err = (&OAuthService{keys: keys}).ValidateAuthorizationRequest(models.Application{},
+				models.AuthorizationRequest{
+					ResponseType:        ResponseTypeCode,
+					Scope:               ScopeOpenID,
+					CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+					CodeChallengeMethod: CodeChallengeMethodS256,
+				})
+			var oauthErr *OAuthError
+			if enabled && err != nil {
+				t.Errorf("openid scope refused: %v", err)
+			}
+			if !enabled && (!errors.As(err, &oauthErr) || oauthErr.Code != "invalid_scope") {
+				t.Errorf("got error %v, want invalid_scope", err)
+			}
+		})
+	}
+}
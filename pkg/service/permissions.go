@@ -0,0 +1,157 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"regexp"
+	"strings"
+)
+
+// Permissions of the catalogue created by the migrations. Further permissions are namespaced with colons,
+// e.g. vault:read or sessions:revoke:any
+const (
+	PermissionRead              = "read"
+	PermissionWrite             = "write"
+	PermissionAccessPrivateData = "access_private_data"
+	PermissionManageAccounts    = "manage_accounts"
+	PermissionRotateKeys        = "keys:rotate"
+
+	// PermissionWildcard as the last segment of a permission covers every permission below it
+	PermissionWildcard = "*"
+
+	defaultRoleName         = "user"
+	maxPermissionNameLength = 128
+)
+
+var defaultRole = viper.GetString("auth.default_role")
+
+var (
+	ErrUnknownPermission     = errors.New("unknown permission")
+	ErrInvalidPermissionName = errors.New("a permission name consists of segments separated by colons, " +
+		"each made of lowercase letters, digits, '_', '-' and '.' or being the * wildcard")
+
+	permissionSegmentRegexp = regexp.MustCompile(`^(\*|[a-z0-9_.-]+)$`)
+)
+
+// HasPermission reports whether the scope of the token grants the permission
+func (c *AccessTokenClaims) HasPermission(permission string) bool {
+	return grantsPermission(strings.Fields(c.Scope), permission)
+}
+
+// MatchPermission reports whether the granted permission covers the required one. A * segment matches
+// any single segment, and a trailing * also matches everything below it: vault:* covers vault:read
+// and vault:items:delete, *:read covers vault:read, and * covers every permission
+func MatchPermission(granted, required string) bool {
+	grantedSegments := strings.Split(granted, ":")
+	requiredSegments := strings.Split(required, ":")
+
+	for i, segment := range grantedSegments {
+		if i == len(requiredSegments) {
+			return false
+		}
+		if segment == PermissionWildcard {
+			if i == len(grantedSegments)-1 {
+				return true
+			}
+			continue
+		}
+		if segment != requiredSegments[i] {
+			return false
+		}
+	}
+
+	return len(grantedSegments) == len(requiredSegments)
+}
+
+func grantsPermission(granted []string, required string) bool {
+	for _, permission := range granted {
+		if MatchPermission(permission, required) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAllowedScope(allowedScopes []string, scope string) bool {
+	for _, allowed := range allowedScopes {
+		if allowed == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePermissionName checks that the name can be used as a scope and does not clash with OpenID Connect scopes
+func validatePermissionName(name string) error {
+	if name == "" || len(name) > maxPermissionNameLength || isOpenIDScope(name) {
+		return ErrInvalidPermissionName
+	}
+
+	for _, segment := range strings.Split(name, ":") {
+		if !permissionSegmentRegexp.MatchString(segment) {
+			return ErrInvalidPermissionName
+		}
+	}
+
+	return nil
+}
+
+// getDefaultRoleName returns the name of the role assigned to new users
+func getDefaultRoleName() string {
+	if defaultRole == "" {
+		return defaultRoleName
+	}
+
+	return defaultRole
+}
+
+// getDefaultRole returns the role assigned to new users
+func (s *AuthService) getDefaultRole() (models.Role, error) {
+	name := getDefaultRoleName()
+
+	role, err := s.repo.GetRoleByName(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Role{}, fmt.Errorf("the default role %q does not exist", name)
+	}
+
+	return role, err
+}
+
+// GrantedScope returns the part of the scope consented to in a session of an OAuth client that the tokens
+// of the user carry: the OpenID Connect scopes and the permissions that are allowed for the client
+// and granted by the role of the user
+func (s *AuthService) GrantedScope(userId uint, allowedScopes []string, scope string) (string, error) {
+	permissions, err := s.repo.GetUserPermissions(userId)
+	if err != nil {
+		return "", err
+	}
+
+	var granted []string
+	for _, requested := range strings.Fields(scope) {
+		if isOpenIDScope(requested) || isAllowedScope(allowedScopes, requested) && grantsPermission(permissions, requested) {
+			granted = append(granted, requested)
+		}
+	}
+
+	return strings.Join(granted, " "), nil
+}
+
+// tokenScope returns the scope of the access tokens of the session. First-party sessions get all permissions
+// of the user's role, sessions of OAuth clients only what GrantedScope leaves of the consented scope
+func (s *AuthService) tokenScope(userId uint, session models.Session) (string, error) {
+	if session.ClientId != "" {
+		return s.GrantedScope(userId, session.AllowedScopes, session.Scope)
+	}
+
+	permissions, err := s.repo.GetUserPermissions(userId)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(permissions, " "), nil
+}
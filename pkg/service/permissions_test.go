@@ -0,0 +1,44 @@
+package service
+
+import "testing"
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		granted  string
+		required string
+		want     bool
+	}{
+		{"manage_accounts", "manage_accounts", true},
+		{"vault:read", "vault:read", true},
+		{"vault:read", "vault:write", false},
+		{"vault:read", "vault", false},
+		{"vault", "vault:read", false},
+		{"manage_accounts", "manage_accounts_x", false},
+		{"manage_accounts_x", "manage_accounts", false},
+		{"manage_accounts", "manage_accounts:x", false},
+		{"*", "manage_accounts", true},
+		{"*", "vault:items:delete", true},
+		{"vault:*", "vault:read", true},
+		{"vault:*", "vault:items:delete", true},
+		{"vault:*", "vault", false},
+		{"vault:*", "vaults:read", false},
+		{"vault:items:*", "vault:items:delete", true},
+		{"vault:items:*", "vault:read", false},
+		{"*:read", "vault:read", true},
+		{"*:read", "vault:write", false},
+		{"*:read", "vault:items:read", false},
+		{"vault:*:delete", "vault:items:delete", true},
+		{"vault:*:delete", "vault:items:read", false},
+		// only colons separate segments, a * within a segment is no wildcard
+		{"vault.*", "vault.read", false},
+		{"vault.*", "vault.*", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.granted+" "+tt.required, func(t *testing.T) {
+			if got := MatchPermission(tt.granted, tt.required); got != tt.want {
+				t.Errorf("MatchPermission(%q, %q) = %v, want %v", tt.granted, tt.required, got, tt.want)
+			}
+		})
+	}
+}
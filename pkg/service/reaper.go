@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"sync"
+	"time"
+)
+
+var (
+	reaperInterval  = viper.GetDuration("reaper.interval") * time.Minute
+	reaperBatchSize = viper.GetInt("reaper.batch_size")
+)
+
+const (
+	defaultReaperInterval  = 15 * time.Minute
+	defaultReaperBatchSize = 1000
+
+	// expiredDeviceCodeRetention keeps expired device codes for a while, so that devices
+	// still polling for them get expired_token instead of invalid_grant
+	expiredDeviceCodeRetention = time.Hour
+)
+
+// reaperJob deletes a batch of at most limit expired rows and returns the number of deleted rows
+type reaperJob struct {
+	name        string
+	deleteBatch func(limit int) (int64, error)
+}
+
+// ReaperService periodically purges expired sessions, one-time codes, challenges and revoked-token records.
+// Every job runs under an advisory lock, so that only one instance works on a job at a time
+type ReaperService struct {
+	repo repository.Reaper
+	jobs []reaperJob
+
+	mu     sync.RWMutex
+	status map[string]*models.ReaperJobStatus
+}
+
+func NewReaperService(repo repository.Reaper) *ReaperService {
+	s := &ReaperService{repo: repo, status: make(map[string]*models.ReaperJobStatus)}
+
+	s.jobs = []reaperJob{
+		{name: "sessions", deleteBatch: func(limit int) (int64, error) {
+			return repo.DeleteExpiredSessions(sessionPolicy(), refreshTokenTTL, limit)
+		}},
+		{name: "authorization_codes", deleteBatch: func(limit int) (int64, error) {
+			return repo.DeleteExpiredAuthorizationCodes(time.Now(), limit)
+		}},
+		{name: "device_codes", deleteBatch: func(limit int) (int64, error) {
+			return repo.DeleteExpiredDeviceCodes(time.Now().Add(-expiredDeviceCodeRetention), limit)
+		}},
+		{name: "mfa_challenges", deleteBatch: func(limit int) (int64, error) {
+			return repo.DeleteExpiredMFAChallenges(time.Now(), limit)
+		}},
+		{name: "webauthn_challenges", deleteBatch: func(limit int) (int64, error) {
+			return repo.DeleteExpiredWebAuthnChallenges(time.Now(), limit)
+		}},
+		{name: "revoked_tokens", deleteBatch: func(limit int) (int64, error) {
+			return repo.DeleteExpiredRevokedTokens(time.Now(), limit)
+		}},
+	}
+
+	for _, job := range s.jobs {
+		s.status[job.name] = &models.ReaperJobStatus{Name: job.name}
+	}
+
+	return s
+}
+
+// RunReaper runs every job each reaper.interval minutes until the context is cancelled
+func (s *ReaperService) RunReaper(ctx context.Context) {
+	interval := reaperInterval
+	if interval <= 0 {
+		interval = defaultReaperInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, job := range s.jobs {
+			if ctx.Err() != nil {
+				return
+			}
+			s.runJob(ctx, job)
+		}
+	}
+}
+
+// GetReaperStatus returns the status of the jobs on this instance
+func (s *ReaperService) GetReaperStatus() []models.ReaperJobStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := make([]models.ReaperJobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		status = append(status, *s.status[job.name])
+	}
+
+	return status
+}
+
+// runJob deletes batches of expired rows until a batch comes back short, so that no single
+// statement locks a large part of a table
+func (s *ReaperService) runJob(ctx context.Context, job reaperJob) {
+	batchSize := reaperBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultReaperBatchSize
+	}
+
+	started := time.Now()
+	var deleted int64
+	ran, err := s.repo.RunExclusive(job.name, func() error {
+		for ctx.Err() == nil {
+			n, err := job.deleteBatch(batchSize)
+			deleted += n
+			if err != nil {
+				return err
+			}
+			if n < int64(batchSize) {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "reaper.go",
+			"function": "runJob",
+			"message":  err,
+		}).Errorf("reaper job %s failed", job.name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status[job.name]
+	if !ran && err == nil {
+		status.Skipped++
+		return
+	}
+
+	status.Runs++
+	status.LastRunAt = &started
+	status.LastDurationMs = time.Since(started).Milliseconds()
+	status.LastDeleted = deleted
+	status.TotalDeleted += deleted
+	status.LastError = ""
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+	}
+}
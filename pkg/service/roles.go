@@ -0,0 +1,281 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"strings"
+)
+
+var (
+	ErrPermissionNotFound = errors.New("permission not found")
+	ErrPermissionExists   = errors.New("a permission with this name already exists")
+	ErrRoleExists         = errors.New("a role with this name already exists")
+	ErrRoleInUse          = errors.New("the role is assigned to users")
+	ErrDefaultRole        = errors.New("the default role of new users can not be renamed or deleted")
+	ErrLastAccountManager = errors.New("at least one active user has to keep the manage_accounts permission")
+)
+
+func (s *AdminService) GetRoles() ([]models.RoleDetails, error) {
+	return s.repo.GetRoles()
+}
+
+func (s *AdminService) GetRole(roleId uint) (models.RoleDetails, error) {
+	role, err := s.repo.GetRoleDetails(roleId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.RoleDetails{}, ErrRoleNotFound
+		}
+		return models.RoleDetails{}, err
+	}
+
+	return role, nil
+}
+
+// GetRoleUsers returns a page of the users holding the role
+func (s *AdminService) GetRoleUsers(roleId uint, page, perPage int) (models.UserList, error) {
+	if _, err := s.GetRole(roleId); err != nil {
+		return models.UserList{}, err
+	}
+
+	return s.GetUsers(models.UserFilter{RoleId: roleId}, page, perPage)
+}
+
+// CreateRole creates a role granting the permissions of the catalogue with the given names and returns its id
+func (s *AdminService) CreateRole(adminId uint, name string, permissions []string, ipAddress string) (uint, error) {
+	permissions, err := s.checkPermissionsExist(permissions)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.checkRoleNameFree(name); err != nil {
+		return 0, err
+	}
+
+	return s.repo.CreateRole(name, permissions, models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionRoleCreated,
+		Details:   fmt.Sprintf("role %s created with permissions [%s]", name, strings.Join(permissions, ", ")),
+		IpAddress: ipAddress,
+	})
+}
+
+func (s *AdminService) RenameRole(adminId, roleId uint, name, ipAddress string) error {
+	role, err := s.GetRole(roleId)
+	if err != nil {
+		return err
+	}
+	if role.Name == name {
+		return nil
+	}
+	if role.Name == getDefaultRoleName() {
+		return ErrDefaultRole
+	}
+
+	if err := s.checkRoleNameFree(name); err != nil {
+		return err
+	}
+
+	ok, err := s.repo.RenameRole(roleId, name, models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionRoleRenamed,
+		Details:   fmt.Sprintf("role %s (id %d) renamed to %s", role.Name, roleId, name),
+		IpAddress: ipAddress,
+	})
+
+	return roleUpdated(ok, err)
+}
+
+// SetRolePermissions replaces the permissions granted by the role. The users holding it get the new
+// permissions with the next token refresh. Taking manage_accounts away from the last active user
+// who has it fails with ErrLastAccountManager
+func (s *AdminService) SetRolePermissions(adminId, roleId uint, permissions []string, ipAddress string) error {
+	permissions, err := s.checkPermissionsExist(permissions)
+	if err != nil {
+		return err
+	}
+
+	role, err := s.GetRole(roleId)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.repo.UpdateRolePermissions(roleId, permissions, models.AuditLogEntry{
+		AdminId: adminId,
+		Action:  models.AuditActionRolePermissionsChanged,
+		Details: fmt.Sprintf("permissions of role %s (id %d) changed from [%s] to [%s]", role.Name, roleId,
+			strings.Join(role.Permissions, ", "), strings.Join(permissions, ", ")),
+		IpAddress: ipAddress,
+	})
+
+	return roleUpdated(ok, err)
+}
+
+// DeleteRole deletes a role that is not assigned to any user
+func (s *AdminService) DeleteRole(adminId, roleId uint, ipAddress string) error {
+	role, err := s.GetRole(roleId)
+	if err != nil {
+		return err
+	}
+	if role.Name == getDefaultRoleName() {
+		return ErrDefaultRole
+	}
+	if role.UserCount != 0 {
+		return ErrRoleInUse
+	}
+
+	ok, err := s.repo.DeleteRole(roleId, models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionRoleDeleted,
+		Details:   fmt.Sprintf("role %s (id %d) deleted", role.Name, roleId),
+		IpAddress: ipAddress,
+	})
+
+	return roleUpdated(ok, err)
+}
+
+// GetPermissions returns the permission catalogue
+func (s *AdminService) GetPermissions() ([]models.Permission, error) {
+	return s.repo.GetPermissions()
+}
+
+// CreatePermission adds a permission to the catalogue, so that roles can grant it, and returns its id
+func (s *AdminService) CreatePermission(adminId uint, name, description, ipAddress string) (uint, error) {
+	if err := validatePermissionName(name); err != nil {
+		return 0, err
+	}
+
+	permissions, err := s.repo.GetPermissions()
+	if err != nil {
+		return 0, err
+	}
+	for _, permission := range permissions {
+		if permission.Name == name {
+			return 0, ErrPermissionExists
+		}
+	}
+
+	return s.repo.CreatePermission(models.Permission{Name: name, Description: description}, models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionPermissionCreated,
+		Details:   fmt.Sprintf("permission %s created", name),
+		IpAddress: ipAddress,
+	})
+}
+
+// UpdatePermission changes the description of the permission. Names can not be changed,
+// since resource servers check them
+func (s *AdminService) UpdatePermission(adminId, permissionId uint, description, ipAddress string) error {
+	permission, err := s.getPermission(permissionId)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.repo.UpdatePermissionDescription(permissionId, description, models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionPermissionUpdated,
+		Details:   fmt.Sprintf("description of permission %s changed", permission.Name),
+		IpAddress: ipAddress,
+	})
+
+	return permissionUpdated(ok, err)
+}
+
+// DeletePermission removes the permission from the catalogue and from all roles granting it.
+// Deleting a permission the last active account manager depends on fails with ErrLastAccountManager
+func (s *AdminService) DeletePermission(adminId, permissionId uint, ipAddress string) error {
+	permission, err := s.getPermission(permissionId)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.repo.DeletePermission(permissionId, models.AuditLogEntry{
+		AdminId:   adminId,
+		Action:    models.AuditActionPermissionDeleted,
+		Details:   fmt.Sprintf("permission %s deleted from the catalogue and %d roles", permission.Name, permission.RoleCount),
+		IpAddress: ipAddress,
+	})
+
+	return permissionUpdated(ok, err)
+}
+
+func (s *AdminService) getPermission(permissionId uint) (models.Permission, error) {
+	permission, err := s.repo.GetPermissionById(permissionId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Permission{}, ErrPermissionNotFound
+		}
+		return models.Permission{}, err
+	}
+
+	return permission, nil
+}
+
+// checkPermissionsExist makes sure that all names are in the catalogue and returns them without duplicates
+func (s *AdminService) checkPermissionsExist(names []string) ([]string, error) {
+	permissions, err := s.repo.GetPermissions()
+	if err != nil {
+		return nil, err
+	}
+
+	catalogue := make(map[string]bool, len(permissions))
+	for _, permission := range permissions {
+		catalogue[permission.Name] = true
+	}
+
+	unique := []string{}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !catalogue[name] {
+			return nil, fmt.Errorf("%w %q", ErrUnknownPermission, name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	return unique, nil
+}
+
+func (s *AdminService) checkRoleNameFree(name string) error {
+	_, err := s.repo.GetRoleByName(name)
+	if err == nil {
+		return ErrRoleExists
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	return err
+}
+
+// roleUpdated turns a change that did not affect any role into ErrRoleNotFound,
+// which happens when the role is deleted concurrently
+func roleUpdated(ok bool, err error) error {
+	if err == nil && !ok {
+		return ErrRoleNotFound
+	}
+
+	return accountManagerError(err)
+}
+
+// permissionUpdated turns a change that did not affect any permission into ErrPermissionNotFound
+func permissionUpdated(ok bool, err error) error {
+	if err == nil && !ok {
+		return ErrPermissionNotFound
+	}
+
+	return accountManagerError(err)
+}
+
+// accountManagerError reports a change that would leave nobody able to manage accounts as ErrLastAccountManager
+func accountManagerError(err error) error {
+	if errors.Is(err, repository.ErrNoAccountManager) {
+		return ErrLastAccountManager
+	}
+
+	return err
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"github.com/th2empty/auth_service/pkg/models"
 	"github.com/th2empty/auth_service/pkg/repository"
 )
@@ -8,24 +9,161 @@ import (
 type Authorization interface {
 	CreateUser(user models.User) (int, error)
 	GenerateTokens(user models.User, session models.Session) ([]string, error)
+	GrantedScope(userId uint, allowedScopes []string, scope string) (string, error)
+	GenerateClientToken(application models.Application, scope string) (string, error)
 	ParseAccessToken(token string) (*AccessTokenClaims, error)
+	RevokeAccessToken(claims *AccessTokenClaims) error
 	ParseRefreshToken(token string) (*RefreshTokenClaims, error)
 	GetUser(username, password string) (models.User, error)
 	GetUserById(id uint) (models.User, error)
 	GetSessions(ownerId uint) ([]models.Session, error)
 	GetSessionById(id uint) (models.Session, error)
-	AddSession(session models.Session, historyItem models.SessionHistoryItem) (uint, error)
-	UpdateSession(session models.Session) error
+	StartSession(user models.User, session models.Session, historyItem models.SessionHistoryItem) ([]string, error)
+	UpdateSession(session models.Session, previousRefreshUUID string) error
+	IsRefreshTokenReused(sessionId uint, refreshUUID string) (bool, error)
+	RevokeSessionFamily(session models.Session, ipAddress string) error
 	GetSessionsDetails(userId uint) ([]models.SessionItem, error)
+	GetSessionAppId(sessionId uint) (uint, error)
 	Logout(sessionId uint) error
+	RevokeSession(userId, sessionId uint) error
+	RevokeOtherSessions(userId, currentSessionId uint) (int, error)
+	UseSession(sessionId uint) (models.Session, error)
+}
+
+type Keys interface {
+	GetJWKS() models.JSONWebKeySet
+	RotateKeys() error
+	RunKeyRotation(ctx context.Context)
+}
+
+type OAuth interface {
+	AuthenticateClient(clientId, clientSecret string) (models.Application, error)
+	GenerateClientSecret(clientId string) (string, error)
+	IntrospectToken(token, tokenTypeHint string) models.TokenIntrospection
+	RevokeToken(application models.Application, token, tokenTypeHint string) error
+	GetAuthorizationClient(clientId, redirectURI string) (models.Application, error)
+	ValidateAuthorizationRequest(application models.Application, request models.AuthorizationRequest) error
+	CreateAuthorizationCode(application models.Application, userId uint, amr []string,
+		request models.AuthorizationRequest) (string, error)
+	ExchangeAuthorizationCode(application models.Application, code, redirectURI, codeVerifier string) (models.AuthorizationCode, error)
+	NewTokenResponse(tokens []string, scope string) models.TokenResponse
+	IssueClientCredentialsToken(application models.Application, scope string) (models.TokenResponse, error)
+	RefreshClientSession(application models.Application, refreshToken, scope, ipAddress string) (models.TokenResponse, error)
+	CreateDeviceAuthorization(application models.Application, scope string) (models.DeviceAuthorizationResponse, error)
+	GetDeviceAuthorization(userCode string) (models.DeviceCode, error)
+	CompleteDeviceAuthorization(userCode string, userId uint, approve bool) error
+	PollDeviceCode(application models.Application, deviceCode string) (models.DeviceCode, error)
+}
+
+type OpenID interface {
+	GetOpenIDConfiguration() (models.OpenIDConfiguration, error)
+	GenerateIdToken(user models.User, application models.Application, code models.AuthorizationCode) (string, error)
+	GetUserInfo(claims *AccessTokenClaims) (models.UserInfo, error)
+}
+
+type MFA interface {
+	BeginTOTPEnrollment(user models.User) (models.TOTPEnrollment, error)
+	ConfirmTOTPEnrollment(userId uint, code string) ([]string, error)
+	DisableTOTP(userId uint, code, ipAddress string) error
+	RegenerateRecoveryCodes(userId uint, code, ipAddress string) ([]string, error)
+	GetMFAMethods(userId uint) ([]string, error)
+	IsMFAEnabled(userId uint) (bool, error)
+	CreateMFAChallenge(userId uint) (string, error)
+	VerifyMFAChallenge(challengeToken, code, ipAddress string) (models.User, []string, error)
+}
+
+type WebAuthn interface {
+	BeginWebAuthnRegistration(user models.User, password, code, ipAddress string) (models.WebAuthnCeremony, error)
+	FinishWebAuthnRegistration(user models.User, challengeId, name string, response []byte) (models.WebAuthnRegistration, error)
+	GetWebAuthnCredentials(userId uint) ([]models.WebAuthnCredential, error)
+	DeleteWebAuthnCredential(userId, id uint, code, ipAddress string) error
+	BeginPasskeyLogin(username string) (models.WebAuthnCeremony, error)
+	FinishPasskeyLogin(challengeId string, response []byte) (models.User, []string, error)
+	BeginWebAuthnMFA(challengeToken string) (models.WebAuthnCeremony, error)
+	VerifyMFAChallengeWebAuthn(challengeToken, challengeId string, response []byte) (models.User, []string, error)
+}
+
+type Admin interface {
+	GetUsers(filter models.UserFilter, page, perPage int) (models.UserList, error)
+	GetUserDetails(userId uint) (models.UserAccountDetails, error)
+	SetUserRole(adminId, userId, roleId uint, ipAddress string) error
+	DisableUser(adminId, userId uint, ipAddress string) error
+	EnableUser(adminId, userId uint, ipAddress string) error
+	LogoutUser(adminId, userId uint, ipAddress string) error
+	DeleteUser(adminId, userId uint, ipAddress string) error
+	GetAuditLog(targetUserId uint, page, perPage int) (models.AuditLog, error)
+	GetRoles() ([]models.RoleDetails, error)
+	GetRole(roleId uint) (models.RoleDetails, error)
+	GetRoleUsers(roleId uint, page, perPage int) (models.UserList, error)
+	CreateRole(adminId uint, name string, permissions []string, ipAddress string) (uint, error)
+	RenameRole(adminId, roleId uint, name, ipAddress string) error
+	SetRolePermissions(adminId, roleId uint, permissions []string, ipAddress string) error
+	DeleteRole(adminId, roleId uint, ipAddress string) error
+	GetPermissions() ([]models.Permission, error)
+	CreatePermission(adminId uint, name, description, ipAddress string) (uint, error)
+	UpdatePermission(adminId, permissionId uint, description, ipAddress string) error
+	DeletePermission(adminId, permissionId uint, ipAddress string) error
+	RotateSigningKeys(adminId uint, ipAddress string) (string, error)
+}
+
+type Denylist interface {
+	RunDenylistSync(ctx context.Context)
+	RunDenylistCleanup(ctx context.Context)
+}
+
+type Reaper interface {
+	RunReaper(ctx context.Context)
+	GetReaperStatus() []models.ReaperJobStatus
+}
+
+type LoginHistory interface {
+	RecordLoginEvent(event models.LoginEvent) error
+	RecordPasswordFailure(username string, event models.LoginEvent) error
+	RecordMFAFailure(challengeToken string, event models.LoginEvent) error
+	GetLoginHistory(userId uint, page, perPage int) (models.LoginHistory, error)
+}
+
+type GeoIP interface {
+	RunGeoIPReload(ctx context.Context)
 }
 
 type Service struct {
 	Authorization
+	Keys
+	OAuth
+	OpenID
+	MFA
+	WebAuthn
+	Admin
+	Denylist
+	Reaper
+	LoginHistory
+	GeoIP
 }
 
-func NewService(repos *repository.Repository) *Service {
-	return &Service{
-		Authorization: NewAuthService(repos.Authorization),
+func NewService(repos *repository.Repository) (*Service, error) {
+	keys, err := NewKeyService(repos.SigningKeys)
+	if err != nil {
+		return nil, err
 	}
+
+	denylist := NewDenylistService(repos.Denylist)
+	notifier := NewNotifier()
+	geoIP := NewGeoIPService()
+	auth := NewAuthService(repos.Authorization, repos.SecurityEvents, keys, denylist, notifier, geoIP)
+	mfa := NewMFAService(repos.MFA, repos.WebAuthn, repos.SecurityEvents, auth, keys, notifier)
+
+	return &Service{
+		Authorization: auth,
+		Keys:          keys,
+		OAuth:         NewOAuthService(repos.Applications, repos.OAuth, auth, keys),
+		OpenID:        NewOpenIDService(auth, keys),
+		MFA:           mfa,
+		WebAuthn:      NewWebAuthnService(repos.WebAuthn, repos.Authorization, mfa),
+		Admin:         NewAdminService(repos.Admin, auth, mfa, keys),
+		Denylist:      denylist,
+		Reaper:        NewReaperService(repos.Reaper),
+		LoginHistory:  NewLoginHistoryService(repos.LoginEvents, repos.Authorization, repos.MFA, geoIP),
+		GeoIP:         geoIP,
+	}, nil
 }
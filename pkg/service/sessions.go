@@ -0,0 +1,98 @@
+package service
+
+import (
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"time"
+)
+
+var (
+	sessionIdleTimeout    = viper.GetDuration("auth.session.idle_timeout") * time.Hour
+	sessionMaxLifetime    = viper.GetDuration("auth.session.max_lifetime") * time.Hour
+	rememberMeIdleTimeout = viper.GetDuration("auth.session.remember_me_idle_timeout") * time.Hour
+	rememberMeMaxLifetime = viper.GetDuration("auth.session.remember_me_max_lifetime") * time.Hour
+
+	ErrSessionExpired = errors.New("the session has expired, sign in again")
+)
+
+// UseSession returns the session a request is made in and records its use. A session that has been idle
+// for longer than its idle timeout or has outlived its absolute lifetime is deleted and ErrSessionExpired returned
+func (s *AuthService) UseSession(sessionId uint) (models.Session, error) {
+	session, err := s.repo.GetSessionById(sessionId)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	if sessionExpired(session, time.Now()) {
+		if err := s.repo.Logout(sessionId); err != nil {
+			return models.Session{}, err
+		}
+		return models.Session{}, ErrSessionExpired
+	}
+
+	if err := s.repo.TouchSession(sessionId); err != nil {
+		return models.Session{}, err
+	}
+
+	return session, nil
+}
+
+// sessionPolicy returns the configured session lifetimes. The remember-me lifetimes fall back to the regular ones
+// where they are not configured
+func sessionPolicy() models.SessionPolicy {
+	policy := models.SessionPolicy{
+		IdleTimeout:           sessionIdleTimeout,
+		MaxLifetime:           sessionMaxLifetime,
+		RememberMeIdleTimeout: rememberMeIdleTimeout,
+		RememberMeMaxLifetime: rememberMeMaxLifetime,
+	}
+
+	if policy.RememberMeIdleTimeout == 0 {
+		policy.RememberMeIdleTimeout = policy.IdleTimeout
+	}
+	if policy.RememberMeMaxLifetime == 0 {
+		policy.RememberMeMaxLifetime = policy.MaxLifetime
+	}
+
+	return policy
+}
+
+// sessionLimits returns the idle timeout and the absolute lifetime of the session, 0 meaning no limit.
+// Remember-me sessions use the remember-me lifetimes, and the overrides of the application of the session
+// take precedence over the configured policy
+func sessionLimits(session models.Session) (time.Duration, time.Duration) {
+	policy := sessionPolicy()
+	idleTimeout, maxLifetime := policy.IdleTimeout, policy.MaxLifetime
+	appIdleTimeout, appMaxLifetime := session.Lifetime.IdleTimeout, session.Lifetime.MaxLifetime
+
+	if session.RememberMe {
+		idleTimeout, maxLifetime = policy.RememberMeIdleTimeout, policy.RememberMeMaxLifetime
+		if session.Lifetime.RememberMeIdleTimeout != nil {
+			appIdleTimeout = session.Lifetime.RememberMeIdleTimeout
+		}
+		if session.Lifetime.RememberMeMaxLifetime != nil {
+			appMaxLifetime = session.Lifetime.RememberMeMaxLifetime
+		}
+	}
+
+	if appIdleTimeout != nil {
+		idleTimeout = time.Duration(*appIdleTimeout) * time.Second
+	}
+	if appMaxLifetime != nil {
+		maxLifetime = time.Duration(*appMaxLifetime) * time.Second
+	}
+
+	return idleTimeout, maxLifetime
+}
+
+// sessionExpired reports whether the session has been idle for too long or has outlived its absolute lifetime
+func sessionExpired(session models.Session, now time.Time) bool {
+	idleTimeout, maxLifetime := sessionLimits(session)
+
+	if idleTimeout > 0 && now.Sub(session.LastUsedAt) > idleTimeout {
+		return true
+	}
+
+	return maxLifetime > 0 && now.Sub(session.CreatedAt) > maxLifetime
+}
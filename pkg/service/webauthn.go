@@ -0,0 +1,603 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"github.com/th2empty/auth_service/pkg/utils"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthMethodHardwareKey is the amr value of a sign-in confirmed with a security key or passkey (RFC 8176)
+	AuthMethodHardwareKey = "hwk"
+	// AuthMethodUserPresence and AuthMethodMultiFactor describe a passwordless sign-in with a passkey
+	// that verified the user with a PIN or biometrics
+	AuthMethodUserPresence = "user"
+	AuthMethodMultiFactor  = "mfa"
+
+	webAuthnChallengeTTL          = 5 * time.Minute
+	webAuthnChallengeIdLength     = 32
+	maxWebAuthnCredentialName     = 64
+	defaultWebAuthnCredentialName = "Security key"
+)
+
+var (
+	webAuthnRPID          = viper.GetString("auth.webauthn.rp_id")
+	webAuthnRPOrigin      = viper.GetString("auth.webauthn.rp_origin")
+	webAuthnRPDisplayName = viper.GetString("auth.webauthn.rp_display_name")
+
+	ErrWebAuthnDisabled           = errors.New("webauthn is not configured")
+	ErrInvalidWebAuthnChallenge   = errors.New("the request has expired, please try again")
+	ErrInvalidWebAuthnResponse    = errors.New("the security key could not be verified")
+	ErrWebAuthnCredentialNotFound = errors.New("security key not found")
+	ErrPasskeyUnavailable         = errors.New("no passkey is registered for this account")
+)
+
+// WebAuthnService runs the WebAuthn ceremonies. Security keys and passkeys are used as a second factor
+// after the password, and credentials that verify the user (PIN or biometrics) also sign in without a password.
+// The state of a ceremony is kept in the database between its two requests, so any instance can finish it
+type WebAuthnService struct {
+	repo     repository.WebAuthn
+	users    repository.Authorization
+	mfa      *MFAService
+	webAuthn *webauthn.WebAuthn
+}
+
+func NewWebAuthnService(repo repository.WebAuthn, users repository.Authorization, mfa *MFAService) *WebAuthnService {
+	service := &WebAuthnService{repo: repo, users: users, mfa: mfa}
+
+	config, err := webAuthnConfig()
+	if err == nil {
+		service.webAuthn, err = webauthn.New(config)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"package":  "service",
+			"file":     "webauthn.go",
+			"function": "NewWebAuthnService",
+			"message":  err,
+		}).Warnf("webauthn is disabled")
+	}
+
+	return service
+}
+
+// webAuthnConfig returns the relying party settings. By default the relying party is the host of auth.issuer,
+// which works as long as the pages calling the WebAuthn API are served from the same host
+func webAuthnConfig() (*webauthn.Config, error) {
+	config := &webauthn.Config{
+		RPID:          webAuthnRPID,
+		RPOrigin:      webAuthnRPOrigin,
+		RPDisplayName: webAuthnRPDisplayName,
+	}
+
+	if config.RPID == "" || config.RPOrigin == "" {
+		issuerURL, err := url.Parse(issuer)
+		if err != nil {
+			return nil, err
+		}
+		if issuerURL.Hostname() == "" {
+			return nil, errors.New("auth.webauthn.rp_id is not set and auth.issuer is not a URL")
+		}
+
+		if config.RPID == "" {
+			config.RPID = issuerURL.Hostname()
+		}
+		if config.RPOrigin == "" {
+			config.RPOrigin = issuerURL.Scheme + "://" + issuerURL.Host
+		}
+	}
+
+	if config.RPDisplayName == "" {
+		config.RPDisplayName = mfaIssuerName
+	}
+	if config.RPDisplayName == "" {
+		config.RPDisplayName = defaultMFAIssuerName
+	}
+
+	return config, nil
+}
+
+// BeginWebAuthnRegistration starts the registration of a new security key or passkey. The user has to pass
+// the second factor, or enter the password if there is none yet, so that a stolen access token can not be used
+// to add a key of the attacker. Credentials the user has already registered are excluded, so an authenticator
+// is not registered twice
+func (s *WebAuthnService) BeginWebAuthnRegistration(user models.User, password, code,
+	ipAddress string) (models.WebAuthnCeremony, error) {
+	if s.webAuthn == nil {
+		return models.WebAuthnCeremony{}, ErrWebAuthnDisabled
+	}
+
+	if err := s.mfa.reauthenticate(user, password, code, ipAddress); err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	webAuthnUser, err := s.getWebAuthnUser(user)
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(webAuthnUser.credentials))
+	for _, credential := range webAuthnUser.credentials {
+		exclusions = append(exclusions, credentialDescriptor(credential))
+	}
+
+	options, session, err := s.webAuthn.BeginRegistration(webAuthnUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyUnrequired(),
+			UserVerification:   protocol.VerificationPreferred,
+		}))
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	return s.saveCeremony(user.Id, models.WebAuthnCeremonyRegistration, session, options)
+}
+
+// FinishWebAuthnRegistration verifies the attestation of the new credential and stores its public key.
+// If the credential is the first second factor of the user, the first set of recovery codes is returned
+func (s *WebAuthnService) FinishWebAuthnRegistration(user models.User, challengeId, name string,
+	response []byte) (models.WebAuthnRegistration, error) {
+	if s.webAuthn == nil {
+		return models.WebAuthnRegistration{}, ErrWebAuthnDisabled
+	}
+
+	session, err := s.consumeCeremony(challengeId, models.WebAuthnCeremonyRegistration)
+	if err != nil {
+		return models.WebAuthnRegistration{}, err
+	}
+	if session.userId != user.Id {
+		return models.WebAuthnRegistration{}, ErrInvalidWebAuthnChallenge
+	}
+
+	parsedResponse, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return models.WebAuthnRegistration{}, ErrInvalidWebAuthnResponse
+	}
+
+	webAuthnUser, err := s.getWebAuthnUser(user)
+	if err != nil {
+		return models.WebAuthnRegistration{}, err
+	}
+
+	credential, err := s.webAuthn.CreateCredential(webAuthnUser, session.data, parsedResponse)
+	if err != nil {
+		logWebAuthnError("FinishWebAuthnRegistration", err)
+		return models.WebAuthnRegistration{}, ErrInvalidWebAuthnResponse
+	}
+
+	mfaEnabled, err := s.mfa.IsMFAEnabled(user.Id)
+	if err != nil {
+		return models.WebAuthnRegistration{}, err
+	}
+
+	if runes := []rune(strings.TrimSpace(name)); len(runes) > maxWebAuthnCredentialName {
+		name = string(runes[:maxWebAuthnCredentialName])
+	} else {
+		name = string(runes)
+	}
+	if name == "" {
+		name = defaultWebAuthnCredentialName
+	}
+
+	registered := models.WebAuthnCredential{
+		UserId:          user.Id,
+		CredentialId:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       int64(credential.Authenticator.SignCount),
+		Transports:      parseTransports(response),
+		Name:            name,
+		CreatedAt:       time.Now(),
+	}
+
+	registered.Id, err = s.repo.AddWebAuthnCredential(registered)
+	if err != nil {
+		return models.WebAuthnRegistration{}, err
+	}
+
+	registration := models.WebAuthnRegistration{Credential: registered}
+	if !mfaEnabled {
+		registration.RecoveryCodes, err = s.mfa.generateRecoveryCodes(user.Id)
+		if err != nil {
+			return models.WebAuthnRegistration{}, err
+		}
+	}
+
+	return registration, nil
+}
+
+func (s *WebAuthnService) GetWebAuthnCredentials(userId uint) ([]models.WebAuthnCredential, error) {
+	credentials, err := s.repo.GetWebAuthnCredentials(userId)
+	if credentials == nil {
+		credentials = []models.WebAuthnCredential{}
+	}
+
+	return credentials, err
+}
+
+// DeleteWebAuthnCredential removes a security key of the user, which requires a valid code of the
+// authenticator app or a recovery code, like DisableTOTP. The recovery codes are removed as well
+// when it was the last second factor of the user
+func (s *WebAuthnService) DeleteWebAuthnCredential(userId, id uint, code, ipAddress string) error {
+	credentials, err := s.repo.GetWebAuthnCredentials(userId)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, credential := range credentials {
+		if credential.Id == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrWebAuthnCredentialNotFound
+	}
+
+	if err := s.mfa.verifySecondFactor(userId, code, ipAddress); err != nil {
+		return err
+	}
+
+	ok, err := s.repo.DeleteWebAuthnCredential(userId, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrWebAuthnCredentialNotFound
+	}
+
+	return s.mfa.deleteRecoveryCodesIfUnused(userId)
+}
+
+// BeginPasskeyLogin starts a passwordless sign-in. With a username only the passkeys of that user are
+// offered, without one the browser lets the user pick any passkey stored for this site (discoverable credential)
+func (s *WebAuthnService) BeginPasskeyLogin(username string) (models.WebAuthnCeremony, error) {
+	if s.webAuthn == nil {
+		return models.WebAuthnCeremony{}, ErrWebAuthnDisabled
+	}
+
+	if username == "" {
+		challenge, err := protocol.CreateChallenge()
+		if err != nil {
+			return models.WebAuthnCeremony{}, err
+		}
+
+		options := protocol.CredentialAssertion{Response: protocol.PublicKeyCredentialRequestOptions{
+			Challenge:        challenge,
+			Timeout:          s.webAuthn.Config.Timeout,
+			RelyingPartyID:   s.webAuthn.Config.RPID,
+			UserVerification: protocol.VerificationRequired,
+		}}
+		session := &webauthn.SessionData{
+			Challenge:        base64.RawURLEncoding.EncodeToString(challenge),
+			UserVerification: protocol.VerificationRequired,
+		}
+
+		return s.saveCeremony(0, models.WebAuthnCeremonyLogin, session, options)
+	}
+
+	user, err := s.users.GetUser(username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.WebAuthnCeremony{}, ErrPasskeyUnavailable
+		}
+		return models.WebAuthnCeremony{}, err
+	}
+
+	return s.beginLogin(user, protocol.VerificationRequired)
+}
+
+// FinishPasskeyLogin verifies the assertion of a passwordless sign-in and returns the user with the
+// authentication methods (amr) of the sign-in. The passkey counts as both factors, since it is possessed
+// by the user and unlocked with a PIN or biometrics
+func (s *WebAuthnService) FinishPasskeyLogin(challengeId string, response []byte) (models.User, []string, error) {
+	if s.webAuthn == nil {
+		return models.User{}, nil, ErrWebAuthnDisabled
+	}
+
+	session, err := s.consumeCeremony(challengeId, models.WebAuthnCeremonyLogin)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return models.User{}, nil, ErrInvalidWebAuthnResponse
+	}
+
+	userId := session.userId
+	if userId == 0 {
+		credential, err := s.repo.GetWebAuthnCredentialByCredentialId(parsedResponse.RawID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return models.User{}, nil, ErrInvalidWebAuthnResponse
+			}
+			return models.User{}, nil, err
+		}
+
+		userId = credential.UserId
+		session.data.UserID = webAuthnUserHandle(userId)
+	}
+
+	user, err := s.users.GetUserById(userId)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	if err := s.finishLogin(user, session.data, parsedResponse); err != nil {
+		return models.User{}, nil, err
+	}
+
+	return user, []string{AuthMethodHardwareKey, AuthMethodUserPresence, AuthMethodMultiFactor}, nil
+}
+
+// BeginWebAuthnMFA starts the second step of a sign-in with a security key instead of a code.
+// Starting the ceremony counts as an attempt of the challenge, so it can not be started indefinitely
+func (s *WebAuthnService) BeginWebAuthnMFA(challengeToken string) (models.WebAuthnCeremony, error) {
+	if s.webAuthn == nil {
+		return models.WebAuthnCeremony{}, ErrWebAuthnDisabled
+	}
+
+	challenge, err := s.mfa.attemptMFAChallenge(challengeToken)
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	user, err := s.users.GetUserById(challenge.UserId)
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	return s.beginLogin(user, protocol.VerificationDiscouraged)
+}
+
+// VerifyMFAChallengeWebAuthn completes the sign-in started with CreateMFAChallenge with a security key.
+// It returns the user and the authentication methods (amr) used for the whole sign-in
+func (s *WebAuthnService) VerifyMFAChallengeWebAuthn(challengeToken, challengeId string,
+	response []byte) (models.User, []string, error) {
+	if s.webAuthn == nil {
+		return models.User{}, nil, ErrWebAuthnDisabled
+	}
+
+	challenge, err := s.mfa.attemptMFAChallenge(challengeToken)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	session, err := s.consumeCeremony(challengeId, models.WebAuthnCeremonyLogin)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+	if session.userId != challenge.UserId {
+		return models.User{}, nil, ErrInvalidWebAuthnChallenge
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return models.User{}, nil, ErrInvalidWebAuthnResponse
+	}
+
+	user, err := s.users.GetUserById(challenge.UserId)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	if err := s.finishLogin(user, session.data, parsedResponse); err != nil {
+		return models.User{}, nil, err
+	}
+
+	return s.mfa.completeMFAChallenge(challenge, AuthMethodHardwareKey)
+}
+
+func (s *WebAuthnService) beginLogin(user models.User,
+	userVerification protocol.UserVerificationRequirement) (models.WebAuthnCeremony, error) {
+	webAuthnUser, err := s.getWebAuthnUser(user)
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+	if len(webAuthnUser.credentials) == 0 {
+		return models.WebAuthnCeremony{}, ErrPasskeyUnavailable
+	}
+
+	allowedCredentials := make([]protocol.CredentialDescriptor, 0, len(webAuthnUser.credentials))
+	for _, credential := range webAuthnUser.credentials {
+		allowedCredentials = append(allowedCredentials, credentialDescriptor(credential))
+	}
+
+	options, session, err := s.webAuthn.BeginLogin(webAuthnUser,
+		webauthn.WithAllowedCredentials(allowedCredentials),
+		webauthn.WithUserVerification(userVerification))
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	return s.saveCeremony(user.Id, models.WebAuthnCeremonyLogin, session, options)
+}
+
+// finishLogin verifies the assertion and stores the new signature counter. A counter that did not increase
+// means that the credential has been cloned, so the sign-in is rejected
+func (s *WebAuthnService) finishLogin(user models.User, session webauthn.SessionData,
+	parsedResponse *protocol.ParsedCredentialAssertionData) error {
+	webAuthnUser, err := s.getWebAuthnUser(user)
+	if err != nil {
+		return err
+	}
+
+	credential, err := s.webAuthn.ValidateLogin(webAuthnUser, session, parsedResponse)
+	if err != nil {
+		logWebAuthnError("finishLogin", err)
+		return ErrInvalidWebAuthnResponse
+	}
+	if credential.Authenticator.CloneWarning {
+		return ErrInvalidWebAuthnResponse
+	}
+
+	for _, stored := range webAuthnUser.credentials {
+		if bytes.Equal(stored.CredentialId, credential.ID) {
+			return s.repo.UpdateWebAuthnCredentialUse(stored.Id, int64(credential.Authenticator.SignCount))
+		}
+	}
+
+	return ErrWebAuthnCredentialNotFound
+}
+
+type webAuthnSession struct {
+	userId uint
+	data   webauthn.SessionData
+}
+
+// saveCeremony stores the session data of the ceremony and returns the options for the browser
+func (s *WebAuthnService) saveCeremony(userId uint, ceremony string, session *webauthn.SessionData,
+	options interface{}) (models.WebAuthnCeremony, error) {
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	id, err := utils.GenerateRandomBytes(webAuthnChallengeIdLength)
+	if err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	challengeId := base64.RawURLEncoding.EncodeToString(id)
+	if err := s.repo.AddWebAuthnChallenge(models.WebAuthnChallenge{
+		Id:          challengeId,
+		UserId:      userId,
+		Ceremony:    ceremony,
+		SessionData: sessionData,
+		ExpiresAt:   time.Now().Add(webAuthnChallengeTTL),
+	}); err != nil {
+		return models.WebAuthnCeremony{}, err
+	}
+
+	return models.WebAuthnCeremony{ChallengeId: challengeId, Options: options}, nil
+}
+
+func (s *WebAuthnService) consumeCeremony(challengeId, ceremony string) (webAuthnSession, error) {
+	challenge, err := s.repo.ConsumeWebAuthnChallenge(challengeId, ceremony)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return webAuthnSession{}, ErrInvalidWebAuthnChallenge
+		}
+		return webAuthnSession{}, err
+	}
+
+	session := webAuthnSession{userId: challenge.UserId}
+	if err := json.Unmarshal(challenge.SessionData, &session.data); err != nil {
+		return webAuthnSession{}, err
+	}
+
+	return session, nil
+}
+
+func (s *WebAuthnService) getWebAuthnUser(user models.User) (*webAuthnUser, error) {
+	credentials, err := s.repo.GetWebAuthnCredentials(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// webAuthnUser adapts a user and their credentials to the webauthn library
+type webAuthnUser struct {
+	user        models.User
+	credentials []models.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.user.Id)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, credential := range u.credentials {
+		credentials = append(credentials, webauthn.Credential{
+			ID:              credential.CredentialId,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: uint32(credential.SignCount),
+			},
+		})
+	}
+
+	return credentials
+}
+
+// webAuthnUserHandle is the user handle stored by authenticators. It identifies the user
+// of a discoverable credential and must not contain personal information like the username
+func webAuthnUserHandle(userId uint) []byte {
+	return []byte(strconv.Itoa(int(userId)))
+}
+
+func credentialDescriptor(credential models.WebAuthnCredential) protocol.CredentialDescriptor {
+	transports := make([]protocol.AuthenticatorTransport, 0, len(credential.Transports))
+	for _, transport := range credential.Transports {
+		transports = append(transports, protocol.AuthenticatorTransport(transport))
+	}
+
+	return protocol.CredentialDescriptor{
+		Type:         protocol.PublicKeyCredentialType,
+		CredentialID: credential.CredentialId,
+		Transport:    transports,
+	}
+}
+
+// parseTransports returns the transports reported by the browser (response.getTransports()),
+// which help browsers to offer the right authenticator at sign-in. The webauthn library ignores them
+func parseTransports(response []byte) []string {
+	var credential struct {
+		Response struct {
+			Transports []string `json:"transports"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(response, &credential); err != nil || credential.Response.Transports == nil {
+		return []string{}
+	}
+
+	return credential.Response.Transports
+}
+
+func logWebAuthnError(function string, err error) {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) {
+		err = errors.New(protocolErr.Details)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"package":  "service",
+		"file":     "webauthn.go",
+		"function": function,
+		"message":  err,
+	}).Warnf("webauthn verification failed")
+}
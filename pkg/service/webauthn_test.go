@@ -0,0 +1,869 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/th2empty/auth_service/pkg/models"
+	"github.com/th2empty/auth_service/pkg/repository"
+	"github.com/th2empty/auth_service/pkg/utils"
+)
+
+const (
+	testRPID     = "auth.example.com"
+	testOrigin   = "https://auth.example.com"
+	testPassword = "correct horse battery staple"
+)
+
+func TestWebAuthnRegistrationAndPasskeyLogin(t *testing.T) {
+	s, repo := newTestWebAuthnService(t)
+	authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+	user := registerSoftwareAuthenticator(t, s, authenticator, 1)
+
+	credentials, _ := repo.GetWebAuthnCredentials(user.Id)
+	if len(credentials) != 1 {
+		t.Fatalf("got %d credentials, want 1", len(credentials))
+	}
+	if !bytes.Equal(credentials[0].CredentialId, authenticator.credentialId) {
+		t.Errorf("stored credential id does not match the authenticator")
+	}
+	if len(credentials[0].Transports) != 1 || credentials[0].Transports[0] != "internal" {
+		t.Errorf("got transports %v, want [internal]", credentials[0].Transports)
+	}
+
+	ceremony, err := s.BeginPasskeyLogin(user.Username)
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+
+	signedIn, amr, err := s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false))
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin: %v", err)
+	}
+	if signedIn.Id != user.Id {
+		t.Errorf("signed in user %d, want %d", signedIn.Id, user.Id)
+	}
+	if len(amr) != 3 || amr[0] != AuthMethodHardwareKey {
+		t.Errorf("got amr %v", amr)
+	}
+
+	credentials, _ = repo.GetWebAuthnCredentials(user.Id)
+	if credentials[0].SignCount != int64(authenticator.signCount) {
+		t.Errorf("stored sign count %d, want %d", credentials[0].SignCount, authenticator.signCount)
+	}
+	if credentials[0].LastUsedAt == nil {
+		t.Errorf("last use of the credential is not recorded")
+	}
+}
+
+func TestWebAuthnRegistrationReturnsRecoveryCodesOnlyForFirstFactor(t *testing.T) {
+	s, _ := newTestWebAuthnService(t)
+	user := mustGetUser(t, s, 1)
+
+	for i, wantCodes := range []bool{true, false} {
+		authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+
+		ceremony := beginRegistration(t, s, user)
+		registration, err := s.FinishWebAuthnRegistration(user, ceremony.ChallengeId, "",
+			authenticator.create(t, ceremony.Options))
+		if err != nil {
+			t.Fatalf("FinishWebAuthnRegistration: %v", err)
+		}
+
+		if got := len(registration.RecoveryCodes) != 0; got != wantCodes {
+			t.Errorf("registration %d: recovery codes returned = %v, want %v", i+1, got, wantCodes)
+		}
+		if registration.Credential.Name != defaultWebAuthnCredentialName {
+			t.Errorf("registration %d: got name %q", i+1, registration.Credential.Name)
+		}
+	}
+}
+
+func TestWebAuthnRegistrationRejectsInvalidClientData(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *softwareAuthenticator)
+	}{
+		{"origin of another site", func(a *softwareAuthenticator) { a.origin = "https://evil.example.com" }},
+		{"relying party of another site", func(a *softwareAuthenticator) { a.rpId = "evil.example.com" }},
+		{"challenge of another ceremony", func(a *softwareAuthenticator) { a.challenge = "c29tZXRoaW5nIGVsc2U" }},
+		{"wrong ceremony type", func(a *softwareAuthenticator) { a.clientDataType = "webauthn.get" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestWebAuthnService(t)
+			user := mustGetUser(t, s, 1)
+			authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+			tt.modify(authenticator)
+
+			ceremony := beginRegistration(t, s, user)
+
+			_, err := s.FinishWebAuthnRegistration(user, ceremony.ChallengeId, "key",
+				authenticator.create(t, ceremony.Options))
+			if !errors.Is(err, ErrInvalidWebAuthnResponse) {
+				t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnResponse)
+			}
+
+			if credentials, _ := repo.GetWebAuthnCredentials(user.Id); len(credentials) != 0 {
+				t.Errorf("the credential has been stored")
+			}
+		})
+	}
+}
+
+func TestWebAuthnRegistrationRejectsCeremonyOfAnotherUser(t *testing.T) {
+	s, repo := newTestWebAuthnService(t)
+	authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+
+	ceremony := beginRegistration(t, s, mustGetUser(t, s, 1))
+
+	other := mustGetUser(t, s, 2)
+	_, err := s.FinishWebAuthnRegistration(other, ceremony.ChallengeId, "key", authenticator.create(t, ceremony.Options))
+	if !errors.Is(err, ErrInvalidWebAuthnChallenge) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnChallenge)
+	}
+
+	if credentials, _ := repo.GetWebAuthnCredentials(other.Id); len(credentials) != 0 {
+		t.Errorf("the credential has been stored")
+	}
+}
+
+func TestWebAuthnRegistrationRequiresReauthentication(t *testing.T) {
+	tests := []struct {
+		name        string
+		securityKey bool
+		password    string
+		code        string
+		want        error
+	}{
+		{"no second factor, no password", false, "", "", ErrInvalidCredentials},
+		{"no second factor, wrong password", false, "wrong password", "", ErrInvalidCredentials},
+		{"security key, password only", true, testPassword, "", ErrInvalidMFACode},
+		{"security key, wrong recovery code", true, testPassword, "aaaa-bbbb-cccc-dddd", ErrInvalidMFACode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestWebAuthnService(t)
+			user := mustGetUser(t, s, 1)
+			if tt.securityKey {
+				registerSoftwareAuthenticator(t, s, newSoftwareAuthenticator(t, testOrigin, testRPID), user.Id)
+			}
+
+			_, err := s.BeginWebAuthnRegistration(user, tt.password, tt.code, "192.0.2.1")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebAuthnRegistrationPasswordLockout(t *testing.T) {
+	s, _ := newTestWebAuthnService(t)
+	user := mustGetUser(t, s, 1)
+
+	for i := 0; i < mfaLockoutPolicy.Threshold; i++ {
+		_, err := s.BeginWebAuthnRegistration(user, "wrong password", "", "192.0.2.1")
+		if !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("attempt %d: got error %v, want %v", i+1, err, ErrInvalidCredentials)
+		}
+	}
+
+	_, err := s.BeginWebAuthnRegistration(user, testPassword, "", "192.0.2.1")
+	if !errors.Is(err, ErrMFALocked) {
+		t.Fatalf("got error %v, want %v", err, ErrMFALocked)
+	}
+}
+
+func TestDeleteWebAuthnCredentialRequiresSecondFactor(t *testing.T) {
+	s, repo := newTestWebAuthnService(t)
+	user := registerSoftwareAuthenticator(t, s, newSoftwareAuthenticator(t, testOrigin, testRPID), 1)
+	credentials, _ := repo.GetWebAuthnCredentials(user.Id)
+	id := credentials[0].Id
+
+	for _, code := range []string{"", "aaaa-bbbb-cccc-dddd"} {
+		if err := s.DeleteWebAuthnCredential(user.Id, id, code, "192.0.2.1"); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("code %q: got error %v, want %v", code, err, ErrInvalidMFACode)
+		}
+	}
+	if credentials, _ := repo.GetWebAuthnCredentials(user.Id); len(credentials) != 1 {
+		t.Fatalf("the credential has been removed without a second factor")
+	}
+
+	code := newRecoveryCode(t, s, user.Id)
+	err := s.DeleteWebAuthnCredential(user.Id, id+1, code, "192.0.2.1")
+	if !errors.Is(err, ErrWebAuthnCredentialNotFound) {
+		t.Fatalf("unknown credential: got error %v, want %v", err, ErrWebAuthnCredentialNotFound)
+	}
+
+	if err := s.DeleteWebAuthnCredential(user.Id, id, code, "192.0.2.1"); err != nil {
+		t.Fatalf("DeleteWebAuthnCredential: %v", err)
+	}
+	if enabled, _ := s.mfa.IsMFAEnabled(user.Id); enabled {
+		t.Errorf("two-factor authentication is still enabled")
+	}
+}
+
+func TestWebAuthnLoginRejectsInvalidClientData(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *softwareAuthenticator)
+	}{
+		{"origin of another site", func(a *softwareAuthenticator) { a.origin = "https://evil.example.com" }},
+		{"relying party of another site", func(a *softwareAuthenticator) { a.rpId = "evil.example.com" }},
+		{"challenge of another ceremony", func(a *softwareAuthenticator) { a.challenge = "c29tZXRoaW5nIGVsc2U" }},
+		{"wrong ceremony type", func(a *softwareAuthenticator) { a.clientDataType = "webauthn.create" }},
+		{"signature of another key", func(a *softwareAuthenticator) { a.key = newSigningKey(t) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestWebAuthnService(t)
+			authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+			user := registerSoftwareAuthenticator(t, s, authenticator, 1)
+			tt.modify(authenticator)
+
+			ceremony, err := s.BeginPasskeyLogin(user.Username)
+			if err != nil {
+				t.Fatalf("BeginPasskeyLogin: %v", err)
+			}
+
+			_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false))
+			if !errors.Is(err, ErrInvalidWebAuthnResponse) {
+				t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnResponse)
+			}
+
+			if credentials, _ := repo.GetWebAuthnCredentials(user.Id); credentials[0].LastUsedAt != nil {
+				t.Errorf("the use of the credential has been recorded")
+			}
+		})
+	}
+}
+
+func TestWebAuthnChallengeCanNotBeReplayed(t *testing.T) {
+	t.Run("registration", func(t *testing.T) {
+		s, _ := newTestWebAuthnService(t)
+		user := mustGetUser(t, s, 1)
+		authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+
+		ceremony := beginRegistration(t, s, user)
+		response := authenticator.create(t, ceremony.Options)
+
+		if _, err := s.FinishWebAuthnRegistration(user, ceremony.ChallengeId, "key", response); err != nil {
+			t.Fatalf("FinishWebAuthnRegistration: %v", err)
+		}
+		_, err := s.FinishWebAuthnRegistration(user, ceremony.ChallengeId, "key", response)
+		if !errors.Is(err, ErrInvalidWebAuthnChallenge) {
+			t.Fatalf("replay: got error %v, want %v", err, ErrInvalidWebAuthnChallenge)
+		}
+	})
+
+	t.Run("login", func(t *testing.T) {
+		s, _ := newTestWebAuthnService(t)
+		authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+		user := registerSoftwareAuthenticator(t, s, authenticator, 1)
+
+		ceremony, err := s.BeginPasskeyLogin(user.Username)
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+		response := authenticator.get(t, ceremony.Options, false)
+
+		if _, _, err := s.FinishPasskeyLogin(ceremony.ChallengeId, response); err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+		_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, response)
+		if !errors.Is(err, ErrInvalidWebAuthnChallenge) {
+			t.Fatalf("replay: got error %v, want %v", err, ErrInvalidWebAuthnChallenge)
+		}
+	})
+
+	t.Run("failed login", func(t *testing.T) {
+		s, _ := newTestWebAuthnService(t)
+		authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+		user := registerSoftwareAuthenticator(t, s, authenticator, 1)
+
+		ceremony, err := s.BeginPasskeyLogin(user.Username)
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+
+		authenticator.origin = "https://evil.example.com"
+		_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false))
+		if !errors.Is(err, ErrInvalidWebAuthnResponse) {
+			t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnResponse)
+		}
+
+		authenticator.origin = testOrigin
+		_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false))
+		if !errors.Is(err, ErrInvalidWebAuthnChallenge) {
+			t.Fatalf("retry: got error %v, want %v", err, ErrInvalidWebAuthnChallenge)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s, repo := newTestWebAuthnService(t)
+		authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+		user := registerSoftwareAuthenticator(t, s, authenticator, 1)
+
+		ceremony, err := s.BeginPasskeyLogin(user.Username)
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+		challenge := repo.challenges[ceremony.ChallengeId]
+		challenge.ExpiresAt = time.Now().Add(-time.Second)
+		repo.challenges[ceremony.ChallengeId] = challenge
+
+		_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false))
+		if !errors.Is(err, ErrInvalidWebAuthnChallenge) {
+			t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnChallenge)
+		}
+	})
+}
+
+func TestWebAuthnLoginRejectsSignCountRegression(t *testing.T) {
+	s, repo := newTestWebAuthnService(t)
+	authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+	user := registerSoftwareAuthenticator(t, s, authenticator, 1)
+
+	for i := 0; i < 2; i++ {
+		ceremony, err := s.BeginPasskeyLogin(user.Username)
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+		if _, _, err := s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false)); err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+	}
+	credentials, _ := repo.GetWebAuthnCredentials(user.Id)
+	storedSignCount := credentials[0].SignCount
+
+	// a clone of the authenticator continues from an older counter
+	authenticator.signCount = uint32(storedSignCount) - 2
+
+	ceremony, err := s.BeginPasskeyLogin(user.Username)
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+	_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, false))
+	if !errors.Is(err, ErrInvalidWebAuthnResponse) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnResponse)
+	}
+
+	credentials, _ = repo.GetWebAuthnCredentials(user.Id)
+	if credentials[0].SignCount != storedSignCount {
+		t.Errorf("stored sign count changed from %d to %d", storedSignCount, credentials[0].SignCount)
+	}
+}
+
+func TestWebAuthnDiscoverableLogin(t *testing.T) {
+	s, _ := newTestWebAuthnService(t)
+	authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+	registerSoftwareAuthenticator(t, s, newSoftwareAuthenticator(t, testOrigin, testRPID), 1)
+	user := registerSoftwareAuthenticator(t, s, authenticator, 2)
+
+	ceremony, err := s.BeginPasskeyLogin("")
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+
+	signedIn, _, err := s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, true))
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin: %v", err)
+	}
+	if signedIn.Id != user.Id {
+		t.Errorf("signed in user %d, want %d", signedIn.Id, user.Id)
+	}
+}
+
+func TestWebAuthnDiscoverableLoginRejectsUnknownCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *softwareAuthenticator)
+	}{
+		{"unregistered credential", func(a *softwareAuthenticator) { a.credentialId = []byte("unregistered") }},
+		{"user handle of another user", func(a *softwareAuthenticator) { a.userHandle = webAuthnUserHandle(1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestWebAuthnService(t)
+			authenticator := newSoftwareAuthenticator(t, testOrigin, testRPID)
+			registerSoftwareAuthenticator(t, s, newSoftwareAuthenticator(t, testOrigin, testRPID), 1)
+			registerSoftwareAuthenticator(t, s, authenticator, 2)
+			tt.modify(authenticator)
+
+			ceremony, err := s.BeginPasskeyLogin("")
+			if err != nil {
+				t.Fatalf("BeginPasskeyLogin: %v", err)
+			}
+
+			_, _, err = s.FinishPasskeyLogin(ceremony.ChallengeId, authenticator.get(t, ceremony.Options, true))
+			if !errors.Is(err, ErrInvalidWebAuthnResponse) {
+				t.Fatalf("got error %v, want %v", err, ErrInvalidWebAuthnResponse)
+			}
+		})
+	}
+}
+
+func newTestWebAuthnService(t *testing.T) (*WebAuthnService, *fakeWebAuthnRepository) {
+	t.Helper()
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPOrigin:      testOrigin,
+		RPDisplayName: defaultMFAIssuerName,
+	})
+	if err != nil {
+		t.Fatalf("webauthn.New: %v", err)
+	}
+
+	passwordHash, err := utils.GeneratePasswordHash(testPassword)
+	if err != nil {
+		t.Fatalf("GeneratePasswordHash: %v", err)
+	}
+
+	repo := &fakeWebAuthnRepository{challenges: map[string]models.WebAuthnChallenge{}}
+	users := &fakeUsersRepository{users: map[uint]models.User{
+		1: {Id: 1, Username: "alice", Password: passwordHash},
+		2: {Id: 2, Username: "bob", Password: passwordHash},
+	}}
+	mfa := &MFAService{repo: &fakeMFARepository{}, credentials: repo, events: &fakeSecurityEvents{},
+		auth: &AuthService{repo: users}, notifier: &logNotifier{}}
+
+	return &WebAuthnService{repo: repo, users: users, mfa: mfa, webAuthn: webAuthn}, repo
+}
+
+func mustGetUser(t *testing.T, s *WebAuthnService, id uint) models.User {
+	t.Helper()
+
+	user, err := s.users.GetUserById(id)
+	if err != nil {
+		t.Fatalf("GetUserById: %v", err)
+	}
+
+	return user
+}
+
+// registerSoftwareAuthenticator runs a registration ceremony of the authenticator for the user
+func registerSoftwareAuthenticator(t *testing.T, s *WebAuthnService, authenticator *softwareAuthenticator,
+	userId uint) models.User {
+	t.Helper()
+
+	user := mustGetUser(t, s, userId)
+	ceremony := beginRegistration(t, s, user)
+
+	if _, err := s.FinishWebAuthnRegistration(user, ceremony.ChallengeId, "key",
+		authenticator.create(t, ceremony.Options)); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %v", err)
+	}
+
+	return user
+}
+
+// beginRegistration starts a registration ceremony for the user, who re-authenticates with the password
+// or, once a second factor is registered, with a new recovery code
+func beginRegistration(t *testing.T, s *WebAuthnService, user models.User) models.WebAuthnCeremony {
+	t.Helper()
+
+	ceremony, err := s.BeginWebAuthnRegistration(user, testPassword, newRecoveryCode(t, s, user.Id), "192.0.2.1")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration: %v", err)
+	}
+
+	return ceremony
+}
+
+// newRecoveryCode returns a recovery code of the user if two-factor authentication is enabled
+func newRecoveryCode(t *testing.T, s *WebAuthnService, userId uint) string {
+	t.Helper()
+
+	enabled, err := s.mfa.IsMFAEnabled(userId)
+	if err != nil {
+		t.Fatalf("IsMFAEnabled: %v", err)
+	}
+	if !enabled {
+		return ""
+	}
+
+	codes, err := s.mfa.generateRecoveryCodes(userId)
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes: %v", err)
+	}
+
+	return codes[0]
+}
+
+// softwareAuthenticator plays the part of the browser and a platform authenticator with a P-256 key.
+// The fields are used for the next response and can be changed to produce invalid ones
+type softwareAuthenticator struct {
+	origin         string
+	rpId           string
+	credentialId   []byte
+	key            *ecdsa.PrivateKey
+	userHandle     []byte
+	signCount      uint32
+	challenge      string
+	clientDataType string
+}
+
+func newSoftwareAuthenticator(t *testing.T, origin, rpId string) *softwareAuthenticator {
+	credentialId := make([]byte, 16)
+	if _, err := rand.Read(credentialId); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softwareAuthenticator{origin: origin, rpId: rpId, credentialId: credentialId, key: newSigningKey(t)}
+}
+
+func newSigningKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// create returns the result of navigator.credentials.create() with the "none" attestation format
+func (a *softwareAuthenticator) create(t *testing.T, options interface{}) []byte {
+	t.Helper()
+
+	var creation struct {
+		PublicKey struct {
+			User struct {
+				Id string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	unmarshalOptions(t, options, &creation)
+	// the library encodes the user handle with standard base64 instead of base64url
+	userHandle, err := base64.StdEncoding.DecodeString(creation.PublicKey.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.userHandle == nil {
+		a.userHandle = userHandle
+	}
+
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: padCoordinate(a.key.PublicKey.X.Bytes()),
+		-3: padCoordinate(a.key.PublicKey.Y.Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authData := a.authenticatorData(0x45) // user present, user verified, attested credential data
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.credentialId)>>8), byte(len(a.credentialId)))
+	authData = append(authData, a.credentialId...)
+	authData = append(authData, publicKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.marshalCredential(t, map[string]interface{}{
+		"clientDataJSON":    a.clientData(t, options, "webauthn.create"),
+		"attestationObject": encode(attestationObject),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get returns the result of navigator.credentials.get(). Discoverable credentials return the user handle
+func (a *softwareAuthenticator) get(t *testing.T, options interface{}, withUserHandle bool) []byte {
+	t.Helper()
+
+	a.signCount++
+	authData := a.authenticatorData(0x05) // user present, user verified
+	clientData := a.clientData(t, options, "webauthn.get")
+
+	clientDataJSON, _ := base64.RawURLEncoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := map[string]interface{}{
+		"clientDataJSON":    clientData,
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+	}
+	if withUserHandle {
+		response["userHandle"] = encode(a.userHandle)
+	}
+
+	return a.marshalCredential(t, response)
+}
+
+func (a *softwareAuthenticator) authenticatorData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+
+	authData := make([]byte, 37)
+	copy(authData, rpIdHash[:])
+	authData[32] = flags
+	binary.BigEndian.PutUint32(authData[33:], a.signCount)
+
+	return authData
+}
+
+func (a *softwareAuthenticator) clientData(t *testing.T, options interface{}, ceremonyType string) string {
+	t.Helper()
+
+	var request struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	unmarshalOptions(t, options, &request)
+
+	// like the user handle, the challenge is encoded with standard base64, the browser reports it in base64url
+	rawChallenge, err := base64.StdEncoding.DecodeString(request.PublicKey.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := encode(rawChallenge)
+	if a.challenge != "" {
+		challenge = a.challenge
+	}
+	if a.clientDataType != "" {
+		ceremonyType = a.clientDataType
+	}
+
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encode(clientData)
+}
+
+func (a *softwareAuthenticator) marshalCredential(t *testing.T, response map[string]interface{}) []byte {
+	t.Helper()
+
+	credential, err := json.Marshal(map[string]interface{}{
+		"id":       encode(a.credentialId),
+		"rawId":    encode(a.credentialId),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+// unmarshalOptions reads the options as the browser does, from their JSON encoding
+func unmarshalOptions(t *testing.T, options interface{}, v interface{}) {
+	t.Helper()
+
+	data, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func padCoordinate(coordinate []byte) []byte {
+	return append(make([]byte, 32-len(coordinate)), coordinate...)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+type fakeWebAuthnRepository struct {
+	credentials []models.WebAuthnCredential
+	challenges  map[string]models.WebAuthnChallenge
+}
+
+func (r *fakeWebAuthnRepository) GetWebAuthnCredentials(userId uint) ([]models.WebAuthnCredential, error) {
+	var credentials []models.WebAuthnCredential
+	for _, credential := range r.credentials {
+		if credential.UserId == userId {
+			credentials = append(credentials, credential)
+		}
+	}
+
+	return credentials, nil
+}
+
+func (r *fakeWebAuthnRepository) GetWebAuthnCredentialByCredentialId(
+	credentialId []byte) (models.WebAuthnCredential, error) {
+	for _, credential := range r.credentials {
+		if bytes.Equal(credential.CredentialId, credentialId) {
+			return credential, nil
+		}
+	}
+
+	return models.WebAuthnCredential{}, sql.ErrNoRows
+}
+
+func (r *fakeWebAuthnRepository) AddWebAuthnCredential(credential models.WebAuthnCredential) (uint, error) {
+	credential.Id = uint(len(r.credentials) + 1)
+	r.credentials = append(r.credentials, credential)
+
+	return credential.Id, nil
+}
+
+func (r *fakeWebAuthnRepository) UpdateWebAuthnCredentialUse(id uint, signCount int64) error {
+	now := time.Now()
+	for i := range r.credentials {
+		if r.credentials[i].Id == id {
+			r.credentials[i].SignCount = signCount
+			r.credentials[i].LastUsedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (r *fakeWebAuthnRepository) DeleteWebAuthnCredential(userId, id uint) (bool, error) {
+	for i, credential := range r.credentials {
+		if credential.UserId == userId && credential.Id == id {
+			r.credentials = append(r.credentials[:i], r.credentials[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *fakeWebAuthnRepository) AddWebAuthnChallenge(challenge models.WebAuthnChallenge) error {
+	r.challenges[challenge.Id] = challenge
+	return nil
+}
+
+// ConsumeWebAuthnChallenge deletes the challenge like the database does, so it is returned only once
+func (r *fakeWebAuthnRepository) ConsumeWebAuthnChallenge(id, ceremony string) (models.WebAuthnChallenge, error) {
+	challenge, ok := r.challenges[id]
+	delete(r.challenges, id)
+	if !ok || challenge.Ceremony != ceremony || !time.Now().Before(challenge.ExpiresAt) {
+		return models.WebAuthnChallenge{}, sql.ErrNoRows
+	}
+
+	return challenge, nil
+}
+
+// fakeUsersRepository implements the user lookups, other methods of the interface are not used
+type fakeUsersRepository struct {
+	repository.Authorization
+	users map[uint]models.User
+}
+
+func (r *fakeUsersRepository) GetUser(username string) (models.User, error) {
+	for _, user := range r.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+
+	return models.User{}, sql.ErrNoRows
+}
+
+func (r *fakeUsersRepository) GetUserById(id uint) (models.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	return user, nil
+}
+
+// fakeMFARepository stores the recovery codes and counts the attempts, the users have no TOTP credential
+type fakeMFARepository struct {
+	repository.MFA
+	recoveryCodes map[uint][]string
+	attempts      map[uint]int
+}
+
+// AttemptSecondFactor locks the user out once the threshold is reached, without the delays of the database
+func (r *fakeMFARepository) AttemptSecondFactor(userId uint, policy models.MFALockoutPolicy) (int, error) {
+	if r.attempts == nil {
+		r.attempts = map[uint]int{}
+	}
+	if r.attempts[userId] >= policy.Threshold {
+		return 0, sql.ErrNoRows
+	}
+	r.attempts[userId]++
+
+	return r.attempts[userId], nil
+}
+
+func (r *fakeMFARepository) ResetSecondFactorAttempts(userId uint) error {
+	delete(r.attempts, userId)
+	return nil
+}
+
+func (r *fakeMFARepository) UseRecoveryCode(userId uint, codeHash string) (bool, error) {
+	for i, hash := range r.recoveryCodes[userId] {
+		if hash == codeHash {
+			r.recoveryCodes[userId] = append(r.recoveryCodes[userId][:i], r.recoveryCodes[userId][i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *fakeMFARepository) CountRecoveryCodes(userId uint) (int, error) {
+	return len(r.recoveryCodes[userId]), nil
+}
+
+func (r *fakeMFARepository) DeleteRecoveryCodes(userId uint) error {
+	delete(r.recoveryCodes, userId)
+	return nil
+}
+
+func (r *fakeMFARepository) GetTOTPCredential(userId uint) (models.TOTPCredential, error) {
+	return models.TOTPCredential{}, sql.ErrNoRows
+}
+
+func (r *fakeMFARepository) ReplaceRecoveryCodes(userId uint, codeHashes []string) error {
+	if r.recoveryCodes == nil {
+		r.recoveryCodes = map[uint][]string{}
+	}
+	r.recoveryCodes[userId] = codeHashes
+
+	return nil
+}
+
+type fakeSecurityEvents struct {
+	events []models.SecurityEvent
+}
+
+func (r *fakeSecurityEvents) AddSecurityEvent(event models.SecurityEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
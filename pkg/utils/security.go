@@ -1,21 +1,202 @@
 package utils
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/spf13/viper"
 	"github.com/th2empty/auth_service/configs"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+
+	defaultArgon2Memory      = 64 * 1024 // in KiB
+	defaultArgon2Iterations  = 3
+	defaultArgon2Parallelism = 2
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
 )
 
 var (
 	_ = configs.InitConfig()
 
+	// salt is only used to verify legacy SHA-1 hashes created before PHC strings were introduced
 	salt = viper.GetString("auth.salt")
+
+	hashAlgorithm     = viper.GetString("auth.password_hash.algorithm")
+	argon2Memory      = viper.GetUint32("auth.password_hash.argon2_memory")
+	argon2Iterations  = viper.GetUint32("auth.password_hash.argon2_iterations")
+	argon2Parallelism = uint8(viper.GetUint("auth.password_hash.argon2_parallelism"))
+	bcryptCost        = viper.GetInt("auth.password_hash.bcrypt_cost")
+
+	ErrInvalidHash         = errors.New("the encoded hash is not in the correct format")
+	ErrIncompatibleVersion = errors.New("incompatible version of argon2")
 )
 
-func GeneratePasswordHash(password string) string {
+func init() {
+	if hashAlgorithm == "" {
+		hashAlgorithm = Argon2id
+	}
+	if argon2Memory == 0 {
+		argon2Memory = defaultArgon2Memory
+	}
+	if argon2Iterations == 0 {
+		argon2Iterations = defaultArgon2Iterations
+	}
+	if argon2Parallelism == 0 {
+		argon2Parallelism = defaultArgon2Parallelism
+	}
+	if bcryptCost == 0 {
+		bcryptCost = bcrypt.DefaultCost
+	}
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// GeneratePasswordHash hashes the password with the configured algorithm and a random per-password salt.
+// Argon2id hashes are returned as PHC strings ($argon2id$v=19$m=...,t=...,p=...$salt$hash),
+// bcrypt hashes use their native modular crypt format ($2a$cost$...)
+func GeneratePasswordHash(password string) (string, error) {
+	switch strings.ToLower(hashAlgorithm) {
+	case Argon2id:
+		return generateArgon2idHash(password, argon2Params{argon2Memory, argon2Iterations, argon2Parallelism})
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		return string(hash), err
+	default:
+		return "", fmt.Errorf("unsupported password hash algorithm %q", hashAlgorithm)
+	}
+}
+
+// ComparePasswordHash reports whether the password matches the encoded hash.
+// Hashes produced by any supported algorithm, including legacy salted SHA-1, are accepted
+func ComparePasswordHash(password, encodedHash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encodedHash, "$"+Argon2id+"$"):
+		params, salt, key, err := decodeArgon2idHash(encodedHash)
+		if err != nil {
+			return false, err
+		}
+
+		otherKey := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism,
+			uint32(len(key)))
+
+		return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+	case isBcryptHash(encodedHash):
+		err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+
+		return err == nil, err
+	case strings.HasPrefix(encodedHash, "$"):
+		return false, ErrInvalidHash
+	default:
+		return subtle.ConstantTimeCompare([]byte(legacyPasswordHash(password)), []byte(encodedHash)) == 1, nil
+	}
+}
+
+// PasswordHashNeedsRehash reports whether the encoded hash was produced by another algorithm
+// or with weaker parameters than currently configured
+func PasswordHashNeedsRehash(encodedHash string) bool {
+	switch strings.ToLower(hashAlgorithm) {
+	case Argon2id:
+		if !strings.HasPrefix(encodedHash, "$"+Argon2id+"$") {
+			return true
+		}
+
+		params, _, _, err := decodeArgon2idHash(encodedHash)
+		if err != nil {
+			return true
+		}
+
+		return params.memory < argon2Memory || params.iterations < argon2Iterations ||
+			params.parallelism < argon2Parallelism
+	case Bcrypt:
+		if !isBcryptHash(encodedHash) {
+			return true
+		}
+
+		cost, err := bcrypt.Cost([]byte(encodedHash))
+
+		return err != nil || cost < bcryptCost
+	default:
+		return false
+	}
+}
+
+func generateArgon2idHash(password string, params argon2Params) (string, error) {
+	salt, err := GenerateRandomBytes(argon2SaltLength)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+		params.memory, params.iterations, params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func decodeArgon2idHash(encodedHash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, ErrIncompatibleVersion
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	return params, salt, key, nil
+}
+
+func isBcryptHash(encodedHash string) bool {
+	return strings.HasPrefix(encodedHash, "$2a$") || strings.HasPrefix(encodedHash, "$2b$") ||
+		strings.HasPrefix(encodedHash, "$2y$")
+}
+
+// legacyPasswordHash reproduces the hashes stored before the introduction of PHC strings
+func legacyPasswordHash(password string) string {
 	hash := sha1.New()
 	hash.Write([]byte(password))
 
 	return fmt.Sprintf("%x", hash.Sum([]byte(salt)))
 }
+
+func GenerateRandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
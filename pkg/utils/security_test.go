@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Params keep the tests fast, the hashes are verified with the parameters they carry
+var testArgon2Params = argon2Params{memory: 1024, iterations: 1, parallelism: 1}
+
+func newArgon2idHash(t *testing.T, password string, params argon2Params) string {
+	t.Helper()
+
+	hash, err := generateArgon2idHash(password, params)
+	if err != nil {
+		t.Fatalf("generateArgon2idHash: %v", err)
+	}
+
+	return hash
+}
+
+func newBcryptHash(t *testing.T, password string, cost int) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+
+	return string(hash)
+}
+
+func TestComparePasswordHash(t *testing.T) {
+	argon2idHash := newArgon2idHash(t, "secret", testArgon2Params)
+	bcryptHash := newBcryptHash(t, "secret", bcrypt.MinCost)
+
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		want     bool
+		wantErr  error
+	}{
+		{name: "argon2id", password: "secret", hash: argon2idHash, want: true},
+		{name: "argon2id wrong password", password: "wrong", hash: argon2idHash},
+		{name: "bcrypt", password: "secret", hash: bcryptHash, want: true},
+		{name: "bcrypt wrong password", password: "wrong", hash: bcryptHash},
+		{name: "legacy SHA-1", password: "secret", hash: legacyPasswordHash("secret"), want: true},
+		{name: "legacy SHA-1 wrong password", password: "wrong", hash: legacyPasswordHash("secret")},
+		{name: "missing parts", password: "secret", hash: "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+			wantErr: ErrInvalidHash},
+		{name: "malformed parameters", password: "secret", hash: "$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+			wantErr: ErrInvalidHash},
+		{name: "malformed salt", password: "secret", hash: "$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+			wantErr: ErrInvalidHash},
+		{name: "empty key", password: "secret", hash: "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+			wantErr: ErrInvalidHash},
+		{name: "other argon2 version", password: "secret", hash: "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+			wantErr: ErrIncompatibleVersion},
+		{name: "unknown algorithm", password: "secret", hash: "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5",
+			wantErr: ErrInvalidHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ComparePasswordHash(tt.password, tt.hash)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHashNeedsRehash(t *testing.T) {
+	defer func(algorithm string, params argon2Params, cost int) {
+		hashAlgorithm = algorithm
+		argon2Memory, argon2Iterations, argon2Parallelism = params.memory, params.iterations, params.parallelism
+		bcryptCost = cost
+	}(hashAlgorithm, argon2Params{argon2Memory, argon2Iterations, argon2Parallelism}, bcryptCost)
+
+	argon2Memory, argon2Iterations, argon2Parallelism = 2048, 2, 1
+	bcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name      string
+		algorithm string
+		hash      string
+		want      bool
+	}{
+		{"argon2id with the configured parameters", Argon2id,
+			newArgon2idHash(t, "secret", argon2Params{2048, 2, 1}), false},
+		{"argon2id with stronger parameters", Argon2id,
+			newArgon2idHash(t, "secret", argon2Params{4096, 3, 2}), false},
+		{"argon2id with less memory", Argon2id, newArgon2idHash(t, "secret", argon2Params{1024, 2, 1}), true},
+		{"argon2id with fewer iterations", Argon2id, newArgon2idHash(t, "secret", argon2Params{2048, 1, 1}), true},
+		{"bcrypt when argon2id is configured", Argon2id, newBcryptHash(t, "secret", bcryptCost), true},
+		{"legacy SHA-1 when argon2id is configured", Argon2id, legacyPasswordHash("secret"), true},
+		{"malformed argon2id", Argon2id, "$argon2id$v=19$m=x$c2FsdA$a2V5", true},
+		{"bcrypt with the configured cost", Bcrypt, newBcryptHash(t, "secret", bcryptCost), false},
+		{"bcrypt with a lower cost", Bcrypt, newBcryptHash(t, "secret", bcrypt.MinCost), true},
+		{"argon2id when bcrypt is configured", Bcrypt, newArgon2idHash(t, "secret", testArgon2Params), true},
+		{"legacy SHA-1 when bcrypt is configured", Bcrypt, legacyPasswordHash("secret"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashAlgorithm = tt.algorithm
+
+			if got := PasswordHashNeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
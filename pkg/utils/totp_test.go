@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the test vectors of RFC 6238, appendix B
+var rfc6238Secret = []byte("12345678901234567890")
+
+// TestGenerateTOTP checks the codes against the test vectors of RFC 6238, appendix B.
+// The vectors have 8 digits, the 6-digit codes are their last 6 digits
+func TestGenerateTOTP(t *testing.T) {
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.time, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			now := time.Unix(tt.time, 0)
+			if got := GenerateTOTP(rfc6238Secret, TOTPStep(now)); got != tt.want {
+				t.Errorf("got code %s, want %s", got, tt.want)
+			}
+
+			step, ok := ValidateTOTP(rfc6238Secret, tt.want, now, 0)
+			if !ok || step != TOTPStep(now) {
+				t.Errorf("got step %d, %v, want %d", step, ok, TOTPStep(now))
+			}
+		})
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := TOTPStep(now)
+
+	tests := []struct {
+		name   string
+		code   string
+		skew   int64
+		want   int64
+		wantOk bool
+	}{
+		{"current step", GenerateTOTP(rfc6238Secret, current), 1, current, true},
+		{"previous step", GenerateTOTP(rfc6238Secret, current-1), 1, current - 1, true},
+		{"next step", GenerateTOTP(rfc6238Secret, current+1), 1, current + 1, true},
+		{"two steps ago", GenerateTOTP(rfc6238Secret, current-2), 1, 0, false},
+		{"two steps ahead", GenerateTOTP(rfc6238Secret, current+2), 1, 0, false},
+		{"previous step without skew", GenerateTOTP(rfc6238Secret, current-1), 0, 0, false},
+		{"two steps ago with a skew of 2", GenerateTOTP(rfc6238Secret, current-2), 2, current - 2, true},
+		{"code of another secret", GenerateTOTP([]byte("another secret"), current), 1, 0, false},
+		{"8-digit code", "14050471", 1, 0, false},
+		{"empty code", "", 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(rfc6238Secret, tt.code, now, tt.skew)
+			if ok != tt.wantOk || step != tt.want {
+				t.Errorf("got step %d, %v, want %d, %v", step, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+CREATE TABLE signing_keys
+(
+    id VARCHAR(64) not null unique,
+    algorithm VARCHAR(16) not null,
+    private_key bytea not null,
+    public_key bytea,
+    created_at timestamptz not null default now(),
+    retired_at timestamptz,
+    expires_at timestamptz
+);
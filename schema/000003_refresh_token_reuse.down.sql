@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS refresh_token_history CASCADE;
+DROP TABLE IF EXISTS security_events CASCADE;
\ No newline at end of file
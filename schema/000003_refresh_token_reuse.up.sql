@@ -0,0 +1,17 @@
+CREATE TABLE refresh_token_history
+(
+    refresh_uuid text not null unique,
+    session_id int references sessions(id) on delete cascade not null,
+    rotated_at timestamptz not null default now()
+);
+
+CREATE TABLE security_events
+(
+    id bigserial not null unique,
+    user_id int references users(id) on delete cascade,
+    session_id int,
+    type VARCHAR(64) not null,
+    ip_address text,
+    details text,
+    created_at timestamptz not null default now()
+);
@@ -0,0 +1,2 @@
+ALTER TABLE applications DROP COLUMN IF EXISTS client_secret_hash;
+ALTER TABLE applications DROP COLUMN IF EXISTS client_id;
@@ -0,0 +1,4 @@
+ALTER TABLE applications ADD COLUMN client_id VARCHAR(64) not null unique default md5(random()::text);
+ALTER TABLE applications ADD COLUMN client_secret_hash text;
+
+UPDATE applications SET client_id = lower(name) WHERE name IN ('unknown', 'PasswordCloud');
@@ -0,0 +1,7 @@
+CREATE TABLE revoked_tokens
+(
+    jti text not null unique,
+    expires_at timestamptz not null
+);
+
+CREATE INDEX revoked_tokens_expires_at_idx ON revoked_tokens (expires_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS authorization_codes CASCADE;
+
+ALTER TABLE applications DROP COLUMN IF EXISTS redirect_uris;
@@ -0,0 +1,13 @@
+ALTER TABLE applications ADD COLUMN redirect_uris text[] not null default '{}';
+
+CREATE TABLE authorization_codes
+(
+    code_hash text not null unique,
+    app_id int references applications(id) on delete cascade not null,
+    user_id int references users(id) on delete cascade not null,
+    redirect_uri text not null,
+    code_challenge text not null,
+    scope text not null default '',
+    created_at timestamptz not null default now(),
+    expires_at timestamptz not null
+);
@@ -0,0 +1,2 @@
+ALTER TABLE applications DROP COLUMN IF EXISTS allowed_scopes;
+ALTER TABLE applications DROP COLUMN IF EXISTS grant_types;
@@ -0,0 +1,2 @@
+ALTER TABLE applications ADD COLUMN grant_types text[] not null default '{authorization_code}';
+ALTER TABLE applications ADD COLUMN allowed_scopes text[] not null default '{}';
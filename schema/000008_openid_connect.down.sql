@@ -0,0 +1,5 @@
+ALTER TABLE sessions DROP COLUMN IF EXISTS scope;
+
+ALTER TABLE authorization_codes DROP COLUMN IF EXISTS amr;
+ALTER TABLE authorization_codes DROP COLUMN IF EXISTS auth_time;
+ALTER TABLE authorization_codes DROP COLUMN IF EXISTS nonce;
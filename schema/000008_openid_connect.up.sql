@@ -0,0 +1,5 @@
+ALTER TABLE authorization_codes ADD COLUMN nonce text not null default '';
+ALTER TABLE authorization_codes ADD COLUMN auth_time timestamptz not null default now();
+ALTER TABLE authorization_codes ADD COLUMN amr text[] not null default '{}';
+
+ALTER TABLE sessions ADD COLUMN scope text not null default '';
@@ -0,0 +1,15 @@
+CREATE TABLE device_codes
+(
+    device_code_hash text not null unique,
+    user_code text not null unique,
+    app_id int references applications(id) on delete cascade not null,
+    user_id int references users(id) on delete cascade,
+    scope text not null default '',
+    status text not null default 'pending',
+    poll_interval int not null,
+    last_polled_at timestamptz,
+    created_at timestamptz not null default now(),
+    expires_at timestamptz not null
+);
+
+CREATE INDEX device_codes_expires_at_idx ON device_codes (expires_at);
@@ -0,0 +1,17 @@
+CREATE TABLE totp_credentials
+(
+    user_id int references users(id) on delete cascade not null unique,
+    secret bytea not null,
+    confirmed_at timestamptz,
+    last_used_step bigint not null default 0,
+    created_at timestamptz not null default now()
+);
+
+CREATE TABLE mfa_challenges
+(
+    token_hash text not null unique,
+    user_id int references users(id) on delete cascade not null,
+    attempts int not null default 0,
+    created_at timestamptz not null default now(),
+    expires_at timestamptz not null
+);
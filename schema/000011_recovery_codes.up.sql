@@ -0,0 +1,10 @@
+CREATE TABLE mfa_recovery_codes
+(
+    id serial not null unique,
+    user_id int references users(id) on delete cascade not null,
+    code_hash text not null,
+    used_at timestamptz,
+    created_at timestamptz not null default now()
+);
+
+CREATE INDEX mfa_recovery_codes_user_id_idx ON mfa_recovery_codes (user_id);
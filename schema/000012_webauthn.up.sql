@@ -0,0 +1,26 @@
+CREATE TABLE webauthn_credentials
+(
+    id serial not null unique,
+    user_id int references users(id) on delete cascade not null,
+    credential_id bytea not null unique,
+    public_key bytea not null,
+    attestation_type text not null default '',
+    aaguid bytea,
+    sign_count bigint not null default 0,
+    transports text[] not null default '{}',
+    name text not null default '',
+    created_at timestamptz not null default now(),
+    last_used_at timestamptz
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
+
+CREATE TABLE webauthn_challenges
+(
+    id text not null unique,
+    user_id int references users(id) on delete cascade, -- null for passkey sign-ins without a username
+    ceremony text not null,
+    session_data bytea not null,
+    created_at timestamptz not null default now(),
+    expires_at timestamptz not null
+);
@@ -0,0 +1,11 @@
+ALTER TABLE sessions DROP COLUMN client_id;
+
+ALTER TABLE users DROP CONSTRAINT users_role_id_fkey;
+ALTER TABLE roles DROP CONSTRAINT roles_permission_id_fkey;
+ALTER TABLE roles DROP CONSTRAINT roles_name_key;
+
+UPDATE users SET role_id = (SELECT id FROM roles WHERE name = 'user')
+WHERE role_id = (SELECT id FROM roles WHERE name = 'admin');
+
+DELETE FROM permissions WHERE id = (SELECT permission_id FROM roles WHERE name = 'admin');
+DELETE FROM roles WHERE name = 'admin';
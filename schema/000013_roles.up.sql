@@ -0,0 +1,18 @@
+-- the seed role pointed to a permission set that does not exist
+UPDATE roles SET permission_id = (SELECT min(id) FROM permissions)
+WHERE permission_id NOT IN (SELECT id FROM permissions);
+
+INSERT INTO permissions(can_read, can_write, can_access_private_data, can_manage_accounts)
+VALUES (true, true, true, true);
+INSERT INTO roles(name, permission_id) VALUES ('admin', currval(pg_get_serial_sequence('permissions', 'id')));
+
+-- users created before roles were assigned have role_id 0
+UPDATE users SET role_id = (SELECT id FROM roles WHERE name = 'user')
+WHERE role_id NOT IN (SELECT id FROM roles);
+
+ALTER TABLE roles ADD CONSTRAINT roles_name_key UNIQUE (name);
+ALTER TABLE roles ADD CONSTRAINT roles_permission_id_fkey FOREIGN KEY (permission_id) REFERENCES permissions (id);
+ALTER TABLE users ADD CONSTRAINT users_role_id_fkey FOREIGN KEY (role_id) REFERENCES roles (id);
+
+-- sessions of OAuth clients act on behalf of the user and must not get the permissions of the user's role
+ALTER TABLE sessions ADD COLUMN client_id text not null default '';
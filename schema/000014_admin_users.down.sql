@@ -0,0 +1,6 @@
+DROP TABLE admin_audit_log;
+
+DROP INDEX users_created_at_idx;
+
+ALTER TABLE users DROP COLUMN disabled_at;
+ALTER TABLE users DROP COLUMN created_at;
@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN created_at timestamptz not null default now();
+ALTER TABLE users ADD COLUMN disabled_at timestamptz;
+
+CREATE INDEX users_created_at_idx ON users (created_at);
+
+-- actions of administrators; entries are kept when the admin or the affected user is deleted
+CREATE TABLE admin_audit_log
+(
+    id bigserial not null unique,
+    admin_id int references users(id) on delete set null,
+    action VARCHAR(64) not null,
+    target_user_id int,
+    details text,
+    ip_address text,
+    created_at timestamptz not null default now()
+);
+
+CREATE INDEX admin_audit_log_target_user_id_idx ON admin_audit_log (target_user_id);
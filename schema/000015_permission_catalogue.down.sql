@@ -0,0 +1,34 @@
+-- permissions that have no boolean column are lost
+ALTER TABLE permissions RENAME TO permission_catalogue;
+
+CREATE TABLE permissions
+(
+    id serial not null unique,
+    can_read bool not null,
+    can_write bool not null,
+    can_access_private_data bool not null,
+    can_manage_accounts bool not null,
+    role_id int
+);
+
+INSERT INTO permissions (can_read, can_write, can_access_private_data, can_manage_accounts, role_id)
+SELECT
+    EXISTS (SELECT 1 FROM role_permissions rp INNER JOIN permission_catalogue c ON c.id = rp.permission_id
+            WHERE rp.role_id = r.id AND c.name IN ('read', '*')),
+    EXISTS (SELECT 1 FROM role_permissions rp INNER JOIN permission_catalogue c ON c.id = rp.permission_id
+            WHERE rp.role_id = r.id AND c.name IN ('write', '*')),
+    EXISTS (SELECT 1 FROM role_permissions rp INNER JOIN permission_catalogue c ON c.id = rp.permission_id
+            WHERE rp.role_id = r.id AND c.name IN ('access_private_data', '*')),
+    EXISTS (SELECT 1 FROM role_permissions rp INNER JOIN permission_catalogue c ON c.id = rp.permission_id
+            WHERE rp.role_id = r.id AND c.name IN ('manage_accounts', '*')),
+    r.id
+FROM roles r;
+
+ALTER TABLE roles ADD COLUMN permission_id int;
+UPDATE roles r SET permission_id = p.id FROM permissions p WHERE p.role_id = r.id;
+ALTER TABLE roles ALTER COLUMN permission_id SET NOT NULL;
+ALTER TABLE permissions DROP COLUMN role_id;
+ALTER TABLE roles ADD CONSTRAINT roles_permission_id_fkey FOREIGN KEY (permission_id) REFERENCES permissions (id);
+
+DROP TABLE role_permissions;
+DROP TABLE permission_catalogue;
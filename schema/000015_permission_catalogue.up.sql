@@ -0,0 +1,39 @@
+-- the boolean columns of the permission sets become rows of a catalogue of named permissions
+CREATE TEMPORARY TABLE legacy_role_permissions AS
+SELECT r.id AS role_id, unnest(array_remove(ARRAY[
+    CASE WHEN p.can_read THEN 'read' END,
+    CASE WHEN p.can_write THEN 'write' END,
+    CASE WHEN p.can_access_private_data THEN 'access_private_data' END,
+    CASE WHEN p.can_manage_accounts THEN 'manage_accounts' END
+], NULL)) AS name
+FROM roles r INNER JOIN permissions p ON p.id = r.permission_id;
+
+ALTER TABLE roles DROP COLUMN permission_id;
+DROP TABLE permissions;
+
+CREATE TABLE permissions
+(
+    id serial primary key,
+    name varchar(128) not null unique,
+    description text not null default ''
+);
+
+CREATE TABLE role_permissions
+(
+    role_id int not null references roles (id) on delete cascade,
+    permission_id int not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+CREATE INDEX role_permissions_permission_id_idx ON role_permissions (permission_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('read', 'Read own data'),
+    ('write', 'Change own data'),
+    ('access_private_data', 'Access private data'),
+    ('manage_accounts', 'Manage user accounts, roles and permissions');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT l.role_id, p.id FROM legacy_role_permissions l INNER JOIN permissions p ON p.name = l.name;
+
+DROP TABLE legacy_role_permissions;
@@ -0,0 +1,3 @@
+CREATE SEQUENCE sessions_history_id_seq OWNED BY sessions_history.id;
+SELECT setval('sessions_history_id_seq', COALESCE((SELECT max(id) FROM sessions_history), 0) + 1, false);
+ALTER TABLE sessions_history ALTER COLUMN id SET DEFAULT nextval('sessions_history_id_seq');
@@ -0,0 +1,3 @@
+-- the history item of a session is stored under the id of the session instead of a sequence of its own
+ALTER TABLE sessions_history ALTER COLUMN id DROP DEFAULT;
+DROP SEQUENCE IF EXISTS sessions_history_id_seq;
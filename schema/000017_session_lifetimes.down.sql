@@ -0,0 +1,10 @@
+ALTER TABLE applications
+    DROP COLUMN session_idle_timeout,
+    DROP COLUMN session_max_lifetime,
+    DROP COLUMN remember_me_idle_timeout,
+    DROP COLUMN remember_me_max_lifetime;
+
+ALTER TABLE sessions
+    DROP COLUMN remember_me,
+    DROP COLUMN created_at,
+    DROP COLUMN last_used_at;
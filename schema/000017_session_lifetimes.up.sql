@@ -0,0 +1,12 @@
+-- sessions remember when they were started and last used, so that idle timeouts and lifetimes can be enforced
+ALTER TABLE sessions
+    ADD COLUMN remember_me boolean not null default false,
+    ADD COLUMN created_at timestamptz not null default now(),
+    ADD COLUMN last_used_at timestamptz not null default now();
+
+-- the lifetimes of the sessions of an application, in seconds, overriding the configured ones when set
+ALTER TABLE applications
+    ADD COLUMN session_idle_timeout int,
+    ADD COLUMN session_max_lifetime int,
+    ADD COLUMN remember_me_idle_timeout int,
+    ADD COLUMN remember_me_max_lifetime int;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS sessions_last_used_at_idx;
+DROP INDEX IF EXISTS sessions_created_at_idx;
+DROP INDEX IF EXISTS authorization_codes_expires_at_idx;
+DROP INDEX IF EXISTS mfa_challenges_expires_at_idx;
+DROP INDEX IF EXISTS webauthn_challenges_expires_at_idx;
@@ -0,0 +1,6 @@
+-- expired rows are looked up by the reaper
+CREATE INDEX sessions_last_used_at_idx ON sessions (last_used_at);
+CREATE INDEX sessions_created_at_idx ON sessions (created_at);
+CREATE INDEX authorization_codes_expires_at_idx ON authorization_codes (expires_at);
+CREATE INDEX mfa_challenges_expires_at_idx ON mfa_challenges (expires_at);
+CREATE INDEX webauthn_challenges_expires_at_idx ON webauthn_challenges (expires_at);
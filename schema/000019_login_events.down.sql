@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS login_events;
+DROP FUNCTION IF EXISTS login_events_immutable();
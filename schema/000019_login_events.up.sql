@@ -0,0 +1,27 @@
+-- sign-in attempts of users, kept after the session ends. Rows are only ever inserted,
+-- and are deleted together with the account they belong to
+CREATE TABLE login_events
+(
+    id bigserial primary key,
+    user_id int references users(id) on delete cascade not null,
+    app_id int references applications(id) on delete set null,
+    result text not null,
+    failure_reason text,
+    mfa text not null,
+    methods text[] not null default '{}',
+    ip_address text,
+    user_agent text,
+    os text,
+    created_at timestamptz not null default now()
+);
+
+CREATE INDEX login_events_user_id_idx ON login_events (user_id, id);
+
+CREATE FUNCTION login_events_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'login events can not be modified';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER login_events_immutable BEFORE UPDATE ON login_events
+    FOR EACH ROW EXECUTE PROCEDURE login_events_immutable();
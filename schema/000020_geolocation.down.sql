@@ -0,0 +1,10 @@
+ALTER TABLE login_events
+    DROP COLUMN city,
+    DROP COLUMN country,
+    DROP COLUMN asn,
+    DROP COLUMN as_organization;
+
+ALTER TABLE sessions_history
+    DROP COLUMN country,
+    DROP COLUMN asn,
+    DROP COLUMN as_organization;
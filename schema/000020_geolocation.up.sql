@@ -0,0 +1,10 @@
+ALTER TABLE sessions_history
+    ADD COLUMN country text,
+    ADD COLUMN asn int,
+    ADD COLUMN as_organization text;
+
+ALTER TABLE login_events
+    ADD COLUMN city text,
+    ADD COLUMN country text,
+    ADD COLUMN asn int,
+    ADD COLUMN as_organization text;
@@ -0,0 +1,9 @@
+-- consecutive second-factor attempts of a user across all challenges, so that codes can not be guessed
+-- by starting new sign-ins or through the account endpoints
+CREATE TABLE mfa_lockouts
+(
+    user_id int references users(id) on delete cascade primary key,
+    attempts int not null,
+    last_attempt_at timestamptz not null,
+    locked_until timestamptz
+);
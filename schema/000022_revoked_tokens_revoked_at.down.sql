@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS revoked_tokens_revoked_at_idx;
+
+ALTER TABLE revoked_tokens DROP COLUMN IF EXISTS revoked_at;
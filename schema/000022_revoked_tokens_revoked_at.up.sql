@@ -0,0 +1,4 @@
+-- instances load the revocations made since their last sync instead of looking up every token
+ALTER TABLE revoked_tokens ADD COLUMN revoked_at timestamptz not null default now();
+
+CREATE INDEX revoked_tokens_revoked_at_idx ON revoked_tokens (revoked_at);
@@ -0,0 +1,5 @@
+-- rotating the signing keys from the admin API is granted separately from managing accounts
+INSERT INTO permissions (name, description) VALUES ('keys:rotate', 'Rotate the token signing keys');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = 'admin' AND p.name = 'keys:rotate';